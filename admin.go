@@ -0,0 +1,55 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// adminStatus is the JSON document served by the admin endpoint
+type adminStatus struct {
+	ID      string       `json:"id"`
+	Addr    string       `json:"addr"`
+	Buckets []BucketStat `json:"buckets"`
+	Stats   Stats        `json:"stats"`
+}
+
+// EnableAdmin serves the node's ID, bucket stats and node stats as JSON at
+// GET /admin on addr, which should be a different port from the node's own.
+// The endpoint stops when the node is closed
+func (node *Node) EnableAdmin(addr string) error {
+	if node.admin != nil {
+		return errors.New("Admin endpoint is already enabled")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	node.admin = l
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin", node.handleAdmin)
+	go func() {
+		err := http.Serve(l, mux)
+		node.logger.Infof("Stopped serving admin endpoint: %s", err)
+	}()
+	node.logger.Infof("Serving admin endpoint on %s", l.Addr().String())
+	return nil
+}
+
+func (node *Node) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod([]string{"GET"}, r, w) {
+		return
+	}
+
+	status := adminStatus{
+		ID:      node.id.Text(keyBase),
+		Addr:    node.addr.String(),
+		Buckets: node.rt.BucketStats(),
+		Stats:   node.Stats(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(status)
+}
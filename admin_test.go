@@ -0,0 +1,44 @@
+package kademlia
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// The admin endpoint serves the node's ID, buckets and stats as JSON
+func TestAdminEndpoint(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	peer := newTestNode(t, network, 10001)
+	node.doPing(context.Background(), peer.addr)
+	addr := freeAddr(t)
+	if err := node.EnableAdmin(addr.String()); err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	resp, err := http.Get("http://" + addr.String() + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status adminStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("admin endpoint didn't return JSON: %s", err)
+	}
+	if status.ID != node.id.Text(keyBase) || status.Addr != node.addr.String() {
+		t.Errorf("admin endpoint reports node %s at %s", status.ID, status.Addr)
+	}
+	if len(status.Buckets) != 1 || status.Buckets[0].Contacts != 1 {
+		t.Errorf("admin endpoint reports buckets %+v, want one with the peer", status.Buckets)
+	}
+	if status.Stats.PingsSent != 1 {
+		t.Errorf("admin endpoint reports %d PINGs sent, want 1", status.Stats.PingsSent)
+	}
+	other := freeAddr(t)
+	if err := node.EnableAdmin(other.String()); err == nil {
+		t.Error("admin endpoint was enabled twice")
+	}
+}
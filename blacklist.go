@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+	"math/big"
+	"sync"
+)
+
+// blacklist is the set of node IDs that a node refuses to deal with. Banned
+// nodes are kept out of the routing table and their RPCs are dropped
+type blacklist struct {
+	ids map[string]bool
+	mu  *sync.Mutex
+}
+
+func newBlacklist() *blacklist {
+	list := new(blacklist)
+	list.ids = make(map[string]bool)
+	list.mu = &sync.Mutex{}
+	return list
+}
+
+func (list *blacklist) add(id big.Int) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.ids[id.Text(keyBase)] = true
+}
+
+func (list *blacklist) remove(id big.Int) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	delete(list.ids, id.Text(keyBase))
+}
+
+func (list *blacklist) contains(id big.Int) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	return list.ids[id.Text(keyBase)]
+}
+
+// Blacklist bans the node with id. It is removed from the routing table, won't
+// be added back and any RPCs it sends us are dropped
+func (node *Node) Blacklist(id big.Int) {
+	node.logger.Infof("Blacklisting %s", id.Text(keyBase))
+	node.banned.add(id)
+	node.rt.removeByID(id)
+}
+
+// Unblacklist lifts the ban on the node with id. It is added back to the
+// routing table the next time we hear from it
+func (node *Node) Unblacklist(id big.Int) {
+	node.logger.Infof("Unblacklisting %s", id.Text(keyBase))
+	node.banned.remove(id)
+}
@@ -0,0 +1,41 @@
+package kademlia
+
+import (
+	"context"
+	"net/rpc"
+	"testing"
+)
+
+func TestBlacklist(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	banned := newTestNode(t, network, 10001)
+	if !banned.doPing(context.Background(), node.addr) {
+		t.Fatal("PING wasn't answered before the ban")
+	}
+	if node.rt.ContactFromID(banned.id) == nil {
+		t.Fatal("PING didn't add the sender to the routing table")
+	}
+
+	node.Blacklist(banned.id)
+	if node.rt.ContactFromID(banned.id) != nil {
+		t.Error("Blacklist didn't remove the node from the routing table")
+	}
+	args := PingArgs{Source: banned.addr, Version: protocolVersion}
+	var reply PingReply
+	err := network.Call(context.Background(), node.addr, "Ping", args, &reply)
+	if _, ok := err.(rpc.ServerError); !ok {
+		t.Errorf("PING from a banned node returned %v, want a server error", err)
+	}
+	if node.rt.add(*NewContactWithID(banned.id, banned.addr)) != contactDropped {
+		t.Error("a banned node was added back to the routing table")
+	}
+
+	node.Unblacklist(banned.id)
+	if !banned.doPing(context.Background(), node.addr) {
+		t.Fatal("PING wasn't answered after the ban was lifted")
+	}
+	if node.rt.ContactFromID(banned.id) == nil {
+		t.Error("an unbanned node wasn't added back when it got in touch")
+	}
+}
@@ -0,0 +1,24 @@
+package kademlia
+
+import (
+	"time"
+)
+
+// Clock tells the time. Every timestamp a Node keeps comes from its Clock so
+// that time-based behavior can be tested without waiting on the wall clock
+type Clock interface {
+	Now() time.Time
+	// After returns a channel that receives the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the default Clock, backed by time.Now
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,32 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+)
+
+// FindClosestLive returns the node closest to target that answers a PING
+// The k closest nodes the lookup finds are pinged closest first until one
+// answers, so dead nodes that other tables still list are skipped, however
+// many of the closest there are. The liveness cache isn't trusted here:
+// every candidate tried is pinged again. Returns an error if none answer, or
+// ctx's error if ctx is done first
+func (node *Node) FindClosestLive(ctx context.Context, target big.Int) (*Contact, error) {
+	candidates, err := node.doIterativeFindNode(ctx, target.Text(keyBase))
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if candidate.Id.Cmp(&node.id) == 0 {
+			continue
+		}
+		if node.answersPing(ctx, candidate) {
+			return &candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("No live node found near %s", IDToHex(target))
+}
@@ -0,0 +1,49 @@
+package kademlia
+
+import (
+	"context"
+	"sort"
+	"testing"
+)
+
+// byDistance returns nodes sorted by their distance to target
+func byDistance(nodes []*Node, target Contact) []*Node {
+	sorted := append([]*Node(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return Distance(target.Id, sorted[i].id).Cmp(Distance(target.Id, sorted[j].id)) < 0
+	})
+	return sorted
+}
+
+// The nodes closest to the target are dead, more of them than alpha, so the
+// live node just behind them has to be found
+func TestFindClosestLiveSkipsDeadNodes(t *testing.T) {
+	network, nodes := newTestNetwork(t, 16)
+	searcher := nodes[0]
+	target := *NewContactWithID(nodes[1].id, nodes[1].addr)
+
+	candidates := byDistance(nodes[1:], target)
+	dead := candidates[:searcher.alpha+1]
+	for _, node := range dead {
+		network.Remove(node.addr)
+	}
+	want := candidates[len(dead)]
+
+	got, err := searcher.FindClosestLive(context.Background(), target.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Id.Cmp(&want.id) != 0 {
+		t.Errorf("FindClosestLive returned %s, want the closest live node %s", got, want)
+	}
+}
+
+func TestFindClosestLiveAllDead(t *testing.T) {
+	network, nodes := newTestNetwork(t, 4)
+	for _, node := range nodes[1:] {
+		network.Remove(node.addr)
+	}
+	if got, err := nodes[0].FindClosestLive(context.Background(), nodes[1].id); err == nil {
+		t.Errorf("FindClosestLive returned %s with every other node dead", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"time"
 )
@@ -58,7 +59,15 @@ func main() {
 		fmt.Println("Contacting ", bootstrapAddr)
 	}
 
-	node := kademlia.NewNode(addr)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	node, err := kademlia.NewNode(*tcpAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	fmt.Println(node)
 
@@ -0,0 +1,142 @@
+package kademlia
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// connPool keeps idle RPC clients around so that repeated RPCs to the same
+// peer don't each have to open a new connection
+type connPool struct {
+	idle        map[string][]pooledClient
+	maxIdle     int           // max number of idle clients kept per peer
+	timeout     time.Duration // idle clients older than this are closed
+	dialTimeout time.Duration // how long a dial may take, or zero for no limit
+	dial        func(ctx context.Context, addr string, timeout time.Duration) (*rpcClient, error)
+	clock       Clock
+	mu          *sync.Mutex
+}
+
+// rpcClient is an RPC client and the connection it runs over, which is kept
+// so that read deadlines can be set on it
+type rpcClient struct {
+	*rpc.Client
+	conn net.Conn
+}
+
+// pooledClient is an idle client and the time it was returned to the pool
+type pooledClient struct {
+	client   *rpcClient
+	returned time.Time
+}
+
+func newConnPool(maxIdle int, timeout time.Duration, dialTimeout time.Duration, clock Clock) *connPool {
+	pool := new(connPool)
+	pool.idle = make(map[string][]pooledClient)
+	pool.maxIdle = maxIdle
+	pool.timeout = timeout
+	pool.dialTimeout = dialTimeout
+	pool.dial = dialHTTP
+	pool.clock = clock
+	pool.mu = &sync.Mutex{}
+	return pool
+}
+
+// get returns an idle client for addr, or dials a new one if there isn't one
+func (pool *connPool) get(ctx context.Context, addr string) (*rpcClient, error) {
+	pool.mu.Lock()
+	pool.evictIdle()
+	clients := pool.idle[addr]
+	if len(clients) > 0 {
+		client := clients[len(clients)-1].client
+		pool.idle[addr] = clients[:len(clients)-1]
+		pool.mu.Unlock()
+		return client, nil
+	}
+	pool.mu.Unlock()
+
+	return pool.dial(ctx, addr, pool.dialTimeout)
+}
+
+// dialHTTP connects to the RPC server at addr like rpc.DialHTTP, except that
+// the dial and the HTTP handshake are abandoned if ctx is done or timeout
+// passes. A zero timeout only leaves ctx
+func dialHTTP(ctx context.Context, addr string, timeout time.Duration) (*rpcClient, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if timeout > 0 && (!ok || time.Now().Add(timeout).Before(deadline)) {
+		deadline, ok = time.Now().Add(timeout), true
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &rpcClient{rpc.NewClient(conn), conn}, nil
+}
+
+// put hands client back to the pool once an RPC on it has succeeded. The
+// client is closed if addr already has maxIdle idle clients
+func (pool *connPool) put(addr string, client *rpcClient) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.idle[addr]) >= pool.maxIdle {
+		client.Close()
+		return
+	}
+	pool.idle[addr] = append(pool.idle[addr], pooledClient{client, pool.clock.Now()})
+}
+
+// evictIdle closes clients that have been idle for longer than the timeout
+// The caller must hold the pool's lock
+func (pool *connPool) evictIdle() {
+	now := pool.clock.Now()
+	for addr, clients := range pool.idle {
+		kept := clients[:0]
+		for _, pooled := range clients {
+			if now.Sub(pooled.returned) > pool.timeout {
+				pooled.client.Close()
+			} else {
+				kept = append(kept, pooled)
+			}
+		}
+		if len(kept) == 0 {
+			delete(pool.idle, addr)
+		} else {
+			pool.idle[addr] = kept
+		}
+	}
+}
+
+// closeAll closes every idle client
+func (pool *connPool) closeAll() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for addr, clients := range pool.idle {
+		for _, pooled := range clients {
+			pooled.client.Close()
+		}
+		delete(pool.idle, addr)
+	}
+}
@@ -0,0 +1,40 @@
+package kademlia
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A second RPC to the same peer goes over the connection the first one
+// opened, until it has been idle for too long
+func TestConnPoolReusesConnections(t *testing.T) {
+	server := listeningNode(t)
+	client := listeningNode(t)
+	pool := client.transport.(*tcpTransport).pool
+	clock := newFakeClock()
+	pool.clock = clock
+	var dials int32
+	pool.dial = func(ctx context.Context, addr string, timeout time.Duration) (*rpcClient, error) {
+		atomic.AddInt32(&dials, 1)
+		return dialHTTP(ctx, addr, timeout)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !client.doPing(context.Background(), server.addr) {
+			t.Fatalf("PING %d failed", i)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("3 PINGs dialed %d connections, want 1", n)
+	}
+
+	clock.Advance(tIdleConn + time.Second)
+	if !client.doPing(context.Background(), server.addr) {
+		t.Fatal("PING after the idle timeout failed")
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("PING after the idle timeout dialed %d connections in all, want 2", n)
+	}
+}
@@ -0,0 +1,81 @@
+package kademlia
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// EncodeBinary encodes the contact's ID and address compactly. The ID is
+// a length byte followed by its big-endian bytes, padded with leading zeros
+// to the default ID size; the IP is a length byte (0, 4 or 16) followed by
+// its bytes; and the port is two big-endian bytes. The IPv6 zone and the
+// local fields like lastSeen aren't encoded
+//
+// It is deliberately not MarshalBinary: gob would pick that up and change how
+// every RPC carrying a Contact is encoded, which older peers can't decode
+func (contact Contact) EncodeBinary() ([]byte, error) {
+	if contact.Id.Sign() < 0 {
+		return nil, errors.New("Can't encode a negative contact ID")
+	}
+	id := contact.Id.Bytes()
+	idLen := idBits / 8
+	if len(id) > idLen {
+		idLen = len(id)
+	}
+	if idLen > 255 {
+		return nil, fmt.Errorf("Contact ID of %d bytes is too long to encode", idLen)
+	}
+
+	ip := contact.Addr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) != 0 && len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("Can't encode IP address of %d bytes", len(ip))
+	}
+	if contact.Addr.Port < 0 || contact.Addr.Port > 65535 {
+		return nil, fmt.Errorf("Can't encode port %d", contact.Addr.Port)
+	}
+
+	data := make([]byte, 0, 1+idLen+1+len(ip)+2)
+	data = append(data, byte(idLen))
+	data = append(data, make([]byte, idLen-len(id))...)
+	data = append(data, id...)
+	data = append(data, byte(len(ip)))
+	data = append(data, ip...)
+	data = binary.BigEndian.AppendUint16(data, uint16(contact.Addr.Port))
+	return data, nil
+}
+
+// DecodeBinary decodes a contact encoded by EncodeBinary, replacing the
+// contact's ID and address. Its local fields are reset
+func (contact *Contact) DecodeBinary(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("Contact encoding is empty")
+	}
+	idLen := int(data[0])
+	data = data[1:]
+	if len(data) < idLen+1 {
+		return errors.New("Contact encoding is truncated in the ID")
+	}
+	id := data[:idLen]
+	ipLen := int(data[idLen])
+	data = data[idLen+1:]
+	if ipLen != 0 && ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return fmt.Errorf("Contact encoding has an IP address of %d bytes", ipLen)
+	}
+	if len(data) != ipLen+2 {
+		return errors.New("Contact encoding has the wrong length for its address")
+	}
+
+	var decoded Contact
+	decoded.Id.SetBytes(id)
+	if ipLen != 0 {
+		decoded.Addr.IP = make(net.IP, ipLen)
+		copy(decoded.Addr.IP, data[:ipLen])
+	}
+	decoded.Addr.Port = int(binary.BigEndian.Uint16(data[ipLen:]))
+	*contact = decoded
+	return nil
+}
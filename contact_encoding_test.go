@@ -0,0 +1,65 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"net"
+	"testing"
+)
+
+func TestContactEncodingRoundTrip(t *testing.T) {
+	contacts := []Contact{
+		*NewContactWithID(*big.NewInt(1), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}),
+		*NewContactWithID(*big.NewInt(0), net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 65535}),
+		*NewContactWithID(*new(big.Int).Lsh(big.NewInt(1), idBits-1), net.TCPAddr{Port: 1}),
+	}
+	for _, contact := range contacts {
+		data, err := contact.EncodeBinary()
+		if err != nil {
+			t.Fatalf("Encoding %s: %s", contact, err)
+		}
+		var decoded Contact
+		if err := decoded.DecodeBinary(data); err != nil {
+			t.Fatalf("Decoding %s: %s", contact, err)
+		}
+		if decoded.Id.Cmp(&contact.Id) != 0 || !AreEqualAddrs(decoded.Addr, contact.Addr) {
+			t.Errorf("%s decoded as %s", contact, decoded)
+		}
+	}
+}
+
+func TestContactEncodingRejectsTruncated(t *testing.T) {
+	contact := *NewContactWithID(*big.NewInt(7), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000})
+	data, err := contact.EncodeBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		var decoded Contact
+		if err := decoded.DecodeBinary(data[:n]); err == nil {
+			t.Errorf("Decoded %d of %d bytes without an error", n, len(data))
+		}
+	}
+}
+
+// gob must keep encoding a Contact as a plain struct, which is what peers
+// before the binary encoding expect
+func TestContactGobLayoutUnchanged(t *testing.T) {
+	type plainContact struct {
+		Id   big.Int
+		Addr net.TCPAddr
+	}
+	contact := *NewContactWithID(*big.NewInt(42), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000})
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&contact); err != nil {
+		t.Fatal(err)
+	}
+	var decoded plainContact
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("A Contact doesn't decode as a plain struct: %s", err)
+	}
+	if decoded.Id.Cmp(&contact.Id) != 0 || !AreEqualAddrs(decoded.Addr, contact.Addr) {
+		t.Errorf("%s decoded as %v", contact, decoded)
+	}
+}
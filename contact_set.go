@@ -0,0 +1,36 @@
+package kademlia
+
+// ContactSet is a set of contacts keyed by ID. Contacts hold a big.Int so
+// they can't be map keys themselves
+type ContactSet map[string]Contact
+
+// NewContactSet returns an empty ContactSet
+func NewContactSet() ContactSet {
+	return make(ContactSet)
+}
+
+// Add puts contact in the set and reports whether it wasn't there already
+func (set ContactSet) Add(contact Contact) bool {
+	key := contact.Id.Text(keyBase)
+	if _, ok := set[key]; ok {
+		return false
+	}
+	set[key] = contact
+	return true
+}
+
+// Contains reports whether a contact with contact's ID is in the set
+func (set ContactSet) Contains(contact Contact) bool {
+	_, ok := set[contact.Id.Text(keyBase)]
+	return ok
+}
+
+// Remove takes the contact with contact's ID out of the set
+func (set ContactSet) Remove(contact Contact) {
+	delete(set, contact.Id.Text(keyBase))
+}
+
+// Len returns the number of contacts in the set
+func (set ContactSet) Len() int {
+	return len(set)
+}
@@ -0,0 +1,37 @@
+package kademlia
+
+import (
+	"math/big"
+	"net"
+	"testing"
+)
+
+// Membership is by ID: a contact is only added once, however its address or
+// big.Int representation differ, and a nil set contains nothing
+func TestContactSet(t *testing.T) {
+	set := NewContactSet()
+	a := *NewContactWithID(*big.NewInt(1), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+	sameID := *NewContactWithID(*new(big.Int).SetBytes([]byte{0, 0, 1}), net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2})
+	b := *NewContactWithID(*big.NewInt(2), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+
+	if !set.Add(a) || set.Add(a) || set.Add(sameID) {
+		t.Error("Add didn't report only the first add of an ID as new")
+	}
+	if set.Len() != 1 || !set.Contains(sameID) || set.Contains(b) {
+		t.Errorf("set of one ID has Len %d, contains its ID %t, contains another %t", set.Len(), set.Contains(sameID), set.Contains(b))
+	}
+	set.Add(b)
+	set.Remove(sameID)
+	if set.Len() != 1 || set.Contains(a) || !set.Contains(b) {
+		t.Error("Remove didn't take out only the contact with its ID")
+	}
+	set.Remove(a)
+	if set.Len() != 1 {
+		t.Error("removing an absent contact changed the set")
+	}
+
+	var none ContactSet
+	if none.Contains(a) || none.Len() != 0 {
+		t.Error("a nil set isn't empty")
+	}
+}
@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"math/big"
+	"testing"
+	"testing/quick"
+)
+
+// quickID turns quick's random bytes into an ID of at most idBits
+func quickID(b [idBits / 8]byte) big.Int {
+	return *new(big.Int).SetBytes(b[:])
+}
+
+func TestDistanceProperties(t *testing.T) {
+	symmetric := func(a, b [idBits / 8]byte) bool {
+		return Distance(quickID(a), quickID(b)).Cmp(Distance(quickID(b), quickID(a))) == 0
+	}
+	zeroToSelf := func(a [idBits / 8]byte) bool {
+		return Distance(quickID(a), quickID(a)).Sign() == 0
+	}
+	triangle := func(a, b, c [idBits / 8]byte) bool {
+		sum := new(big.Int).Add(Distance(quickID(a), quickID(b)), Distance(quickID(b), quickID(c)))
+		return Distance(quickID(a), quickID(c)).Cmp(sum) <= 0
+	}
+	// for any ID and distance there is exactly one ID at that distance
+	unidirectional := func(a, b [idBits / 8]byte) bool {
+		d := Distance(quickID(a), quickID(b))
+		back := new(big.Int).Xor(d, new(big.Int).SetBytes(a[:]))
+		return back.Cmp(new(big.Int).SetBytes(b[:])) == 0
+	}
+	for name, property := range map[string]interface{}{
+		"symmetric":      symmetric,
+		"zero to self":   zeroToSelf,
+		"triangle":       triangle,
+		"unidirectional": unidirectional,
+	} {
+		if err := quick.Check(property, nil); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	a := *big.NewInt(0)
+	top := *new(big.Int).Lsh(big.NewInt(1), idBits-1)
+	if got := CommonPrefixLen(a, a); got != idBits {
+		t.Errorf("CommonPrefixLen of equal IDs = %d, want %d", got, idBits)
+	}
+	if got := CommonPrefixLen(a, top); got != 0 {
+		t.Errorf("CommonPrefixLen of IDs differing in the top bit = %d, want 0", got)
+	}
+	if got := CommonPrefixLen(a, *big.NewInt(1)); got != idBits-1 {
+		t.Errorf("CommonPrefixLen of IDs differing in the last bit = %d, want %d", got, idBits-1)
+	}
+
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithHash(SHA256), WithIDBits(256))
+	if got := node.CommonPrefixLen(a, a); got != 256 {
+		t.Errorf("Node.CommonPrefixLen of equal 256-bit IDs = %d, want 256", got)
+	}
+	if got := node.CommonPrefixLen(a, top); got != 256-idBits {
+		t.Errorf("Node.CommonPrefixLen in a 256-bit space = %d, want %d", got, 256-idBits)
+	}
+}
@@ -6,9 +6,27 @@ import "time"
 // TTL from original publication date
 const tExpire = 864000 * time.Second
 
+// tCache is how long a value cached on a node along a lookup path is kept
+const tCache = 3600 * time.Second
+
+// tStoreCheck is how often stored values are checked for expiration and
+// republishing
+const tStoreCheck = 600 * time.Second
+
 // tRefresh is the time after which an unaccessed bucket must be refreshed
 const tRefresh = 3600 * time.Second
 
+// tAgeOut is how long a contact can go without being heard from before it is
+// pinged, and removed if it doesn't answer
+const tAgeOut = 86400 * time.Second
+
+// tRefreshCheck is how often buckets are checked to see if they need a refresh
+const tRefreshCheck = 600 * time.Second
+
+// tSiblingRefresh is how often a node looks up its own ID to keep its sibling
+// set fresh, unless it was created WithSelfLookupInterval
+const tSiblingRefresh = 600 * time.Second
+
 // tReplicate is the interval between replication events, when a node is
 // required to publish its entire database
 const tReplicate = 3600 * time.Second
@@ -17,15 +35,102 @@ const tReplicate = 3600 * time.Second
 // key/value pair
 const tRepublish = 86400 * time.Second
 
+// tLiveness is how long a successful PING is trusted before a contact that is
+// up for eviction is pinged again
+const tLiveness = 10 * time.Second
+
+// readyPollInterval is how often WaitReady checks whether the node is ready
+const readyPollInterval = 100 * time.Millisecond
+
+// shortlistPrefixBits is how many leading bits two lookup targets must share
+// to reuse each other's shortlists when the shortlist cache is enabled
+const shortlistPrefixBits = 8
+
+// tIdleConn is how long an idle RPC connection is kept open for reuse
+const tIdleConn = 60 * time.Second
+
+// tRPCIdle is how long the server keeps an RPC connection with no requests on
+// it open. It is longer than tIdleConn so that clients close their pooled
+// connections first
+const tRPCIdle = 2 * tIdleConn
+
+// tRPCRead is how long the server waits for the rest of a request once it
+// has started arriving
+const tRPCRead = 10 * time.Second
+
+// tDial is how long connecting to a peer may take before the RPC fails
+const tDial = 3 * time.Second
+
+// tReply is how long a peer has to answer an RPC once it has been sent
+const tReply = 5 * time.Second
+
+// maxIdleConns is the number of idle RPC connections kept open per peer
+const maxIdleConns = 2
+
+// maxLookupRounds is the most rounds an iterative lookup runs for
+const maxLookupRounds = 20
+
+// lookupStallRounds is how many rounds in a row an iterative lookup may fail
+// to find a closer contact before it stops
+const lookupStallRounds = 3
+
+// rpcRate is how many inbound RPCs per second a source IP may send once it
+// has used up its burst of rpcBurst
+const rpcRate = 100
+const rpcBurst = 200
+
+// maxRateLimitSources is how many source IPs the rate limiter tracks before
+// it drops the ones that are back at their full burst
+const maxRateLimitSources = 4096
+
+// republishRate is how many key/value pairs per second periodic republishes
+// send. At this rate a tStoreCheck is enough for 60000 pairs
+const republishRate = 100
+
+// storeQueueSize is how many BATCHSTOREs the store queue holds
+const storeQueueSize = 1024
+
+// republishBatchSize is the most key/value pairs a queued BATCHSTORE carries
+const republishBatchSize = 100
+
+// protocolVersion is the version of the RPC messages this node speaks. It is
+// advertised in PINGs so that peers can tell which messages we understand
+// Version 1 is the original protocol; version 2 added BATCHSTORE
+const protocolVersion = 2
+
+// minProtocolVersion is the oldest version we still talk to
+const minProtocolVersion = 1
+
+// batchStoreVersion is the first version that understands BATCHSTORE
+const batchStoreVersion = 2
+
+// maxFailures is how many RPCs in a row a contact can fail before it is
+// removed from the routing table
+const maxFailures = 5
+
+// maxRetryDoublings is how many times the delay between retries of an RPC
+// can double before it stops growing
+const maxRetryDoublings = 16
+
 // Alpha is the degree of parallelism in network calls
 const alpha = 3
 
-// k is the maximum number of contacts stored in a bucket
+// idBits is the default size of node and key IDs, which is the output size
+// of SHA-1
+const idBits = 160
+
+// k is the default maximum number of contacts stored in a bucket
 const k = 4
 
+// maxValueSize is the largest value in bytes that a node will store
+const maxValueSize = 65536
+
 // keys should be stored as hex when in string form
 const keyBase = 16
 
+// contactIDPrefix is how many hex digits of its ID a contact is printed with
+const contactIDPrefix = 8
+
 // turn caching on and off
 const caching_on = true
 
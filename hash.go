@@ -0,0 +1,44 @@
+package kademlia
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"math/big"
+	"net"
+)
+
+// HashFunc maps data to an ID. Its output size must match the node's ID
+// space, which is 160 bits unless set with WithIDBits. A node's ID is the hash
+// of its address, and the keys passed to Get and Put are hashed into IDs the
+// same way
+type HashFunc func(data []byte) big.Int
+
+// SHA1 is the default HashFunc
+func SHA1(data []byte) big.Int {
+	sum := sha1.Sum(data)
+	return *new(big.Int).SetBytes(sum[:])
+}
+
+// SHA256Truncated is a HashFunc that keeps the first 160 bits of the SHA-256
+// hash of data
+func SHA256Truncated(data []byte) big.Int {
+	sum := sha256.Sum256(data)
+	return *new(big.Int).SetBytes(sum[:sha1.Size])
+}
+
+// SHA256 is a HashFunc for a 256-bit ID space
+func SHA256(data []byte) big.Int {
+	sum := sha256.Sum256(data)
+	return *new(big.Int).SetBytes(sum[:])
+}
+
+// hashAddr returns the ID that hash gives the node at addr
+func hashAddr(addr net.TCPAddr, hash HashFunc) big.Int {
+	return hash([]byte(canonicalAddr(addr)))
+}
+
+// newContact returns the contact for addr, with the ID that the node's hash
+// function gives it
+func (node *Node) newContact(addr net.TCPAddr) *Contact {
+	return NewContactWithID(hashAddr(addr, node.hash), addr)
+}
@@ -1,6 +1,10 @@
 package kademlia
 
-import ()
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 // KVStore holds mappings from keys to values and keeps track if a given node is
 // the owner of the value
@@ -8,47 +12,174 @@ type KVStore struct {
 	//owner    *Node
 	ht       map[string][]byte
 	isOrigin map[string]bool
+	// isCached holds the keys whose values were only cached here along a
+	// lookup path
+	isCached map[string]bool
+	// publishedAt is when a key was last stored or republished, and expiresAt
+	// is when it will be dropped unless it is stored again
+	publishedAt map[string]time.Time
+	expiresAt   map[string]time.Time
+	clock       Clock
+	mu          *sync.Mutex
 }
 
-// NewKVStore returns a newly initialized KVStore
-func NewKVStore() *KVStore {
+// NewKVStore returns a newly initialized KVStore that uses clock for TTLs
+func NewKVStore(clock Clock) *KVStore {
 	kvStore := new(KVStore)
 	kvStore.ht = make(map[string][]byte)
 	kvStore.isOrigin = make(map[string]bool)
+	kvStore.isCached = make(map[string]bool)
+	kvStore.publishedAt = make(map[string]time.Time)
+	kvStore.expiresAt = make(map[string]time.Time)
+	kvStore.clock = clock
+	kvStore.mu = &sync.Mutex{}
 
 	//kvStore.owner = owner
 	return kvStore
 }
 
 func (store *KVStore) get(key string) ([]byte, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
 	if val, ok := store.ht[key]; ok {
 		return val, true
 	}
 	return nil, false
 }
 
-// Will overwrite existing value
-func (store *KVStore) add(key string, val []byte, isOrigin bool) {
+// keys returns every key in the store
+func (store *KVStore) keys() []string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	keys := make([]string, 0, len(store.ht))
+	for key := range store.ht {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Will overwrite existing value and restart its TTL
+// Returns an error if val is larger than maxValueSize
+func (store *KVStore) add(key string, val []byte, isOrigin bool) error {
+	if len(val) > maxValueSize {
+		return fmt.Errorf("Value for key %s is %d bytes, limit is %d", key, len(val), maxValueSize)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
 	store.ht[key] = val
 	store.isOrigin[key] = isOrigin
+	delete(store.isCached, key)
+	now := store.clock.Now()
+	store.publishedAt[key] = now
+	store.expiresAt[key] = now.Add(tExpire)
+	return nil
+}
+
+// addBatch adds every pair in pairs like add, as a single update. If any value
+// is larger than maxValueSize nothing is stored
+func (store *KVStore) addBatch(pairs []KeyValue, isOrigin bool) error {
+	for _, pair := range pairs {
+		if len(pair.Val) > maxValueSize {
+			return fmt.Errorf("Value for key %s is %d bytes, limit is %d", pair.Key, len(pair.Val), maxValueSize)
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.clock.Now()
+	for _, pair := range pairs {
+		store.ht[pair.Key] = pair.Val
+		store.isOrigin[pair.Key] = isOrigin
+		delete(store.isCached, pair.Key)
+		store.publishedAt[pair.Key] = now
+		store.expiresAt[pair.Key] = now.Add(tExpire)
+	}
+	return nil
+}
+
+// cache keeps a copy of val for ttl. It isn't republished, and a value that
+// is already stored here normally is left as it is
+func (store *KVStore) cache(key string, val []byte, ttl time.Duration) error {
+	if len(val) > maxValueSize {
+		return fmt.Errorf("Value for key %s is %d bytes, limit is %d", key, len(val), maxValueSize)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.ht[key]; ok && !store.isCached[key] {
+		return nil
+	}
+	store.ht[key] = val
+	store.isOrigin[key] = false
+	store.isCached[key] = true
+	now := store.clock.Now()
+	store.publishedAt[key] = now
+	store.expiresAt[key] = now.Add(ttl)
+	return nil
+}
+
+// markPublished records that key was just republished, which restarts its TTL
+func (store *KVStore) markPublished(key string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.ht[key]; !ok {
+		return
+	}
+	now := store.clock.Now()
+	store.publishedAt[key] = now
+	store.expiresAt[key] = now.Add(tExpire)
+}
+
+// expire removes every key whose TTL has run out and returns how many were
+// removed. Keys we are the origin of never expire
+func (store *KVStore) expire() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := store.clock.Now()
+	removed := 0
+	for key, expiresAt := range store.expiresAt {
+		if store.isOrigin[key] || now.Before(expiresAt) {
+			continue
+		}
+		delete(store.ht, key)
+		delete(store.isOrigin, key)
+		delete(store.isCached, key)
+		delete(store.publishedAt, key)
+		delete(store.expiresAt, key)
+		removed++
+	}
+	return removed
 }
 
 // KV contains all the information we have for a key
 type KV struct {
-	key      string
-	val      []byte
-	isOrigin bool
+	key         string
+	val         []byte
+	isOrigin    bool
+	isCached    bool
+	publishedAt time.Time
+	expiresAt   time.Time
 }
 
 // Iterator returns a channel that iterates over all the keys that we've stored
+// The keys are copied up front so the store isn't locked while the channel is
+// being read
 func (store *KVStore) Iterator() chan *KV {
+	store.mu.Lock()
+	kvs := make([]*KV, 0, len(store.ht))
+	for k, v := range store.ht {
+		kv := new(KV)
+		kv.key = k
+		kv.val = v
+		kv.isOrigin = store.isOrigin[k]
+		kv.isCached = store.isCached[k]
+		kv.publishedAt = store.publishedAt[k]
+		kv.expiresAt = store.expiresAt[k]
+		kvs = append(kvs, kv)
+	}
+	store.mu.Unlock()
+
 	ch := make(chan *KV)
 	go func() {
-		for k, v := range store.ht {
-			kv := new(KV)
-			kv.key = k
-			kv.val = v
-			kv.isOrigin = store.isOrigin[k]
+		for _, kv := range kvs {
 			ch <- kv
 		}
 		close(ch)
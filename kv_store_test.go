@@ -0,0 +1,85 @@
+package kademlia
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+)
+
+// Run with -race: STOREs arriving at once all land
+func TestConcurrentStores(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	peer := newTestNode(t, network, 10001)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			args := StoreArgs{Source: peer.addr, Key: fmt.Sprintf("%x", i), Val: []byte{byte(i)}}
+			if err := node.Store(args, &StoreReply{}); err != nil {
+				t.Errorf("STORE of key %x failed: %s", i, err)
+			}
+			node.ht.get(fmt.Sprintf("%x", i+1))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		if val, ok := node.ht.get(fmt.Sprintf("%x", i)); !ok || !bytes.Equal(val, []byte{byte(i)}) {
+			t.Errorf("key %x holds %v, %t", i, val, ok)
+		}
+	}
+}
+
+func TestOversizedStoreRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	peer := newTestNode(t, network, 10001)
+
+	args := StoreArgs{Source: peer.addr, Key: "abc", Val: make([]byte, maxValueSize+1)}
+	if err := node.Store(args, &StoreReply{}); err == nil {
+		t.Error("STORE of an oversized value succeeded")
+	}
+	if _, ok := node.ht.get("abc"); ok {
+		t.Error("oversized value was stored")
+	}
+
+	args.Val = make([]byte, maxValueSize)
+	if err := node.Store(args, &StoreReply{}); err != nil {
+		t.Errorf("STORE of a value at the limit failed: %s", err)
+	}
+}
+
+// LocalKeys lists exactly the keys stored on the node, and LocalValue reads
+// them without a lookup
+func TestLocalKeys(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	want := make(map[string][]byte)
+	for i := 0; i < 5; i++ {
+		key := node.keyID([]byte{byte(i)})
+		want[key] = []byte{byte(i), 1}
+		node.ht.add(key, want[key], true)
+	}
+
+	keys := node.LocalKeys()
+	if len(keys) != len(want) {
+		t.Errorf("LocalKeys returned %d keys, want %d", len(keys), len(want))
+	}
+	for _, key := range keys {
+		expected, ok := want[key.Text(keyBase)]
+		if !ok {
+			t.Errorf("LocalKeys returned %s, which wasn't stored", key.Text(keyBase))
+			continue
+		}
+		if value, found := node.LocalValue(key); !found || !bytes.Equal(value, expected) {
+			t.Errorf("LocalValue(%s) = %v, %t, want %v", key.Text(keyBase), value, found, expected)
+		}
+	}
+	if _, found := node.LocalValue(*big.NewInt(12345)); found {
+		t.Error("LocalValue found a key that wasn't stored")
+	}
+}
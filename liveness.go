@@ -0,0 +1,55 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// livenessCache remembers which contacts answered a PING recently, so that a
+// contact isn't pinged again every time it is a candidate for eviction
+type livenessCache struct {
+	answered map[string]time.Time
+	ttl      time.Duration // how long a successful PING is trusted for
+	clock    Clock
+	mu       *sync.Mutex
+}
+
+func newLivenessCache(ttl time.Duration, clock Clock) *livenessCache {
+	cache := new(livenessCache)
+	cache.answered = make(map[string]time.Time)
+	cache.ttl = ttl
+	cache.clock = clock
+	cache.mu = &sync.Mutex{}
+	return cache
+}
+
+// livenessKey returns the key contact is cached under. It includes the ID, so
+// that in signed mode a contact claiming another node's address doesn't count
+// as alive because that node answered
+func livenessKey(contact Contact) string {
+	return contact.Id.Text(keyBase) + "@" + contact.Addr.String()
+}
+
+// markAlive records that the contact with key just answered a PING. Entries
+// older than the ttl are dropped at the same time so the cache doesn't grow
+// without bound
+func (cache *livenessCache) markAlive(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := cache.clock.Now()
+	for other, answered := range cache.answered {
+		if now.Sub(answered) >= cache.ttl {
+			delete(cache.answered, other)
+		}
+	}
+	cache.answered[key] = now
+}
+
+// isAlive reports whether the contact with key answered a PING within the
+// last ttl
+func (cache *livenessCache) isAlive(key string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	answered, ok := cache.answered[key]
+	return ok && cache.clock.Now().Sub(answered) < cache.ttl
+}
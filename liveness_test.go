@@ -0,0 +1,30 @@
+package kademlia
+
+import "testing"
+
+// A full bucket pings its least recently seen contact when a newcomer
+// arrives, but not again for the next newcomer within tLiveness
+func TestLivenessCacheSkipsPing(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithK(1), WithClock(clock))
+	// a live peer in the far half of the ID space, whose bucket won't split
+	peer := farPeers(t, network, node, 1)[0]
+	node.rt.ImportContacts([]Contact{
+		*NewContactWithID(peer.id, peer.addr),
+		contactAtDistance(node.id, 10, 0, 1),
+	})
+
+	pings := node.Stats().PingsSent
+	for i, want := range []uint64{1, 1, 2} {
+		if i == 2 {
+			clock.Advance(tLiveness)
+		}
+		if result := node.rt.add(contactAtDistance(node.id, idBits-1, int64(i), i+2)); result != contactCached {
+			t.Fatalf("newcomer %d got %v, want it cached", i, result)
+		}
+		if sent := node.Stats().PingsSent - pings; sent != want {
+			t.Errorf("after newcomer %d, %d PINGs were sent, want %d", i, sent, want)
+		}
+	}
+}
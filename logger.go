@@ -0,0 +1,77 @@
+package kademlia
+
+import (
+	"fmt"
+	"log"
+)
+
+// Level is how important a log message is
+type Level int
+
+const (
+	// LevelDebug is for step-by-step detail of RPCs, lookups and buckets
+	LevelDebug Level = iota
+	// LevelInfo is for things an operator would want to know happened
+	LevelInfo
+	// LevelWarn is for failures the node recovers from by itself
+	LevelWarn
+	// LevelError is for failures that stop the node from doing what it was
+	// asked
+	LevelError
+)
+
+// Logger is a leveled log that a Node writes to. The methods format their
+// arguments like log.Printf
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NewLogger returns a Logger that writes messages of at least level to out
+func NewLogger(out *log.Logger, level Level) Logger {
+	return &levelLogger{out, level}
+}
+
+// NopLogger returns a Logger that discards everything
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+type levelLogger struct {
+	out   *log.Logger
+	level Level
+}
+
+// logf writes a message at level with the given prefix. The call depth points
+// log.Lshortfile at the caller of Debugf, Infof, etc
+func (logger *levelLogger) logf(level Level, prefix string, format string, v []interface{}) {
+	if level < logger.level {
+		return
+	}
+	logger.out.Output(3, prefix+fmt.Sprintf(format, v...))
+}
+
+func (logger *levelLogger) Debugf(format string, v ...interface{}) {
+	logger.logf(LevelDebug, "DEBUG: ", format, v)
+}
+
+func (logger *levelLogger) Infof(format string, v ...interface{}) {
+	logger.logf(LevelInfo, "INFO: ", format, v)
+}
+
+func (logger *levelLogger) Warnf(format string, v ...interface{}) {
+	logger.logf(LevelWarn, "WARN: ", format, v)
+}
+
+func (logger *levelLogger) Errorf(format string, v ...interface{}) {
+	logger.logf(LevelError, "ERROR: ", format, v)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Infof(format string, v ...interface{})  {}
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
@@ -0,0 +1,32 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+// At info level, routine adds, splits and RPCs log nothing at debug level,
+// which only shows up when asked for
+func TestLoggerLevels(t *testing.T) {
+	for _, level := range []Level{LevelInfo, LevelDebug} {
+		var buf bytes.Buffer
+		network := NewMemoryNetwork()
+		node := newTestNode(t, network, 10000, WithK(2), WithLogger(NewLogger(log.New(&buf, "", 0), level)))
+		peer := newTestNode(t, network, 10001)
+		for i := 0; i < 10; i++ {
+			node.rt.ImportContacts([]Contact{contactAtDistance(node.id, uint(150-i*10), 0, i+1)})
+		}
+		node.doPing(context.Background(), peer.addr)
+
+		out := buf.String()
+		if !strings.Contains(out, "INFO: ") {
+			t.Errorf("level %d logged no info messages:\n%s", level, out)
+		}
+		if debug := strings.Contains(out, "DEBUG: "); debug != (level == LevelDebug) {
+			t.Errorf("level %d logged debug messages: %t\n%s", level, debug, out)
+		}
+	}
+}
@@ -2,17 +2,19 @@ package kademlia
 
 import (
 	"bufio"
-	"crypto/sha1"
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/big"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
-	//"time"
+	"time"
 )
 
 // Node is an individual Kademlia node
@@ -21,17 +23,102 @@ type Node struct {
 	addr   net.TCPAddr
 	ht     KVStore
 	rt     *RoutingTable
-	logger *log.Logger
+	logger Logger
+	// k is the maximum number of contacts stored in each of our buckets
+	k int
+	// alpha is the number of RPCs a lookup sends in parallel
+	alpha int
+	// eviction is the policy our buckets use when they are full
+	eviction EvictionPolicy
+	// bucketPolicy decides whether our full buckets ping and cache at all
+	bucketPolicy BucketPolicy
+	// pingOnInsert makes the routing table PING contacts learned from other
+	// nodes before storing them
+	pingOnInsert bool
+	// hash derives node IDs from addresses and key IDs from keys
+	hash HashFunc
+	// idBits is the size of the IDs hash returns, and so the number of
+	// buckets in the routing table
+	idBits int
+	// rng picks random IDs for bucket refreshes
+	rng *rand.Rand
+	// clock provides every timestamp the node keeps
+	clock Clock
+
+	// each node serves its own RPC and REST endpoints so several nodes can
+	// run in one process
+	server   *rpc.Server
+	mux      *http.ServeMux
+	listener net.Listener
+	done     chan struct{}
+	// admin serves the introspection endpoint once EnableAdmin is called
+	admin net.Listener
+	// transport carries our outgoing RPCs
+	transport Transport
+	// dialTimeout and readTimeout bound how long the default transport waits
+	// to connect to a peer and for its reply to an RPC
+	dialTimeout time.Duration
+	readTimeout time.Duration
+	// retry decides how failed RPCs are retried
+	retry RetryPolicy
+	// lookup bounds how many rounds iterative lookups run for
+	lookup lookupConfig
+	// version is the protocol version we advertise in PINGs
+	version int
+	// storeQuorum is how many STOREs must succeed before a Put returns
+	storeQuorum int
+	// replication is how many of the closest nodes a value is stored on
+	replication int
+	// trace is called after every lookup RPC, or is nil if tracing is off
+	trace LookupTrace
+	// tableListener is told about changes to the routing table, or is nil
+	tableListener TableListener
+	// stores paces the BATCHSTOREs of periodic republishes, or is nil if
+	// they are sent all at once
+	stores *storeQueue
+	// republishRate is how many key/value pairs per second stores sends
+	republishRate float64
+	// selfLookupInterval is how often the node looks up its own ID to find
+	// new nodes near it
+	selfLookupInterval time.Duration
+	// maxContacts caps the number of contacts in the routing table across
+	// all of its buckets, or is zero for no cap
+	maxContacts int
+	// signer signs our RPCs and is the source of our ID, or is nil if the
+	// node runs without signing
+	signer ed25519.PrivateKey
+	// alive holds the contacts that answered a PING within tLiveness
+	alive *livenessCache
+	// shortlists holds recent lookup results, or is nil if the cache is off
+	shortlists *shortlistCache
+	// shortlistTTL is how long lookup results are cached, or zero for off
+	shortlistTTL time.Duration
+	// banned holds the IDs of blacklisted nodes
+	banned *blacklist
+	// limiter caps the rate of inbound RPCs per peer IP, or is nil if rate
+	// limiting is off
+	limiter *rateLimiter
+	// rpcRate and rpcBurst configure limiter
+	rpcRate  float64
+	rpcBurst int
+	// stats is allocated separately so its counters are 64-bit aligned for
+	// the atomic operations
+	stats *Stats
 }
 
 // PingArgs contains the arguments for the PING RPC
 type PingArgs struct {
 	Source net.TCPAddr
+	// Version is the protocol version the sender speaks
+	Version int
+	Auth    Signature `json:"-"`
 }
 
 // PingReply contains the results for the PING RPC
 type PingReply struct {
-	Source net.TCPAddr
+	Source  net.TCPAddr
+	Version int
+	Auth    Signature `json:"-"`
 }
 
 // StoreArgs contains the arguments for the STORE RPC
@@ -39,21 +126,46 @@ type StoreArgs struct {
 	Source net.TCPAddr
 	Key    string
 	Val    []byte
+	// TTL is set when the value is only a cached copy, which is kept for
+	// TTL instead of tExpire and isn't republished
+	TTL  time.Duration
+	Auth Signature `json:"-"`
 }
 
 // StoreReply contains the results for the Store RPC
 type StoreReply struct {
 }
 
+// KeyValue is a single key/value pair sent in a BATCHSTORE RPC
+type KeyValue struct {
+	Key string
+	Val []byte
+}
+
+// BatchStoreArgs contains the arguments for the BATCHSTORE RPC
+type BatchStoreArgs struct {
+	Source net.TCPAddr
+	Pairs  []KeyValue
+	Auth   Signature `json:"-"`
+}
+
+// BatchStoreReply contains the results for the BATCHSTORE RPC
+type BatchStoreReply struct {
+}
+
 // FindValueArgs contains the arguments for the FINDVALUE RPC
 type FindValueArgs struct {
 	Source net.TCPAddr
 	Key    string
+	Auth   Signature `json:"-"`
 }
 
 // FindValueReply contains the results for the FINDVALUE RPC
+// Found is set when Val holds the value, otherwise Contacts holds the k closest
+// contacts to the key
 type FindValueReply struct {
 	Val      []byte
+	Found    bool
 	Contacts []Contact
 }
 
@@ -61,6 +173,10 @@ type FindValueReply struct {
 type FindNodeArgs struct {
 	Source net.TCPAddr
 	Key    string
+	// MaxDistance, if set, limits the reply to contacts within this XOR
+	// distance of Key. The k closest are returned when it is nil
+	MaxDistance *big.Int
+	Auth        Signature `json:"-"`
 }
 
 // FindNodeReply contains the results for the FINDNODE RPC
@@ -70,63 +186,150 @@ type FindNodeReply struct {
 
 // Ping is the handler for the PING RPC
 func (node *Node) Ping(args PingArgs, reply *PingReply) error {
-	contact := NewContact(args.Source)
-
-	node.logger.Printf("Ping from %s", args.Source.String())
-	if contact == nil {
-		return errors.New("Couldn't hash IP address")
+	count(&node.stats.PingsReceived)
+	node.logger.Debugf("Ping from %s", args.Source.String())
+	contact, err := node.verifiedContact("Ping", args.Source, args, args.Auth)
+	if err != nil {
+		node.logger.Debugf("Dropping PING: %s", err)
+		return err
 	}
-	node.rt.add(*contact)
+	if err := node.acceptFrom(*contact); err != nil {
+		return err
+	}
+	contact.version = wireVersion(args.Version)
+	if err := checkVersion(contact.version); err != nil {
+		node.logger.Debugf("Dropping PING from %s: %s", contact, err)
+		return err
+	}
+	node.rt.touch(*contact)
 
 	// Update k-bucket based on args.Source
-	*reply = PingReply{node.addr}
-	node.checkRoutingTable(args.Source)
+	*reply = PingReply{Source: node.addr, Version: node.version}
+	reply.Auth = node.sign("PingReply", *reply)
+	node.checkRoutingTable(contact.Id)
 	return nil
 }
 
-func (node *Node) checkRoutingTable(dest net.TCPAddr) {
-	node.logger.Printf("Checking routing table")
-	hash := sha1.Sum([]byte(dest.String()))
+// acceptFrom returns an error if an RPC from contact should be dropped
+// because the sender is blacklisted
+func (node *Node) acceptFrom(contact Contact) error {
+	if node.banned.contains(contact.Id) {
+		node.logger.Debugf("Dropping RPC from blacklisted %s", contact)
+		return fmt.Errorf("%s is blacklisted", contact.Addr.String())
+	}
+	return nil
+}
 
-	id := *big.NewInt(0)
-	id.SetBytes(hash[:])
+// allowPeer returns an error if the peer at host is over its rate limit. host
+// is the IP the RPC's connection comes from, not the Source it claims, so a
+// flooder can't get a fresh bucket by changing Source
+func (node *Node) allowPeer(host string) error {
+	if node.limiter == nil || node.limiter.allow(host) {
+		return nil
+	}
+	count(&node.stats.RateLimited)
+	node.logger.Debugf("Dropping RPC from %s, it is over the rate limit", host)
+	return fmt.Errorf("%s is over the rate limit", host)
+}
 
+func (node *Node) checkRoutingTable(id big.Int) {
+	node.logger.Debugf("Checking routing table")
 	contact := node.rt.ContactFromID(id)
 	if contact == nil {
-		node.logger.Printf("Node not added")
+		node.logger.Debugf("Node not added")
 		return
 	}
-	node.logger.Printf("Printing node info")
-
-	node.logger.Printf("Id: %s, addr: %s", contact.Id.Text(keyBase), contact.Addr.String())
+	node.logger.Debugf("Routing table has %s", contact)
 }
 
 // Store is the handler for the STORE RPC
 func (node *Node) Store(args StoreArgs, reply *StoreReply) error {
-	contact := NewContact(args.Source)
-	if contact == nil {
-		return errors.New("Couldn't hash IP address")
+	count(&node.stats.StoresReceived)
+	contact, err := node.verifiedContact("Store", args.Source, args, args.Auth)
+	if err != nil {
+		node.logger.Debugf("Dropping STORE: %s", err)
+		return err
 	}
-	node.rt.add(*contact)
+	if err := node.acceptFrom(*contact); err != nil {
+		return err
+	}
+	node.rt.touch(*contact)
 
 	// TODO: Might have to check if we're already the origin before overwriting
 	// with false
-	node.ht.add(args.Key, args.Val, false)
+	if args.TTL > 0 {
+		err = node.ht.cache(args.Key, args.Val, args.TTL)
+	} else {
+		err = node.ht.add(args.Key, args.Val, false)
+	}
+	if err != nil {
+		node.logger.Warnf("Rejected STORE from %s: %s", args.Source.String(), err)
+		return err
+	}
 
 	*reply = StoreReply{}
 	return nil
 }
 
+// BatchStore is the handler for the BATCHSTORE RPC. Either every pair is
+// stored or none are
+func (node *Node) BatchStore(args BatchStoreArgs, reply *BatchStoreReply) error {
+	count(&node.stats.StoresReceived)
+	contact, err := node.verifiedContact("BatchStore", args.Source, args, args.Auth)
+	if err != nil {
+		node.logger.Debugf("Dropping BATCHSTORE: %s", err)
+		return err
+	}
+	if err := node.acceptFrom(*contact); err != nil {
+		return err
+	}
+	node.rt.touch(*contact)
+
+	if err := node.ht.addBatch(args.Pairs, false); err != nil {
+		node.logger.Warnf("Rejected BATCHSTORE from %s: %s", args.Source.String(), err)
+		return err
+	}
+
+	*reply = BatchStoreReply{}
+	return nil
+}
+
+// LocalKeys returns the ID of every key stored on this node. Keys that
+// aren't IDs in hex, which can only be stored through the REST API, are
+// left out
+func (node *Node) LocalKeys() []big.Int {
+	keys := node.ht.keys()
+	ids := make([]big.Int, 0, len(keys))
+	for _, key := range keys {
+		id := new(big.Int)
+		if _, ok := id.SetString(key, keyBase); ok {
+			ids = append(ids, *id)
+		}
+	}
+	return ids
+}
+
+// LocalValue returns the value stored on this node for key, without contacting
+// any other nodes
+func (node *Node) LocalValue(key big.Int) ([]byte, bool) {
+	return node.ht.get(key.Text(keyBase))
+}
+
 // FindValue is the handler for the FINDVALUE RPC
 func (node *Node) FindValue(args FindValueArgs, reply *FindValueReply) error {
-	contact := NewContact(args.Source)
-	if contact == nil {
-		return errors.New("Couldn't hash IP address")
+	count(&node.stats.FindValuesReceived)
+	contact, err := node.verifiedContact("FindValue", args.Source, args, args.Auth)
+	if err != nil {
+		node.logger.Debugf("Dropping FINDVALUE: %s", err)
+		return err
 	}
-	node.rt.add(*contact)
+	if err := node.acceptFrom(*contact); err != nil {
+		return err
+	}
+	node.rt.touch(*contact)
 	// If node contains key, returns associated data
 	if val, ok := node.ht.get(args.Key); ok {
-		*reply = FindValueReply{Val: val}
+		*reply = FindValueReply{Val: val, Found: true}
 		return nil
 	}
 
@@ -134,33 +337,42 @@ func (node *Node) FindValue(args FindValueArgs, reply *FindValueReply) error {
 	toFindID := new(big.Int)
 	toFindID.SetString(args.Key, keyBase)
 	nearest := node.rt.findKNearestContacts(*toFindID)
-	*reply = FindValueReply{Contacts: nearest}
+	*reply = FindValueReply{Contacts: excludeContact(nearest, *contact)}
 	return nil
 }
 
 // FindNode is the handler for the FINDNODE RPC
 func (node *Node) FindNode(args FindNodeArgs, reply *FindNodeReply) error {
-	node.logger.Printf("FindNode from %s", args.Source.String())
-	contact := NewContact(args.Source)
-	if contact == nil {
-		return errors.New("Couldn't hash IP address")
+	count(&node.stats.FindNodesReceived)
+	node.logger.Debugf("FindNode from %s", args.Source.String())
+	contact, err := node.verifiedContact("FindNode", args.Source, args, args.Auth)
+	if err != nil {
+		node.logger.Debugf("Dropping FINDNODE: %s", err)
+		return err
 	}
-	node.rt.add(*contact)
+	if err := node.acceptFrom(*contact); err != nil {
+		return err
+	}
+	node.rt.touch(*contact)
 
 	keyInt := new(big.Int)
 	keyInt.SetString(args.Key, keyBase)
 
+	// the requester already knows about itself
 	nearest := node.rt.findKNearestContacts(*keyInt)
-	*reply = FindNodeReply{Contacts: nearest}
-	node.logger.Printf("Processed FindNode from %s", args.Source.String())
+	if args.MaxDistance != nil {
+		nearest = withinDistance(nearest, *keyInt, args.MaxDistance)
+	}
+	*reply = FindNodeReply{Contacts: excludeContact(nearest, *contact)}
+	node.logger.Debugf("Processed FindNode from %s", args.Source.String())
 	return nil
 }
 
 func (node *Node) String() string {
-	return fmt.Sprintf("Node: (id = %s) (address = %s) (kBuckets = %v)",
-		node.id.Text(keyBase),
+	return fmt.Sprintf("Node: (id = %s) (address = %s) (contacts = %v)",
+		IDToHex(node.id),
 		node.addr.String(),
-		node.rt)
+		node.rt.allContacts())
 }
 
 // Return XOR distance between node and other
@@ -168,83 +380,510 @@ func (node *Node) distanceTo(other *Contact) *big.Int {
 	return big.NewInt(0).Xor(&node.id, &other.Id)
 }
 
-func distanceBetween(firstID big.Int, secondID big.Int) *big.Int {
-	return big.NewInt(0).Xor(&firstID, &secondID)
+// Option configures a Node when it is created by NewNode
+type Option func(*Node)
+
+// WithK sets the maximum number of contacts stored in each bucket
+func WithK(k int) Option {
+	return func(node *Node) {
+		node.k = k
+	}
 }
 
-// NewNode returns a new Node struct
-func NewNode(address string) *Node {
-	node := new(Node)
-	addr, err := net.ResolveTCPAddr("tcp", address)
-	if err != nil {
-		fmt.Println(err)
-		return nil
+// WithClock makes the node read the time from clock instead of the wall clock
+func WithClock(clock Clock) Option {
+	return func(node *Node) {
+		node.clock = clock
 	}
+}
 
-	node.addr = *addr
+// WithAlpha sets how many RPCs a lookup sends in parallel
+func WithAlpha(alpha int) Option {
+	return func(node *Node) {
+		node.alpha = alpha
+	}
+}
 
-	hash := sha1.Sum([]byte(addr.String()))
+// WithRandSource makes the node draw the random IDs it refreshes buckets with
+// from src, so that refreshes are reproducible
+func WithRandSource(src rand.Source) Option {
+	return func(node *Node) {
+		node.rng = rand.New(src)
+	}
+}
 
-	node.id = *big.NewInt(0)
-	node.id.SetBytes(hash[:])
-	// TODO: take in k and tRefresh arguments - for now just hardcoding default
-	node.rt = NewRoutingTable(node)
+// WithShortlistCache makes lookups reuse the contacts found by lookups for
+// nearby targets within the last ttl. It is off by default
+func WithShortlistCache(ttl time.Duration) Option {
+	return func(node *Node) {
+		node.shortlistTTL = ttl
+	}
+}
+
+// WithPingOnInsert makes the node PING every contact it learns about from
+// another node, and only add it to the routing table if it answers
+func WithPingOnInsert(enabled bool) Option {
+	return func(node *Node) {
+		node.pingOnInsert = enabled
+	}
+}
+
+// WithBucketPolicy sets whether a full bucket pings its least-recently seen
+// contact and keeps a replacement cache when a new contact arrives
+func WithBucketPolicy(policy BucketPolicy) Option {
+	return func(node *Node) {
+		node.bucketPolicy = policy
+	}
+}
+
+// WithEvictionPolicy sets what a full bucket does when a new contact arrives
+// and the contact it pings is still alive. Policies other than
+// EvictLeastRecent cache the contact they don't keep, so NewNode rejects them
+// unless the bucket policy is ReplacementCache
+func WithEvictionPolicy(policy EvictionPolicy) Option {
+	return func(node *Node) {
+		node.eviction = policy
+	}
+}
+
+// WithRetryPolicy makes the node retry failed RPCs according to policy. By
+// default they aren't retried. NewNode returns an error if the policy makes
+// no attempts or has a negative delay or a jitter outside 0 to 1
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(node *Node) {
+		node.retry = policy
+	}
+}
+
+// WithHash makes the node derive IDs with hash instead of SHA-1. Every node in
+// a network must use the same function
+func WithHash(hash HashFunc) Option {
+	return func(node *Node) {
+		node.hash = hash
+	}
+}
+
+// WithIDBits sets the size of the ID space in bits. It must match the output
+// of the node's hash function, e.g. WithIDBits(256) with WithHash(SHA256)
+func WithIDBits(bits int) Option {
+	return func(node *Node) {
+		node.idBits = bits
+	}
+}
+
+// WithLookupRounds makes iterative lookups stop after maxRounds rounds, or
+// after stallRounds rounds in a row that don't find a contact closer than
+// the best one so far
+func WithLookupRounds(maxRounds int, stallRounds int) Option {
+	return func(node *Node) {
+		node.lookup = lookupConfig{maxRounds, stallRounds}
+	}
+}
+
+// WithRateLimit limits each peer IP to burst inbound RPCs at once and rate
+// per second after that. RPCs over the limit are dropped before they are
+// decoded. A rate of zero turns rate limiting off. Only RPCs over TCP are
+// limited: a MemoryNetwork has no peer addresses to tell senders apart
+func WithRateLimit(rate float64, burst int) Option {
+	return func(node *Node) {
+		node.rpcRate = rate
+		node.rpcBurst = burst
+	}
+}
+
+// WithStoreQuorum makes Put return once quorum nodes have acknowledged the
+// STORE, leaving the rest to finish in the background. It defaults to a
+// majority of k
+func WithStoreQuorum(quorum int) Option {
+	return func(node *Node) {
+		node.storeQuorum = quorum
+	}
+}
+
+// WithReplication stores values on the r closest nodes to their key instead of
+// the k closest. r must be at least k
+func WithReplication(r int) Option {
+	return func(node *Node) {
+		node.replication = r
+	}
+}
+
+// WithLookupTrace calls trace after every FINDNODE and FINDVALUE RPC a lookup
+// sends, for debugging lookups that go wrong
+func WithLookupTrace(trace LookupTrace) Option {
+	return func(node *Node) {
+		node.trace = trace
+	}
+}
+
+// WithRepublishRate makes periodic republishes send at most rate key/value
+// pairs per second, so they are spread out rather than sent in one burst.
+// Zero sends them all at once
+func WithRepublishRate(rate float64) Option {
+	return func(node *Node) {
+		node.republishRate = rate
+	}
+}
+
+// WithTableListener calls listener with every structural change to the
+// routing table: buckets being created and split, and contacts being added,
+// removed and evicted
+func WithTableListener(listener TableListener) Option {
+	return func(node *Node) {
+		node.tableListener = listener
+	}
+}
+
+// WithSigningKey makes the node sign every RPC with key and take the hash of
+// its public key as its ID instead of the hash of its address. RPCs from
+// other nodes must then be signed too, so every node in the network has to
+// use a signing key. Contacts learned from other nodes are only verified when
+// they are pinged, so it is best combined with WithPingOnInsert
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(node *Node) {
+		node.signer = key
+	}
+}
+
+// WithDialTimeout makes the default TCP transport give up connecting to a
+// peer after timeout. Zero waits as long as the RPC's context allows
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(node *Node) {
+		node.dialTimeout = timeout
+	}
+}
+
+// WithReadTimeout makes the default TCP transport fail an RPC whose reply
+// hasn't arrived timeout after it was sent, so a peer that accepts the
+// connection but never answers can't hold it up. Zero waits as long as the
+// RPC's context allows
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(node *Node) {
+		node.readTimeout = timeout
+	}
+}
+
+// WithSelfLookupInterval makes the node look up its own ID every interval
+// instead of every tSiblingRefresh. The lookup finds nodes that joined near
+// us, independent of the per-bucket refreshes
+func WithSelfLookupInterval(interval time.Duration) Option {
+	return func(node *Node) {
+		node.selfLookupInterval = interval
+	}
+}
+
+// WithMaxContacts caps the routing table at limit contacts across all of its
+// buckets, for nodes that must bound their memory. Adding a contact beyond
+// the cap evicts the contact farthest from us in the least recently accessed
+// bucket. Zero, the default, means no cap
+func WithMaxContacts(limit int) Option {
+	return func(node *Node) {
+		node.maxContacts = limit
+	}
+}
+
+// WithTransport makes the node send its RPCs over transport instead of TCP
+func WithTransport(transport Transport) Option {
+	return func(node *Node) {
+		node.transport = transport
+	}
+}
+
+// WithLogger makes the node write its log to logger. Use NopLogger to discard
+// it
+func WithLogger(logger Logger) Option {
+	return func(node *Node) {
+		node.logger = logger
+	}
+}
+
+// NewNode returns a new Node struct for addr. The node doesn't accept
+// connections until Listen or Run is called
+func NewNode(addr net.TCPAddr, opts ...Option) (*Node, error) {
+	node := new(Node)
+	node.k = k
+	node.alpha = alpha
+	node.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	node.clock = realClock{}
+	node.hash = SHA1
+	node.idBits = idBits
+	node.retry = noRetries
+	node.version = protocolVersion
+	node.rpcRate = rpcRate
+	node.rpcBurst = rpcBurst
+	node.republishRate = republishRate
+	node.dialTimeout = tDial
+	node.readTimeout = tReply
+	node.selfLookupInterval = tSiblingRefresh
+	node.lookup = lookupConfig{maxLookupRounds, lookupStallRounds}
 
 	// Disable logging if necessary (see option in globals.go)
 	if !loggingEnable {
 		log.SetOutput(ioutil.Discard)
 		log.SetFlags(0)
-		node.logger = log.New(ioutil.Discard, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+		node.logger = NopLogger()
+	} else {
+		node.logger = NewLogger(log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile), LevelInfo)
+	}
+
+	for _, opt := range opts {
+		opt(node)
+	}
+	if node.k < 1 {
+		return nil, fmt.Errorf("k must be at least 1, got %d", node.k)
+	}
+	if node.alpha < 1 {
+		return nil, fmt.Errorf("alpha must be at least 1, got %d", node.alpha)
+	}
+	if node.lookup.maxRounds < 1 || node.lookup.stallRounds < 1 {
+		return nil, fmt.Errorf("Lookups must be allowed at least 1 round, got %d max and %d stalled", node.lookup.maxRounds, node.lookup.stallRounds)
+	}
+	if node.dialTimeout < 0 || node.readTimeout < 0 {
+		return nil, fmt.Errorf("Timeouts can't be negative, got %s to dial and %s to read", node.dialTimeout, node.readTimeout)
+	}
+	if node.bucketPolicy < ReplacementCache || node.bucketPolicy > StrictReject {
+		return nil, fmt.Errorf("Unknown bucket policy %d", node.bucketPolicy)
+	}
+	if node.eviction < EvictLeastRecent || node.eviction > PreferCloser {
+		return nil, fmt.Errorf("Unknown eviction policy %d", node.eviction)
+	}
+	if node.eviction != EvictLeastRecent && node.bucketPolicy != ReplacementCache {
+		return nil, fmt.Errorf("Eviction policy %d needs the ReplacementCache bucket policy, got %d", node.eviction, node.bucketPolicy)
+	}
+	if node.maxContacts < 0 {
+		return nil, fmt.Errorf("Contact cap can't be negative, got %d", node.maxContacts)
+	}
+	if node.selfLookupInterval <= 0 {
+		return nil, fmt.Errorf("Self lookup interval must be positive, got %s", node.selfLookupInterval)
+	}
+	if node.republishRate < 0 {
+		return nil, fmt.Errorf("Republish rate can't be negative, got %f", node.republishRate)
+	}
+	if node.rpcRate > 0 && node.rpcBurst < 1 {
+		return nil, fmt.Errorf("Rate limit burst must be at least 1, got %d", node.rpcBurst)
+	}
+	if node.storeQuorum == 0 {
+		node.storeQuorum = (node.k + 1) / 2
+	}
+	if node.storeQuorum < 1 || node.storeQuorum > node.k {
+		return nil, fmt.Errorf("Store quorum must be between 1 and k, got %d", node.storeQuorum)
+	}
+	if node.replication == 0 {
+		node.replication = node.k
+	}
+	if node.replication < node.k {
+		return nil, fmt.Errorf("Replication factor must be at least k (%d), got %d", node.k, node.replication)
+	}
+	if node.idBits < 1 {
+		return nil, fmt.Errorf("ID space must be at least 1 bit, got %d", node.idBits)
+	}
+	if err := node.retry.validate(); err != nil {
+		return nil, err
+	}
+	if node.signer != nil && len(node.signer) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Signing key must be a %d-byte ed25519 private key, got %d bytes", ed25519.PrivateKeySize, len(node.signer))
+	}
+
+	node.addr = addr
+
+	if node.signer != nil {
+		node.id = node.hash(node.signer.Public().(ed25519.PublicKey))
 	} else {
-		node.logger = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+		node.id = hashAddr(addr, node.hash)
+	}
+	if node.id.BitLen() > node.idBits {
+		return nil, fmt.Errorf("Hash returned a %d-bit ID but the ID space is %d bits", node.id.BitLen(), node.idBits)
+	}
+	// TODO: take in tRefresh argument - for now just hardcoding default
+	node.rt = NewRoutingTable(node)
+
+	node.ht = *NewKVStore(node.clock)
+	if node.transport == nil {
+		node.transport = newTCPTransport(maxIdleConns, tIdleConn, node.dialTimeout, node.readTimeout, node.clock)
+	}
+	node.stats = new(Stats)
+	node.banned = newBlacklist()
+	if node.rpcRate > 0 {
+		node.limiter = newRateLimiter(node.rpcRate, node.rpcBurst, node.clock)
+	}
+	node.alive = newLivenessCache(tLiveness, node.clock)
+	if node.republishRate > 0 {
+		node.stores = newStoreQueue(storeQueueSize, node.republishRate)
+	}
+	if node.shortlistTTL > 0 {
+		node.shortlists = newShortlistCache(node.shortlistTTL, node.idBits, node.clock)
 	}
 
-	node.ht = *NewKVStore()
+	node.server = rpc.NewServer()
+	node.server.Register(&NodeRPC{node})
+	node.mux = http.NewServeMux()
+	node.mux.HandleFunc(rpc.DefaultRPCPath, node.serveRPC)
+	node.setupControlEndpoints()
 
 	fmt.Println(caching_on)
 
-	return node
+	return node, nil
 }
 
-// Run is called on an initialized Node to begin serving the RPC endpoints
-func (node *Node) Run(toPing string) {
-	nodeRPC := &NodeRPC{node}
-	rpc.Register(nodeRPC)
-	rpc.HandleHTTP()
-	node.setupControlEndpoints()
+// Bootstrap joins the network that seed is part of. It adds seed to the
+// routing table, looks up our own ID to learn about our neighbors and then
+// refreshes every bucket farther away than the closest neighbor
+// Returns an error if seed doesn't answer a PING
+func (node *Node) Bootstrap(ctx context.Context, seed Contact) error {
+	if !node.doPing(ctx, seed.Addr) {
+		return fmt.Errorf("Couldn't reach bootstrap node %s", seed.Addr.String())
+	}
+	// with signing, the seed's ID is only known from its PING reply, which
+	// has already added it
+	if node.signer == nil {
+		node.rt.add(seed)
+	}
 
-	// if the node was passed a node to ping, otherwise
-	// don't bother
-	if toPing != "" {
-		toPingAddr, err := net.ResolveTCPAddr("", toPing)
-		//TODO: handle err
-		if err != nil {
-			node.logger.Printf("%s", err)
+	// get k closest nodes and add to routing table by querying
+	// own id
+	kclosest, err := node.doIterativeFindNode(ctx, node.id.Text(keyBase))
+	if err != nil {
+		return err
+	}
+	closest := -1
+	for i := 0; i < len(kclosest); i++ {
+		curr := kclosest[i]
+		node.logger.Debugf("Got node %s", curr)
+		node.rt.add(curr)
+
+		index := node.GetKBucketFromID(&curr.Id)
+		if curr.Id.Cmp(&node.id) != 0 && (closest == -1 || index < closest) {
+			closest = index
+		}
+	}
+
+	// fill the buckets further away than our closest neighbor
+	if closest == -1 {
+		return nil
+	}
+	for index := closest + 1; index < len(node.rt.kBuckets); index++ {
+		if err := node.refreshBucket(ctx, index); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		contact := NewContact(*toPingAddr)
+// IsReady reports whether the node knows at least one other node, so that
+// lookups have somewhere to start
+func (node *Node) IsReady() bool {
+	return node.rt.Size() > 0
+}
 
-		node.rt.add(*contact)
-		// get k closest nodes and add to routing table by querying
-		// own id
-		kclosest := node.doIterativeFindNode(node.id.Text(keyBase))
-		for i := 0; i < len(kclosest); i++ {
-			curr := kclosest[i]
-			node.logger.Printf("Got node %s with ID %s", curr.Addr.String(), curr.Id.String())
-			node.rt.add(curr)
+// WaitReady blocks until the node is ready or ctx is done, and returns ctx's
+// error in the latter case
+func (node *Node) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for !node.IsReady() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
+	}
+	return nil
+}
+
+// keyID hashes key into the ID, in hex, that its value is stored under
+func (node *Node) keyID(key []byte) string {
+	id := node.hash(key)
+	return id.Text(keyBase)
+}
+
+// Get looks up the value stored under key in the DHT. The value is also cached
+// on the closest node that was asked for it and didn't have it
+// A value this node stores itself is returned without sending any RPCs
+// Returns false if no node has the value
+func (node *Node) Get(ctx context.Context, key []byte) ([]byte, bool, error) {
+	return node.doIterativeFindValue(ctx, node.keyID(key))
+}
+
+// Put stores value under key on the closest nodes to the key. This node
+// becomes the key's origin and republishes it every tRepublish. It returns
+// once the store quorum has acknowledged the value
+func (node *Node) Put(ctx context.Context, key []byte, value []byte) error {
+	id := node.keyID(key)
+	if err := node.ht.add(id, value, true); err != nil {
+		return err
+	}
+	return node.doIterativeStore(ctx, id, value)
+}
+
+// Listen binds to the node's address and serves the RPC and REST endpoints in
+// the background until Close is called
+func (node *Node) Listen() error {
+	l, err := net.ListenTCP("tcp", &node.addr)
+	if err != nil {
+		return err
+	}
+	node.listener = l
+	node.done = make(chan struct{})
 
-		// fill k buckets further away :w
+	go func() {
+		err := http.Serve(l, node.mux)
+		node.logger.Infof("Stopped serving: %s", err)
+		close(node.done)
+	}()
+	return nil
+}
+
+// Close stops the node from accepting connections
+func (node *Node) Close() error {
+	node.transport.Close()
+	if node.admin != nil {
+		node.admin.Close()
 	}
+	if node.listener == nil {
+		return nil
+	}
+	return node.listener.Close()
+}
 
-	node.logger.Printf("Finished routing table initialization")
+// Shutdown hands our key/value pairs off to the closest nodes so they
+// aren't lost until the next republish, then closes the node, which stops the
+// background loops. If ctx is done first, the handoff is cut short and ctx's
+// error is returned
+func (node *Node) Shutdown(ctx context.Context) error {
+	node.logger.Infof("Shutting down, handing off %d keys", len(node.ht.keys()))
+	node.republish(ctx, true)
+	if err := node.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Run is called on an initialized Node to begin serving the RPC endpoints
+// It returns once the node is closed
+func (node *Node) Run(toPing string) {
 	// open our own port for connection
-	l, e := net.ListenTCP("tcp", &node.addr)
-	if e != nil {
-		log.Fatal(e)
+	if err := node.Listen(); err != nil {
+		log.Fatal(err)
 		return
 	}
 
+	// if the node was passed a node to ping, otherwise
+	// don't bother
+	if toPing != "" {
+		toPingAddr, err := net.ResolveTCPAddr("", toPing)
+		if err != nil {
+			node.logger.Errorf("%s", err)
+		} else if err := node.Bootstrap(context.Background(), *node.newContact(*toPingAddr)); err != nil {
+			node.logger.Errorf("%s", err)
+		}
+	}
+
+	node.logger.Infof("Finished routing table initialization")
+	node.startRefreshLoop(tRefreshCheck)
+	node.startSiblingLoop(node.selfLookupInterval)
+	go node.expireLoop(tStoreCheck)
+	go node.republishLoop(tStoreCheck)
+
 	// write our address into the bootstrap node file
 	f, err := os.OpenFile(Bootstrap_node_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if (err != nil) {
@@ -254,63 +893,169 @@ func (node *Node) Run(toPing string) {
 	fmt.Fprintln(w, node.addr.String())
 	w.Flush()
 	f.Close()
-	http.Serve(l, nil)
+	<-node.done
 }
 
 // Perform the legwork of RPC invocation
-func (node *Node) doRPC(method string, dest net.TCPAddr, args interface{}, reply interface{}) bool {
-	node.logger.Printf("Sending %s RPC to %s", method, dest.String())
+// Failed RPCs are retried according to the node's retry policy. The RPC is
+// abandoned if ctx is done before the reply arrives
+func (node *Node) doRPC(ctx context.Context, method string, dest net.TCPAddr, args interface{}, reply interface{}) bool {
+	node.logger.Debugf("Sending %s RPC to %s", method, dest.String())
 
-	client, err := rpc.DialHTTP("tcp", dest.String())
-	if err != nil {
-		node.logger.Printf("Dial to %s failed: %s", dest.String(), err)
-		return false
-	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = node.transport.Call(ctx, dest, method, args, reply)
+		// errors returned by the handler itself won't go away on a retry
+		_, isServerErr := err.(rpc.ServerError)
+		if err == nil || isServerErr || attempt >= node.retry.MaxAttempts || ctx.Err() != nil {
+			break
+		}
 
-	err = client.Call(fmt.Sprintf("NodeRPC.%s", method), args, reply)
+		delay := node.retry.delay(attempt)
+		node.logger.Debugf("Retrying %s RPC to %s in %s: %s", method, dest.String(), delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+	}
 	if err != nil {
-		node.logger.Printf("%s RPC to %s failed: %s", method, dest.String(), err)
+		var dialErr *dialError
+		if errors.As(err, &dialErr) {
+			count(&node.stats.FailedDials)
+		}
+		node.logger.Warnf("%s RPC to %s failed: %s", method, dest.String(), err)
+		// an RPC we gave up on says nothing about the contact, and one it
+		// rejected shows it is up. The contact is the one the table holds at
+		// dest, which with signing needn't have the ID dest hashes to
+		_, isServerErr := err.(rpc.ServerError)
+		if contact := node.tableContactAt(dest); contact != nil && ctx.Err() == nil && !isServerErr {
+			node.rt.markFailed(*contact)
+		}
 		return false
 	}
-
+	if contact := node.tableContactAt(dest); contact != nil {
+		node.rt.markAlive(*contact)
+	}
 	return true
 }
 
 // Send a PING RPC to dest
 // TODO: Return diagnostic information
-func (node *Node) doPing(dest net.TCPAddr) bool {
-	args := PingArgs{node.addr}
+func (node *Node) doPing(ctx context.Context, dest net.TCPAddr) bool {
+	return node.ping(ctx, dest) != nil
+}
+
+// ping sends a PING RPC to dest and returns the contact that answered, or nil
+// if none did or the reply couldn't be verified
+func (node *Node) ping(ctx context.Context, dest net.TCPAddr) *Contact {
+	count(&node.stats.PingsSent)
+	args := PingArgs{Source: node.addr, Version: node.version}
+	args.Auth = node.sign("Ping", args)
 	var reply PingReply
 
-	if !node.doRPC("Ping", dest, args, &reply) {
-		return false
+	sent := node.clock.Now()
+	if !node.doRPC(ctx, "Ping", dest, args, &reply) {
+		return nil
 	}
+	rtt := node.clock.Now().Sub(sent)
 
-	node.logger.Printf("Got ping reply from %s", reply.Source.String())
-
-	// TODO: Update K-Buckets
-	contact := NewContact(reply.Source)
+	node.logger.Debugf("Got ping reply from %s", reply.Source.String())
+	contact, err := node.verifiedContact("PingReply", reply.Source, reply, reply.Auth)
+	if err != nil {
+		node.logger.Warnf("Not adding %s: %s", reply.Source.String(), err)
+		return nil
+	}
+	contact.version = wireVersion(reply.Version)
+	if err := checkVersion(contact.version); err != nil {
+		node.logger.Warnf("Not adding %s: %s", contact, err)
+		return nil
+	}
+	node.alive.markAlive(livenessKey(*contact))
+	contact.lastSeen = node.clock.Now()
+	contact.rtt = rtt
 	node.rt.add(*contact)
 
-	return true
+	return contact
+}
+
+// pingContact reports whether contact answers a PING RPC before ctx is done.
+// A contact that answered one within tLiveness isn't pinged again
+func (node *Node) pingContact(ctx context.Context, contact Contact) bool {
+	if node.alive.isAlive(livenessKey(contact)) {
+		return true
+	}
+	return node.answersPing(ctx, contact)
+}
+
+// answersPing sends contact a PING and reports whether it answered, without
+// checking the liveness cache first
+func (node *Node) answersPing(ctx context.Context, contact Contact) bool {
+	replied := node.ping(ctx, contact.Addr)
+	// with signing, whoever answers at the address must hold the key that
+	// contact's ID is the hash of
+	return replied != nil && (node.signer == nil || replied.Id.Cmp(&contact.Id) == 0)
 }
 
 // Send a STORE RPC for (key, value) to dest
-func (node *Node) doStore(key string, value []byte, dest net.TCPAddr) {
-	args := StoreArgs{node.addr, key, value}
+// Returns true if dest acknowledged the STORE
+func (node *Node) doStore(ctx context.Context, key string, value []byte, dest net.TCPAddr) bool {
+	count(&node.stats.StoresSent)
+	args := StoreArgs{Source: node.addr, Key: key, Val: value}
+	args.Auth = node.sign("Store", args)
 	var reply StoreReply
 
-	if !node.doRPC("Store", dest, args, &reply) {
-		return
+	return node.doRPC(ctx, "Store", dest, args, &reply)
+}
+
+// batchStore sends every pair in pairs to contact in a single BATCHSTORE RPC
+// Peers too old to know BATCHSTORE get one STORE per pair instead
+func (node *Node) batchStore(ctx context.Context, contact Contact, pairs []KeyValue) error {
+	if !node.peerSupports(contact.Id, batchStoreVersion) {
+		for _, pair := range pairs {
+			if !node.doStore(ctx, pair.Key, pair.Val, contact.Addr) {
+				return fmt.Errorf("STORE of key %s to %s failed", pair.Key, contact.Addr.String())
+			}
+		}
+		return nil
+	}
+	count(&node.stats.StoresSent)
+	args := BatchStoreArgs{Source: node.addr, Pairs: pairs}
+	args.Auth = node.sign("BatchStore", args)
+	var reply BatchStoreReply
+
+	if !node.doRPC(ctx, "BatchStore", contact.Addr, args, &reply) {
+		return fmt.Errorf("BATCHSTORE of %d keys to %s failed", len(pairs), contact.Addr.String())
 	}
+	return nil
 }
 
 // Send a FINDVALUE RPC for key to dest
-func (node *Node) doFindValue(key string, dest net.TCPAddr) *FindValueReply {
-	args := FindValueArgs{node.addr, key}
+func (node *Node) doFindValue(ctx context.Context, key string, dest net.TCPAddr) *FindValueReply {
+	count(&node.stats.FindValuesSent)
+	args := FindValueArgs{Source: node.addr, Key: key}
+	args.Auth = node.sign("FindValue", args)
 	var reply FindValueReply
 
-	if !node.doRPC("FindValue", dest, args, &reply) {
+	var sent time.Time
+	if node.trace != nil {
+		sent = node.clock.Now()
+	}
+	ok := node.doRPC(ctx, "FindValue", dest, args, &reply)
+	if node.trace != nil {
+		event := LookupEvent{Target: key, Method: "FindValue", Addr: dest, Latency: node.clock.Now().Sub(sent), OK: ok}
+		if ok {
+			event.Contacts = len(reply.Contacts)
+			event.Found = reply.Found
+		}
+		node.trace(event)
+	}
+	if !ok {
 		return nil
 	}
 
@@ -323,10 +1068,30 @@ func (node *Node) doFindValue(key string, dest net.TCPAddr) *FindValueReply {
 }
 
 // Send a FINDNODE RPC for key to dest
-func (node *Node) doFindNode(nodeKey string, dest net.TCPAddr) []Contact {
-	args := FindNodeArgs{node.addr, nodeKey}
+func (node *Node) doFindNode(ctx context.Context, nodeKey string, dest net.TCPAddr) []Contact {
+	return node.doFindNodeWithin(ctx, nodeKey, dest, nil)
+}
+
+// doFindNodeWithin sends a FINDNODE RPC that only asks for contacts within
+// maxDistance of nodeKey, or for the k closest if maxDistance is nil
+func (node *Node) doFindNodeWithin(ctx context.Context, nodeKey string, dest net.TCPAddr, maxDistance *big.Int) []Contact {
+	count(&node.stats.FindNodesSent)
+	args := FindNodeArgs{Source: node.addr, Key: nodeKey, MaxDistance: maxDistance}
+	args.Auth = node.sign("FindNode", args)
 	var reply FindNodeReply
-	if !node.doRPC("FindNode", dest, args, &reply) {
+	var sent time.Time
+	if node.trace != nil {
+		sent = node.clock.Now()
+	}
+	ok := node.doRPC(ctx, "FindNode", dest, args, &reply)
+	if node.trace != nil {
+		event := LookupEvent{Target: nodeKey, Method: "FindNode", Addr: dest, Latency: node.clock.Now().Sub(sent), OK: ok}
+		if ok {
+			event.Contacts = len(reply.Contacts)
+		}
+		node.trace(event)
+	}
+	if !ok {
 		return nil
 	}
 
@@ -0,0 +1,394 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listeningNode returns a node serving RPCs over TCP on a free loopback port
+func listeningNode(t *testing.T, opts ...Option) *Node {
+	t.Helper()
+	node, err := NewNode(freeAddr(t), append([]Option{WithLogger(NopLogger())}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// Two nodes ping each other over loopback TCP and each adds the other to its
+// table. Once closed, a node accepts no new connections
+func TestPingOverTCP(t *testing.T) {
+	a := listeningNode(t)
+	b := listeningNode(t)
+
+	if !a.doPing(context.Background(), b.addr) {
+		t.Fatal("b didn't answer a's PING")
+	}
+	if !b.doPing(context.Background(), a.addr) {
+		t.Fatal("a didn't answer b's PING")
+	}
+	if a.rt.ContactFromID(b.id) == nil || b.rt.ContactFromID(a.id) == nil {
+		t.Error("the nodes didn't add each other to their tables")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		t.Fatal("b kept serving after Close")
+	}
+	c := listeningNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if c.doPing(ctx, b.addr) {
+		t.Error("b answered a PING on a new connection after Close")
+	}
+}
+
+// Concurrent FINDVALUEs sharing pooled connections each get the value for the
+// key they asked for
+func TestConcurrentRepliesMatchRequests(t *testing.T) {
+	a := listeningNode(t)
+	b := listeningNode(t)
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		b.ht.add(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("value%d", i)), true)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < keys; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reply := a.doFindValue(context.Background(), fmt.Sprintf("key%d", i), b.addr)
+			want := fmt.Sprintf("value%d", i)
+			if reply == nil || !reply.Found || string(reply.Val) != want {
+				t.Errorf("FINDVALUE for key%d returned %v, want %q", i, reply, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// A joining node learns about peers it wasn't told about through the seed, and
+// fails to join through a seed that doesn't answer
+func TestBootstrap(t *testing.T) {
+	network := NewMemoryNetwork()
+	seed := newTestNode(t, network, 10000)
+	third := newTestNode(t, network, 10001)
+	joiner := newTestNode(t, network, 10002)
+	seedContact := *NewContactWithID(seed.id, seed.addr)
+	if err := third.Bootstrap(context.Background(), seedContact); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := joiner.Bootstrap(context.Background(), seedContact); err != nil {
+		t.Fatalf("Bootstrap failed: %s", err)
+	}
+	if joiner.rt.ContactFromID(third.id) == nil {
+		t.Error("joiner didn't learn about the third node through the seed")
+	}
+
+	network.Remove(seed.addr)
+	lonely := newTestNode(t, network, 10003)
+	if err := lonely.Bootstrap(context.Background(), seedContact); err == nil {
+		t.Error("Bootstrap through an unreachable seed succeeded")
+	}
+}
+
+// NewNode derives the node's ID from its address and applies its options
+// without starting to listen
+func TestNewNode(t *testing.T) {
+	addr := freeAddr(t)
+	node, err := NewNode(addr, WithLogger(NopLogger()), WithK(7), WithAlpha(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SHA1([]byte(canonicalAddr(addr)))
+	if node.id.Cmp(&want) != 0 {
+		t.Errorf("node ID is %s, want the hash of its address %s", IDToHex(node.id), IDToHex(want))
+	}
+	if self := NewContact(addr); self.Id.Cmp(&node.id) != 0 {
+		t.Errorf("NewContact for the node's address has ID %s, want %s", IDToHex(self.Id), IDToHex(node.id))
+	}
+	if node.k != 7 || node.alpha != 2 {
+		t.Errorf("node has k=%d and alpha=%d, want 7 and 2", node.k, node.alpha)
+	}
+	if node.rt.Size() != 0 || node.listener != nil {
+		t.Error("a new node isn't empty and idle")
+	}
+}
+
+// A FINDNODE is answered with the known peers closest to the target in order
+// of distance, leaving out the requester even when it is the target
+func TestFindNodeHandler(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	requester := newTestNode(t, network, 10001)
+	peers := make([]Contact, 6)
+	for i := range peers {
+		peers[i] = contactAtDistance(node.id, uint(150-10*i), int64(i), i+1)
+	}
+	node.rt.ImportContacts(peers)
+	node.rt.touch(*NewContactWithID(requester.id, requester.addr))
+
+	var reply FindNodeReply
+	args := FindNodeArgs{Source: requester.addr, Key: requester.id.Text(keyBase)}
+	if err := node.FindNode(args, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Contacts) != len(peers) {
+		t.Fatalf("FINDNODE returned %d contacts, want %d", len(reply.Contacts), len(peers))
+	}
+	for i, contact := range reply.Contacts {
+		if contact.Id.Sign() == 0 || contact.Id.Cmp(&requester.id) == 0 {
+			t.Errorf("FINDNODE returned %s", contact)
+		}
+		if i > 0 && Distance(requester.id, reply.Contacts[i-1].Id).Cmp(Distance(requester.id, contact.Id)) > 0 {
+			t.Errorf("contact %d is closer to the target than contact %d", i, i-1)
+		}
+	}
+}
+
+// Every RPC a node receives records when it last heard from the sender, and
+// the table keeps contacts ordered by that time
+func TestLastSeenOnRPC(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock))
+	a := newTestNode(t, network, 10001)
+	b := newTestNode(t, network, 10002)
+
+	for _, sender := range []*Node{a, b, a} {
+		clock.Advance(time.Minute)
+		if !sender.doPing(context.Background(), node.addr) {
+			t.Fatalf("%s's PING failed", sender)
+		}
+		contact := node.rt.ContactFromID(sender.id)
+		if contact == nil || !contact.lastSeen.Equal(clock.Now()) {
+			t.Fatalf("after a PING from %s its contact is %v, want it last seen now", sender, contact)
+		}
+	}
+	contacts := node.rt.allContacts()
+	if len(contacts) != 2 || contacts[0].Id.Cmp(&a.id) != 0 || contacts[1].Id.Cmp(&b.id) != 0 {
+		t.Errorf("contacts are %v, want the most recently heard from first", contacts)
+	}
+}
+
+// 100 pairs sent in one BATCHSTORE all land, and a batch with a pair the peer
+// rejects stores none of them
+func TestBatchStore(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	peer := newTestNode(t, network, 10001)
+	contact := *NewContactWithID(peer.id, peer.addr)
+
+	pairs := make([]KeyValue, 100)
+	for i := range pairs {
+		pairs[i] = KeyValue{fmt.Sprintf("%x", i), []byte{byte(i)}}
+	}
+	if err := node.batchStore(context.Background(), contact, pairs); err != nil {
+		t.Fatal(err)
+	}
+	if got := peer.Stats().StoresReceived; got != 1 {
+		t.Errorf("peer received %d RPCs, want a single BATCHSTORE", got)
+	}
+	for _, pair := range pairs {
+		if val, ok := peer.ht.get(pair.Key); !ok || !bytes.Equal(val, pair.Val) {
+			t.Errorf("key %s holds %v, %t on the peer", pair.Key, val, ok)
+		}
+	}
+
+	bad := []KeyValue{{"good", []byte("1")}, {"big", make([]byte, maxValueSize+1)}}
+	if err := node.batchStore(context.Background(), contact, bad); err == nil {
+		t.Error("BATCHSTORE with an oversized value succeeded")
+	}
+	if _, ok := peer.ht.get("good"); ok {
+		t.Error("part of a rejected BATCHSTORE was stored")
+	}
+}
+
+// A new node isn't ready until it has bootstrapped, and WaitReady returns once
+// it has
+func TestWaitReady(t *testing.T) {
+	network := NewMemoryNetwork()
+	seed := newTestNode(t, network, 10000)
+	node := newTestNode(t, network, 10001)
+	if node.IsReady() {
+		t.Fatal("a new node is ready")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := node.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitReady on a node that never bootstraps returned %v", err)
+	}
+
+	ready := make(chan error, 1)
+	go func() { ready <- node.WaitReady(context.Background()) }()
+	if err := node.Bootstrap(context.Background(), *NewContactWithID(seed.id, seed.addr)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ready:
+		if err != nil {
+			t.Errorf("WaitReady returned %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitReady didn't return after a bootstrap")
+	}
+	if !node.IsReady() {
+		t.Error("node isn't ready after a bootstrap")
+	}
+}
+
+// The node's ID, and the IDs of keys, come from the configured hash function
+func TestConfiguredHash(t *testing.T) {
+	addr := freeAddr(t)
+	custom := func(data []byte) big.Int {
+		return *big.NewInt(int64(len(data)))
+	}
+	for name, hash := range map[string]HashFunc{"SHA1": SHA1, "SHA256Truncated": SHA256Truncated, "custom": custom} {
+		node, err := NewNode(addr, WithLogger(NopLogger()), WithHash(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := hash([]byte(canonicalAddr(addr))); node.id.Cmp(&want) != 0 {
+			t.Errorf("%s: node ID is %s, want %s", name, IDToHex(node.id), IDToHex(want))
+		}
+		if want := hash([]byte("key")); node.keyID([]byte("key")) != want.Text(keyBase) {
+			t.Errorf("%s: key ID is %s, want %s", name, node.keyID([]byte("key")), want.Text(keyBase))
+		}
+	}
+}
+
+// A node that shuts down hands the values it holds off to the node that
+// stays behind
+func TestShutdownHandsOffValues(t *testing.T) {
+	network, nodes := newTestNetwork(t, 2)
+	leaving, staying := nodes[1], nodes[0]
+	want := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		key := leaving.keyID([]byte(fmt.Sprintf("key%d", i)))
+		want[key] = fmt.Sprintf("value%d", i)
+		leaving.ht.add(key, []byte(want[key]), i%2 == 0)
+	}
+
+	if err := leaving.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil", err)
+	}
+	network.Remove(leaving.addr)
+	for key, val := range want {
+		if got, ok := staying.ht.get(key); !ok || string(got) != val {
+			t.Errorf("after the handoff %s holds %q, %v, want %q, true", key, got, ok, val)
+		}
+	}
+}
+
+// A FINDNODE bounded by a distance only returns the contacts within it, and an
+// unbounded one returns the closest contacts as before
+func TestFindNodeWithinDistance(t *testing.T) {
+	network := NewMemoryNetwork()
+	a := newTestNode(t, network, 10000)
+	b := newTestNode(t, network, 10001)
+	target := SHA1([]byte("target"))
+	bits := []uint{10, 50, 100, 120}
+	for i, bit := range bits {
+		b.rt.ImportContacts([]Contact{contactAtDistance(target, bit, 0, i+1)})
+	}
+
+	bound := new(big.Int).Lsh(big.NewInt(1), 60)
+	got := a.doFindNodeWithin(context.Background(), target.Text(keyBase), b.addr, bound)
+	if len(got) != 2 {
+		t.Fatalf("bounded FINDNODE returned %v, want the 2 contacts within 2^60", got)
+	}
+	for _, contact := range got {
+		if Distance(contact.Id, target).Cmp(bound) >= 0 {
+			t.Errorf("bounded FINDNODE returned %s, which is beyond the bound", contact)
+		}
+	}
+
+	got = a.doFindNodeWithin(context.Background(), target.Text(keyBase), b.addr, nil)
+	if len(got) < len(bits) {
+		t.Errorf("unbounded FINDNODE returned %v, want at least the %d contacts", got, len(bits))
+	}
+}
+
+// Garbage sent to the listener, as HTTP or after the RPC handshake, gets its
+// connection closed while the node keeps answering valid peers
+func TestMalformedRequests(t *testing.T) {
+	a := listeningNode(t)
+	b := listeningNode(t)
+	addr := b.addr
+
+	payloads := []string{
+		"not even HTTP\r\n\r\n",
+		"CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n\x07garbage that isn't gob",
+	}
+	for _, payload := range payloads {
+		conn, err := net.DialTCP("tcp", nil, &addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, payload); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Errorf("connection sent %q wasn't closed: %v", payload, err)
+		}
+		conn.Close()
+
+		if !a.doPing(context.Background(), b.addr) {
+			t.Fatalf("b stopped answering PINGs after %q", payload)
+		}
+	}
+}
+
+// A contact we already know moves to the front of its bucket when it sends us
+// any RPC, and its failed RPCs are forgotten
+func TestInboundRPCPromotesContact(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock))
+	sender := newTestNode(t, network, 10001)
+
+	known := *NewContactWithID(sender.id, sender.addr)
+	known.lastSeen = clock.Now()
+	bit := uint(bucketIndex(node.id, sender.id))
+	other := contactAtDistance(node.id, bit, 1, 1)
+	clock.Advance(time.Minute)
+	other.lastSeen = clock.Now()
+	node.rt.ImportContacts([]Contact{known, other})
+	node.rt.markFailed(known)
+	bucket := node.rt.kBuckets[node.rt.indexFromID(&sender.id)]
+	if front := bucket.getAllContacts()[0]; front.Id.Cmp(&other.Id) != 0 {
+		t.Fatalf("bucket starts with %s, want %s", front, other)
+	}
+
+	clock.Advance(time.Minute)
+	sender.doFindNode(context.Background(), sender.keyID([]byte("key")), node.addr)
+	front := bucket.getAllContacts()[0]
+	if front.Id.Cmp(&sender.id) != 0 || !front.lastSeen.Equal(clock.Now()) {
+		t.Errorf("after a FINDNODE from %s the bucket starts with %s, want the sender last seen now", sender, front)
+	}
+	node.rt.mu.Lock()
+	failures := node.rt.failures[sender.id.Text(keyBase)]
+	node.rt.mu.Unlock()
+	if failures != 0 {
+		t.Errorf("sender still has %d failures", failures)
+	}
+}
@@ -0,0 +1,33 @@
+package kademlia
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Save writes every contact in the table to w as JSON so the table can be
+// restored with LoadRoutingTable after a restart
+func (self *RoutingTable) Save(w io.Writer) error {
+	return json.NewEncoder(w).Encode(self.allContacts())
+}
+
+// LoadRoutingTable builds a routing table for owner from contacts written by
+// Save. Loaded contacts are stale: they have no lastSeen time, so they are the
+// first to be pinged and evicted when their bucket fills up
+func LoadRoutingTable(r io.Reader, owner *Node) (*RoutingTable, error) {
+	var contacts []Contact
+	if err := json.NewDecoder(r).Decode(&contacts); err != nil {
+		return nil, err
+	}
+
+	// Save lists each bucket most recent first. Loaded contacts have no
+	// lastSeen, and each one is put ahead of the others without one, so
+	// import them in reverse to keep each bucket's order
+	reversed := make([]Contact, len(contacts))
+	for i, contact := range contacts {
+		reversed[len(contacts)-1-i] = contact
+	}
+	rt := NewRoutingTable(owner)
+	rt.ImportContacts(reversed)
+	return rt, nil
+}
@@ -0,0 +1,43 @@
+package kademlia
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// A saved table loads into a fresh node with the same contacts in the same
+// buckets and order, all of them marked stale
+func TestSaveLoadRoutingTable(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	for i := 0; i < 12; i++ {
+		contact := contactAtDistance(node.id, uint(159-i*10), int64(i%2), i+1)
+		contact.lastSeen = time.Unix(int64(1000+i), 0)
+		node.rt.add(contact)
+	}
+	var buf bytes.Buffer
+	if err := node.rt.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	rt, err := LoadRoutingTable(&buf, fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, loaded := node.rt.allContacts(), rt.allContacts()
+	if len(loaded) != len(saved) || rt.Size() != node.rt.Size() {
+		t.Fatalf("loaded %d contacts with Size %d, saved %d with Size %d", len(loaded), rt.Size(), len(saved), node.rt.Size())
+	}
+	for i := range saved {
+		if loaded[i].Id.Cmp(&saved[i].Id) != 0 || !AreEqualAddrs(loaded[i].Addr, saved[i].Addr) {
+			t.Errorf("contact %d loaded as %s, want %s", i, loaded[i], saved[i])
+		}
+		if !loaded[i].lastSeen.IsZero() {
+			t.Errorf("loaded %s isn't stale", loaded[i])
+		}
+	}
+	if rt.lowest != node.rt.lowest {
+		t.Errorf("loaded table's lowest bucket is %d, want %d", rt.lowest, node.rt.lowest)
+	}
+}
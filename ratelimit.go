@@ -0,0 +1,71 @@
+package kademlia
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per source. Each source may send burst RPCs
+// at once and then rate per second, so the short bursts of a lookup get
+// through but a flood doesn't
+type rateLimiter struct {
+	rate    float64 // tokens added per second
+	burst   float64 // most tokens a bucket holds
+	buckets map[string]*tokenBucket
+	clock   Clock
+	mu      *sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	limiter := new(rateLimiter)
+	limiter.rate = rate
+	limiter.burst = float64(burst)
+	limiter.buckets = make(map[string]*tokenBucket)
+	limiter.clock = clock
+	limiter.mu = &sync.Mutex{}
+	return limiter
+}
+
+// allow takes a token from source's bucket and reports whether there was one
+// Once more than maxRateLimitSources are tracked, buckets that have refilled
+// completely are dropped, since a new bucket starts out full anyway
+func (limiter *rateLimiter) allow(source string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := limiter.clock.Now()
+
+	if len(limiter.buckets) > maxRateLimitSources {
+		for other, bucket := range limiter.buckets {
+			if limiter.refill(bucket, now) >= limiter.burst {
+				delete(limiter.buckets, other)
+			}
+		}
+	}
+
+	bucket, ok := limiter.buckets[source]
+	if !ok {
+		bucket = &tokenBucket{limiter.burst, now}
+		limiter.buckets[source] = bucket
+	}
+	if limiter.refill(bucket, now) < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// refill adds the tokens bucket earned since it was last updated and returns
+// how many it holds
+func (limiter *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * limiter.rate
+	if bucket.tokens > limiter.burst {
+		bucket.tokens = limiter.burst
+	}
+	bucket.updated = now
+	return bucket.tokens
+}
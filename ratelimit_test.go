@@ -0,0 +1,74 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// A flooder that claims a different Source on every PING still shares one
+// token bucket, since the limit is kept per connection address
+func TestRateLimitIgnoresClaimedSource(t *testing.T) {
+	server, err := NewNode(freeAddr(t), WithLogger(NopLogger()), WithRateLimit(0.001, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewNode(freeAddr(t), WithLogger(NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	limited := 0
+	for i := 0; i < 10; i++ {
+		source := net.TCPAddr{IP: net.IPv4(10, 0, byte(i), 1), Port: 4000 + i}
+		args := PingArgs{Source: source, Version: protocolVersion}
+		var reply PingReply
+		err := client.transport.Call(context.Background(), server.addr, "Ping", args, &reply)
+		if _, ok := err.(rpc.ServerError); ok {
+			limited++
+		} else if err != nil {
+			t.Fatalf("PING %d failed: %s", i, err)
+		}
+	}
+	if limited != 7 {
+		t.Errorf("%d of 10 PINGs were rate limited, want 7", limited)
+	}
+	if got := server.Stats().RateLimited; got != 7 {
+		t.Errorf("Stats().RateLimited = %d, want 7", got)
+	}
+}
+
+// Over the limit, the PING is rejected before its body is decoded, so the
+// handler, and any signature check in it, never runs
+func TestRateLimitRunsBeforeHandler(t *testing.T) {
+	server, err := NewNode(freeAddr(t), WithLogger(NopLogger()), WithRateLimit(0.001, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := NewNode(freeAddr(t), WithLogger(NopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if !client.doPing(context.Background(), server.addr) {
+		t.Fatal("first PING wasn't answered")
+	}
+	received := server.Stats().PingsReceived
+	if client.doPing(context.Background(), server.addr) {
+		t.Fatal("second PING was answered")
+	}
+	if got := server.Stats().PingsReceived; got != received {
+		t.Errorf("the handler ran for a rate limited PING")
+	}
+}
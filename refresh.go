@@ -0,0 +1,66 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// refreshBucket performs a node lookup for a random ID in bucket index, which
+// fills the bucket with any nodes we don't know about yet
+func (node *Node) refreshBucket(ctx context.Context, index int) error {
+	id := randomIDInBucket(node.id, index, node.rng)
+	node.logger.Infof("Refreshing bucket %d with lookup of %s", index, id.Text(keyBase))
+	_, err := node.doIterativeFindNode(ctx, id.Text(keyBase))
+	return err
+}
+
+// ageOut pings every contact we haven't heard from within age and removes the
+// ones that don't answer. Up to alpha contacts are pinged at once, so a table
+// full of contacts that were never seen doesn't stall on one timeout after
+// another. A contact that answers is seen again, so it isn't pinged on the
+// next pass. Contacts whose PING was cut short by ctx are kept
+func (node *Node) ageOut(ctx context.Context, age time.Duration) {
+	pending := make(chan struct{}, node.alpha)
+	var wg sync.WaitGroup
+	for _, contact := range node.rt.staleContacts(age) {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case pending <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			defer func() { <-pending }()
+			if !node.pingContact(ctx, contact) && ctx.Err() == nil {
+				node.logger.Infof("Removing %s, it hasn't been seen for %s and didn't answer a PING", contact, age)
+				node.rt.remove(contact)
+			}
+		}(contact)
+	}
+	wg.Wait()
+}
+
+// startRefreshLoop checks the routing table every interval in the background.
+// Contacts that haven't been seen within tAgeOut and don't answer a PING are
+// removed, then the buckets that haven't been accessed within tRefresh are
+// refreshed. Intervals are measured on the node's clock. The loop stops when
+// the node is closed
+func (node *Node) startRefreshLoop(interval time.Duration) {
+	done := node.done
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-node.clock.After(interval):
+				node.ageOut(context.Background(), tAgeOut)
+				for _, index := range node.rt.staleBuckets(tRefresh) {
+					node.refreshBucket(context.Background(), index)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package kademlia
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Buckets are only refreshed once the node's clock says they are stale, and
+// the check runs on that clock too
+func TestRefreshLoopRefreshesStaleBuckets(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock))
+	peer := newTestNode(t, network, 10001)
+	defer node.Close()
+	if !node.doPing(context.Background(), peer.addr) {
+		t.Fatal("Peer didn't answer a PING")
+	}
+	lookups := func() uint64 { return atomic.LoadUint64(&peer.stats.FindNodesReceived) }
+
+	interval := time.Minute
+	node.startRefreshLoop(interval)
+	waitFor(t, "the refresh loop to wait on the clock", func() bool { return clock.waiting() == 1 })
+	clock.Advance(interval)
+	waitFor(t, "the fresh check to finish", func() bool { return clock.waiting() == 1 })
+	if got := lookups(); got != 0 {
+		t.Fatalf("%d lookups sent while every bucket was fresh", got)
+	}
+
+	clock.Advance(tRefresh)
+	waitFor(t, "a stale bucket to be refreshed", func() bool { return lookups() > 0 })
+}
+
+// Contacts unseen for tAgeOut by the node's clock are pinged, and removed if
+// they don't answer
+func TestAgeOutRemovesDeadContacts(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock))
+	peer := newTestNode(t, network, 10001)
+	dead := *NewContactWithID(*big.NewInt(12345), net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10002})
+	node.rt.touch(*NewContactWithID(peer.id, peer.addr))
+	node.rt.touch(dead)
+
+	pings := node.Stats().PingsSent
+	node.ageOut(context.Background(), tAgeOut)
+	if sent := node.Stats().PingsSent - pings; sent != 0 || node.rt.Size() != 2 {
+		t.Fatalf("ageOut sent %d PINGs and left %d contacts before anyone was stale", sent, node.rt.Size())
+	}
+
+	clock.Advance(tAgeOut)
+	node.ageOut(context.Background(), tAgeOut)
+	if node.rt.ContactFromID(dead.Id) != nil {
+		t.Error("dead contact wasn't aged out")
+	}
+	if node.rt.ContactFromID(peer.id) == nil {
+		t.Error("live contact was aged out")
+	}
+}
+
+// blockingTransport holds every PING until its context is done, counting how
+// many are in flight
+type blockingTransport struct {
+	*MemoryNetwork
+	inFlight int32
+	most     int32
+}
+
+func (transport *blockingTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	if method != "Ping" {
+		return transport.MemoryNetwork.Call(ctx, to, method, args, reply)
+	}
+	n := atomic.AddInt32(&transport.inFlight, 1)
+	defer atomic.AddInt32(&transport.inFlight, -1)
+	for {
+		most := atomic.LoadInt32(&transport.most)
+		if n <= most || atomic.CompareAndSwapInt32(&transport.most, most, n) {
+			break
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Stale contacts are pinged alpha at a time, and the ones whose PING ctx cut
+// short stay in the table
+func TestAgeOutPingsAlphaAtOnce(t *testing.T) {
+	transport := &blockingTransport{MemoryNetwork: NewMemoryNetwork()}
+	node := newTestNode(t, transport.MemoryNetwork, 10000, WithTransport(transport))
+	contacts := make([]Contact, 10)
+	for i := range contacts {
+		contacts[i] = contactAtDistance(node.id, uint(100+i), 0, i+1)
+	}
+	node.rt.ImportContacts(contacts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		node.ageOut(ctx, tAgeOut)
+		close(done)
+	}()
+	waitFor(t, "alpha PINGs in flight", func() bool { return atomic.LoadInt32(&transport.inFlight) == int32(node.alpha) })
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	if most := atomic.LoadInt32(&transport.most); most != int32(node.alpha) {
+		t.Errorf("%d PINGs were in flight at once, want alpha (%d)", most, node.alpha)
+	}
+	if size := node.rt.Size(); size != len(contacts) {
+		t.Errorf("table has %d contacts after a cancelled pass, want all %d", size, len(contacts))
+	}
+}
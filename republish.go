@@ -0,0 +1,108 @@
+package kademlia
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// expireLoop removes expired key/value pairs every interval, measured on the
+// node's clock, until the node is closed
+func (node *Node) expireLoop(interval time.Duration) {
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-node.clock.After(interval):
+			if removed := node.ht.expire(); removed > 0 {
+				node.logger.Infof("Expired %d keys", removed)
+			}
+		}
+	}
+}
+
+// republishLoop stores our key/value pairs on the closest nodes every
+// interval, measured on the node's clock, until the node is closed. Values we
+// are the origin of are only republished every tRepublish, all others every
+// tReplicate
+func (node *Node) republishLoop(interval time.Duration) {
+	if node.stores != nil {
+		go node.drainStoreQueue()
+	}
+	for {
+		select {
+		case <-node.done:
+			return
+		case <-node.clock.After(interval):
+			node.republish(context.Background(), false)
+		}
+	}
+}
+
+// republish stores every key/value pair that is due on the closest nodes,
+// or every pair if all is set. The pairs are grouped by destination so each
+// node gets a single BATCHSTORE
+// Unless all is set, the BATCHSTOREs go through the store queue if there is
+// one, and keys that don't fit in it stay due for the next republish.
+// Otherwise they are all sent at once and republish waits for them
+func (node *Node) republish(ctx context.Context, all bool) {
+	batches := make(map[string][]KeyValue)
+	contacts := make(map[string]Contact)
+	due := make([]string, 0)
+	for kv := range node.ht.Iterator() {
+		// cached copies just expire
+		if kv.isCached {
+			continue
+		}
+		age := node.clock.Now().Sub(kv.publishedAt)
+		if !all && ((kv.isOrigin && age < tRepublish) || (!kv.isOrigin && age < tReplicate)) {
+			continue
+		}
+		node.logger.Infof("Republishing key %s", kv.key)
+		closest, err := node.doIterativeFindN(ctx, kv.key, node.replication)
+		if err != nil {
+			node.logger.Warnf("Republishing key %s failed: %s", kv.key, err)
+			continue
+		}
+		for _, contact := range closest {
+			addr := contact.Addr.String()
+			batches[addr] = append(batches[addr], KeyValue{kv.key, kv.val})
+			contacts[addr] = contact
+		}
+		due = append(due, kv.key)
+	}
+
+	if !all && node.stores != nil {
+		deferred := make(map[string]bool)
+		for addr, pairs := range batches {
+			for _, pair := range node.queueStore(contacts[addr], pairs) {
+				deferred[pair.Key] = true
+			}
+		}
+		if len(deferred) > 0 {
+			node.logger.Warnf("Store queue is full, deferring %d keys to the next republish", len(deferred))
+		}
+		for _, key := range due {
+			if !deferred[key] {
+				node.ht.markPublished(key)
+			}
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for addr, pairs := range batches {
+		wg.Add(1)
+		go func(contact Contact, pairs []KeyValue) {
+			defer wg.Done()
+			if err := node.batchStore(ctx, contact, pairs); err != nil {
+				node.logger.Warnf("%s", err)
+			}
+		}(contacts[addr], pairs)
+	}
+	wg.Wait()
+
+	for _, key := range due {
+		node.ht.markPublished(key)
+	}
+}
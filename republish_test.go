@@ -0,0 +1,72 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpireLoopRemovesExpiredKeys(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock))
+	defer node.Close()
+
+	node.ht.add("expiring", []byte("value"), false)
+	node.ht.add("origin", []byte("value"), true)
+	clock.Advance(tExpire / 2)
+	node.ht.add("fresh", []byte("value"), false)
+
+	go node.expireLoop(tStoreCheck)
+	waitFor(t, "the expire loop to wait on the clock", func() bool { return clock.waiting() == 1 })
+	clock.Advance(tExpire / 2)
+	waitFor(t, "the expired key to be removed", func() bool {
+		_, ok := node.ht.get("expiring")
+		return !ok
+	})
+	for _, key := range []string{"origin", "fresh"} {
+		if _, ok := node.ht.get(key); !ok {
+			t.Errorf("Key %s was removed before it expired", key)
+		}
+	}
+}
+
+// Keys are republished once they are due by the node's clock: replicated
+// ones after tReplicate, our own only after tRepublish
+func TestRepublishLoopRepublishesDueKeys(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	node := newTestNode(t, network, 10000, WithClock(clock), WithRepublishRate(0))
+	peer := newTestNode(t, network, 10001)
+	defer node.Close()
+	if !node.doPing(context.Background(), peer.addr) {
+		t.Fatal("Peer didn't answer a PING")
+	}
+	replicated := IDToHex(peer.id)
+	origin := IDToHex(node.id)
+	node.ht.add(replicated, []byte("value"), false)
+	node.ht.add(origin, []byte("value"), true)
+	held := func(key string) bool {
+		_, ok := peer.ht.get(key)
+		return ok
+	}
+
+	interval := time.Minute
+	go node.republishLoop(interval)
+	waitFor(t, "the republish loop to wait on the clock", func() bool { return clock.waiting() == 1 })
+	clock.Advance(interval)
+	waitFor(t, "the first republish check", func() bool { return clock.waiting() == 1 })
+	if held(replicated) || held(origin) {
+		t.Fatal("A key was republished before it was due")
+	}
+
+	clock.Advance(tReplicate)
+	waitFor(t, "the replicated key to be republished", func() bool { return held(replicated) })
+	waitFor(t, "the republish to finish", func() bool { return clock.waiting() == 1 })
+	if held(origin) {
+		t.Fatal("Our own key was republished before tRepublish")
+	}
+
+	clock.Advance(tRepublish)
+	waitFor(t, "our own key to be republished", func() bool { return held(origin) })
+}
@@ -0,0 +1,29 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Resolve looks up the current address of the node with id. Returns an error
+// if no node with id is among the k closest nodes the lookup converges on, or
+// ctx's error if ctx is done first
+func (node *Node) Resolve(ctx context.Context, id big.Int) (*net.TCPAddr, error) {
+	if id.Cmp(&node.id) == 0 {
+		addr := node.addr
+		return &addr, nil
+	}
+	closest, err := node.doIterativeFindNode(ctx, id.Text(keyBase))
+	if err != nil {
+		return nil, err
+	}
+	for _, contact := range closest {
+		if contact.Id.Cmp(&id) == 0 {
+			addr := contact.Addr
+			return &addr, nil
+		}
+	}
+	return nil, fmt.Errorf("No node found with ID %s", IDToHex(id))
+}
@@ -0,0 +1,26 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+)
+
+// A node resolves the address of a node it only reaches through another one,
+// and fails to resolve an ID no node has
+func TestResolveTwoHops(t *testing.T) {
+	network := NewMemoryNetwork()
+	requester := newTestNode(t, network, 10000)
+	middle := newTestNode(t, network, 10001)
+	target := newTestNode(t, network, 10002)
+	requester.rt.ImportContacts([]Contact{*NewContactWithID(middle.id, middle.addr)})
+	middle.rt.ImportContacts([]Contact{*NewContactWithID(target.id, target.addr)})
+
+	addr, err := requester.Resolve(context.Background(), target.id)
+	if err != nil || !AreEqualAddrs(*addr, target.addr) {
+		t.Fatalf("Resolve returned %v, %v, want %s, nil", addr, err, target.addr.String())
+	}
+	missing := SHA1([]byte("nobody"))
+	if addr, err := requester.Resolve(context.Background(), missing); err == nil {
+		t.Errorf("Resolve of an unknown ID returned %v, want an error", addr)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
@@ -36,9 +35,9 @@ func (node *Node) handlePingIP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	node.logger.Printf("Performing IP PING of %s", addr)
+	node.logger.Infof("Performing IP PING of %s", addr)
 
-	if node.doPing(*addr) {
+	if node.doPing(r.Context(), *addr) {
 		fmt.Fprintf(w, "Host %s successfully pinged", ipString)
 	} else {
 		fmt.Fprintf(w, "PING of Host %s unsuccessful", ipString)
@@ -52,30 +51,29 @@ func (node *Node) handlePingID(w http.ResponseWriter, r *http.Request) {
 
 	idString := r.URL.Path[len("/ping/id/"):]
 
-	id := new(big.Int)
-	_, success := id.SetString(idString, 16)
-	if !success {
+	id, err := HexToID(idString)
+	if err != nil {
 		fmt.Fprintf(w, "Invalid id: %s", idString)
 		return
 	}
 
-	node.logger.Printf("Performing ID PING of %s", id.String())
+	node.logger.Infof("Performing ID PING of %s", IDToHex(id))
 
-	contact := node.rt.ContactFromID(*id)
+	contact := node.rt.ContactFromID(id)
 	if contact == nil {
-		fmt.Fprintf(w, "Could not find %s in routing table", id.String())
-		node.logger.Printf("Could not find %s in the routing table", id.String())
+		fmt.Fprintf(w, "Could not find %s in routing table", IDToHex(id))
+		node.logger.Warnf("Could not find %s in the routing table", IDToHex(id))
 		return
 	}
 
 	addr := contact.Addr
 
-	node.doPing(addr)
+	node.doPing(r.Context(), addr)
 
-	if node.doPing(addr) {
-		fmt.Fprintf(w, "Host %s successfully pinged", id.String())
+	if node.doPing(r.Context(), addr) {
+		fmt.Fprintf(w, "Host %s successfully pinged", IDToHex(id))
 	} else {
-		fmt.Fprintf(w, "PING of Host %s unsuccessful", id.String())
+		fmt.Fprintf(w, "PING of Host %s unsuccessful", IDToHex(id))
 	}
 }
 
@@ -91,9 +89,18 @@ func (node *Node) handleStore(w http.ResponseWriter, r *http.Request) {
 	}
 
 	encoded := base64.StdEncoding.EncodeToString(value)
-	node.logger.Printf("Received REST STORE for key: (%s), value: (%s)", key, encoded)
+	node.logger.Infof("Received REST STORE for key: (%s), value: (%s)", key, encoded)
+
+	if len(value) > maxValueSize {
+		fmt.Fprintf(w, "Value is %d bytes, limit is %d", len(value), maxValueSize)
+		return
+	}
 
-	closest := node.doIterativeFindNode(key)
+	closest, err := node.doIterativeFindNode(r.Context(), key)
+	if err != nil {
+		fmt.Fprintf(w, "Couldn't find nodes for key (%s): %s", key, err)
+		return
+	}
 	// TODO: Check that we have a node that is the closest
 	var storeHere net.TCPAddr
 	if len(closest) > 0 {
@@ -101,7 +108,7 @@ func (node *Node) handleStore(w http.ResponseWriter, r *http.Request) {
 	} else {
 		storeHere = node.addr
 	}
-	node.doStore(key, value, storeHere)
+	node.doStore(r.Context(), key, value, storeHere)
 
 	fmt.Fprintf(w, "Successfully stored key (%s)", key)
 }
@@ -118,9 +125,12 @@ func (node *Node) handleStoreHere(w http.ResponseWriter, r *http.Request) {
 	}
 
 	encoded := base64.StdEncoding.EncodeToString(value)
-	node.logger.Printf("Received STORE_HERE for key: (%s), value: (%s)", key, encoded)
+	node.logger.Infof("Received STORE_HERE for key: (%s), value: (%s)", key, encoded)
 
-	node.ht.add(key, value, true)
+	if err := node.ht.add(key, value, true); err != nil {
+		fmt.Fprintf(w, "Couldn't store key (%s): %s", key, err)
+		return
+	}
 
 	fmt.Fprintf(w, "Successfully stored key (%s)", key)
 }
@@ -177,9 +187,12 @@ func (node *Node) handleIterativeFindNode(w http.ResponseWriter, r *http.Request
 		return
 	}
 	id := r.URL.Path[len("/iterative/findnode/"):]
-	node.logger.Printf("Node got REST FindNode request for ID %s", id)
+	node.logger.Infof("Node got REST FindNode request for ID %s", id)
 
-	contacts := node.doIterativeFindNode(id)
+	contacts, err := node.doIterativeFindNode(r.Context(), id)
+	if err != nil {
+		node.logger.Errorf("REST FindNode request for ID %s failed: %s", id, err)
+	}
 	enc := json.NewEncoder(w)
 	enc.Encode(contacts)
 }
@@ -190,11 +203,13 @@ func (node *Node) handleIterativeFindValue(w http.ResponseWriter, r *http.Reques
 	}
 
 	key := r.URL.Path[len("/iterative/findvalue/"):]
-	node.logger.Printf("Node got REST FindValue request for ID %s", key)
+	node.logger.Infof("Node got REST FindValue request for ID %s", key)
 
-	value := node.doIterativeFindValue(key)
-	if value == nil {
-		node.logger.Printf("ERROR with REST FindValue request for ID %s", key)
+	value, found, err := node.doIterativeFindValue(r.Context(), key)
+	if err != nil {
+		node.logger.Errorf("REST FindValue request for ID %s failed: %s", key, err)
+	} else if !found {
+		node.logger.Warnf("REST FindValue request for ID %s found no value", key)
 	}
 	enc := json.NewEncoder(w)
 	enc.Encode(value)
@@ -206,7 +221,7 @@ func (node *Node) handleShutdown(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	node.logger.Println("Shutdown received. Terminating")
+	node.logger.Infof("Shutdown received. Terminating")
 
 	fmt.Fprintf(w, "Called SHUTDOWN")
 
@@ -215,19 +230,19 @@ func (node *Node) handleShutdown(w http.ResponseWriter, r *http.Request) {
 
 // setupControlEndpoints registers handlers for the remote control REST API
 func (node *Node) setupControlEndpoints() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "")
 	})
 
 	// Handle request to ping a specific server by IP address
 	// GET /ping/ip/<ip addr>
-	http.HandleFunc("/ping/ip/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/ping/ip/", func(w http.ResponseWriter, r *http.Request) {
 		node.handlePingIP(w, r)
 	})
 
 	// Handle request to ping a specific server by ID
 	// GET /ping/id/<id>
-	http.HandleFunc("/ping/id/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/ping/id/", func(w http.ResponseWriter, r *http.Request) {
 		node.handlePingID(w, r)
 	})
 
@@ -235,7 +250,7 @@ func (node *Node) setupControlEndpoints() {
 	// This node becomes the originator
 	// POST /store_here/<key>
 	// Body is raw value
-	http.HandleFunc("/store_here/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/store_here/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleStoreHere(w, r)
 	})
 
@@ -243,41 +258,41 @@ func (node *Node) setupControlEndpoints() {
 	// This node becomes the originator
 	// POST /store/<key>
 	// Body is raw value
-	http.HandleFunc("/store/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/store/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleStore(w, r)
 	})
 
-	http.HandleFunc("/table", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/table", func(w http.ResponseWriter, r *http.Request) {
 		node.handleGetTable(w, r)
 	})
 
 	// Handle oneshot request to find node with specific node id
 	// GET /find/<id>
-	http.HandleFunc("/oneshot/findnode/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/oneshot/findnode/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleOneshotFindNode(w, r)
 	})
 
 	// Handle oneshot request to find specific value
 	// GET /findvalue/<key>
-	http.HandleFunc("/oneshot/findvalue/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/oneshot/findvalue/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleOneshotFindValue(w, r)
 	})
 
 	// Handle iterative request to find node with specific node id
 	// GET /find/<id>
-	http.HandleFunc("/iterative/findnode/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/iterative/findnode/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleIterativeFindNode(w, r)
 	})
 
 	// Handle iterative request to find specific value
 	// GET /findvalue/<key>
-	http.HandleFunc("/iterative/findvalue/", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/iterative/findvalue/", func(w http.ResponseWriter, r *http.Request) {
 		node.handleIterativeFindValue(w, r)
 	})
 
 	// Handle request to shutdown server
 	// GET /shutdown
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+	node.mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
 		node.handleShutdown(w, r)
 	})
 }
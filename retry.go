@@ -0,0 +1,54 @@
+package kademlia
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how often a failed RPC is tried again. The delay before
+// attempt n+1 is BaseDelay * 2^(n-1), moved up or down by a random fraction of
+// up to Jitter so that retries from many nodes don't line up
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times an RPC is sent. 1 means
+	// failed RPCs aren't retried
+	MaxAttempts int
+	BaseDelay   time.Duration
+	// Jitter is between 0 and 1. NewNode rejects policies outside that range
+	Jitter float64
+}
+
+// noRetries is the default policy
+var noRetries = RetryPolicy{MaxAttempts: 1}
+
+// delay returns how long to wait after the given failed attempt, counting
+// from 1
+// The delay stops doubling after maxRetryDoublings attempts and never
+// exceeds the largest Duration
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	doublings := attempt - 1
+	if doublings > maxRetryDoublings {
+		doublings = maxRetryDoublings
+	}
+	delay := float64(policy.BaseDelay) * float64(int64(1)<<uint(doublings))
+	delay *= 1 + policy.Jitter*(2*rand.Float64()-1)
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// validate returns an error if the policy can't be used
+func (policy RetryPolicy) validate() error {
+	if policy.MaxAttempts < 1 {
+		return fmt.Errorf("Retry policy must make at least 1 attempt, got %d", policy.MaxAttempts)
+	}
+	if policy.BaseDelay < 0 {
+		return fmt.Errorf("Retry delay can't be negative, got %s", policy.BaseDelay)
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		return fmt.Errorf("Retry jitter must be between 0 and 1, got %f", policy.Jitter)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyTransport fails the first failures calls, then passes the rest on
+type flakyTransport struct {
+	*MemoryNetwork
+	failures int32
+	calls    int32
+}
+
+func (transport *flakyTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	if atomic.AddInt32(&transport.calls, 1) <= transport.failures {
+		return errors.New("connection reset")
+	}
+	return transport.MemoryNetwork.Call(ctx, to, method, args, reply)
+}
+
+func TestRetryFlakyTransport(t *testing.T) {
+	for _, attempts := range []int{2, 3} {
+		transport := &flakyTransport{MemoryNetwork: NewMemoryNetwork(), failures: 2}
+		policy := RetryPolicy{MaxAttempts: attempts, BaseDelay: time.Millisecond}
+		node := newTestNode(t, transport.MemoryNetwork, 10000, WithTransport(transport), WithRetryPolicy(policy))
+		peer := newTestNode(t, transport.MemoryNetwork, 10001)
+
+		ok := node.doPing(context.Background(), peer.addr)
+		if want := attempts > 2; ok != want {
+			t.Errorf("with %d attempts, PING after 2 failures returned %v, want %v", attempts, ok, want)
+		}
+		if calls := atomic.LoadInt32(&transport.calls); calls != int32(attempts) {
+			t.Errorf("with %d attempts, %d calls were made", attempts, calls)
+		}
+	}
+}
+
+func TestRetryDelayBounded(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 1000, BaseDelay: time.Second}
+	if got := policy.delay(1); got != time.Second {
+		t.Errorf("delay(1) = %s, want the base delay", got)
+	}
+	if got := policy.delay(3); got != 4*time.Second {
+		t.Errorf("delay(3) = %s, want 4 times the base delay", got)
+	}
+	capped := policy.delay(maxRetryDoublings + 1)
+	if got := policy.delay(1000); got != capped {
+		t.Errorf("delay(1000) = %s, want it capped at %s", got, capped)
+	}
+
+	policy = RetryPolicy{MaxAttempts: 1000, BaseDelay: 1 << 60, Jitter: 1}
+	for attempt := 1; attempt <= 1000; attempt++ {
+		if got := policy.delay(attempt); got < 0 {
+			t.Fatalf("delay(%d) = %s is negative", attempt, got)
+		}
+	}
+}
+
+func TestRetryPolicyValidated(t *testing.T) {
+	addr := net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+	invalid := []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 2, BaseDelay: -time.Second},
+		{MaxAttempts: 2, Jitter: -0.1},
+		{MaxAttempts: 2, Jitter: 1.5},
+	}
+	for _, policy := range invalid {
+		if _, err := NewNode(addr, WithRetryPolicy(policy)); err == nil {
+			t.Errorf("NewNode accepted retry policy %+v", policy)
+		}
+	}
+	if _, err := NewNode(addr, WithLogger(NopLogger()), WithRetryPolicy(RetryPolicy{MaxAttempts: 2, Jitter: 1})); err != nil {
+		t.Errorf("NewNode rejected a jitter of 1: %s", err)
+	}
+}
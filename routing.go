@@ -1,71 +1,152 @@
 package kademlia
 
 import (
+	"context"
+	"fmt"
 	"math/big"
 	"sort"
 	"sync"
 )
 
 // This file contains the iterative RPCs used for information progagation throughout nodes
-// Calls STORE RPC on k Contacts ( Don't call on self?)
-func (node *Node) doIterativeStore(key string, value []byte) {
-	shortlist := node.doIterativeFindNode(key)
 
-	// get k contacts and send STORE RPC to each
+// lookupConfig bounds how long an iterative lookup runs. A lookup always stops
+// once its shortlist stops changing, and stops early if it hits either limit
+type lookupConfig struct {
+	// maxRounds is the most rounds a lookup sends before it settles for the
+	// shortlist it has
+	maxRounds int
+	// stallRounds is how many rounds in a row may leave the closest contact
+	// unchanged before the lookup gives up on finding a closer one
+	stallRounds int
+}
+
+// stalled reports whether the closest contact in updated is the same as in
+// shortlist, so the round didn't get any closer to the target
+func stalled(shortlist []Contact, updated []Contact) bool {
+	if len(shortlist) == 0 || len(updated) == 0 {
+		return len(shortlist) == len(updated)
+	}
+	return shortlist[0].Id.Cmp(&updated[0].Id) == 0
+}
+
+// finished reports whether a lookup that has run rounds rounds, the last
+// stallCount of which didn't get closer, should stop
+func (config lookupConfig) finished(rounds int, stallCount int) bool {
+	return rounds >= config.maxRounds || stallCount >= config.stallRounds
+}
+// Calls STORE RPC on the replication closest Contacts ( Don't call on self?)
+// Returns once storeQuorum of the nodes have acknowledged the STORE, while the
+// rest finish in the background. Returns an error if the quorum can't be
+// reached or ctx is done first
+func (node *Node) doIterativeStore(ctx context.Context, key string, value []byte) error {
+	shortlist, err := node.doIterativeFindN(ctx, key, node.replication)
+	if err != nil {
+		return err
+	}
+	// siblings the lookup missed that are as close to the key get a copy too
+	keyInt := new(big.Int)
+	keyInt.SetString(key, keyBase)
+	shortlist = append(shortlist, node.siblingsFor(*keyInt, shortlist)...)
+	if len(shortlist) == 0 {
+		return fmt.Errorf("STORE of key %s found no nodes to store it on", key)
+	}
+
+	// fewer nodes than the quorum can't be helped in a small network
+	required := node.storeQuorum
+	if required > len(shortlist) {
+		required = len(shortlist)
+	}
+
+	// the STOREs outlive ctx once the quorum is reached, so they aren't
+	// sent under it. They are only cancelled if we give up first
+	storeCtx, cancel := context.WithCancel(context.Background())
+	results := make(chan bool, len(shortlist))
 	for _, contact := range shortlist {
 		go func(contact Contact) {
-			args := StoreArgs{node.addr, key, value}
-			var reply StoreReply
-			if !node.doRPC("Store", contact.Addr, args, &reply) {
-				return
-			}
+			results <- node.doStore(storeCtx, key, value, contact.Addr)
 		}(contact)
 	}
+
+	acked, failed := 0, 0
+	for acked < required {
+		if len(shortlist)-failed < required {
+			cancel()
+			return fmt.Errorf("STORE of key %s reached %d of %d nodes, needed %d", key, acked, len(shortlist), required)
+		}
+		select {
+		case ok := <-results:
+			if ok {
+				acked++
+			} else {
+				failed++
+			}
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		}
+	}
+
+	// leave the rest to finish in the background
+	go func() {
+		for i := acked + failed; i < len(shortlist); i++ {
+			<-results
+		}
+		cancel()
+	}()
+	return nil
 }
 
-func (node *Node) doIterativeFindValue(key string) []byte {
+// Iteratively send a FINDVALUE RPC
+// Returns the value and true as soon as any node has it, or nil and false once
+// the lookup converges without finding it. Returns ctx's error if ctx is done
+// before then
+func (node *Node) doIterativeFindValue(ctx context.Context, key string) ([]byte, bool, error) {
 	value, found := node.ht.get(key)
 	if found {
-		return value
+		return value, true, nil
 	}
 
 	//Iterations continue until no contacts returned that are closer or if all contacts in shortlist are active (k contacts have been queried)
 	toFindID := new(big.Int)
 	toFindID.SetString(key, keyBase)
-	contacted := make(map[string]bool)
-	shortlist := make([]Contact, 0, k)
+	contacted := NewContactSet()
+	shortlist := make([]Contact, 0, node.k)
 	
 	// caching purposes
-	cache_contact := NewContact(node.addr);
-	cache_distance := distanceBetween(cache_contact.Id, *toFindID)
+	// the closest node that was asked and didn't have the value, if any
+	var cache_contact *Contact
+	var cache_distance *big.Int
 	mu := &sync.Mutex{}
 
 	// add yourself to contacted
-	contacted[node.addr.String()] = true
+	contacted.Add(*NewContactWithID(node.id, node.addr))
 
-	shortlist = node.rt.findKNearestContacts(*toFindID)
-	node.logger.Printf("Found %d contacts", len(shortlist))
+	shortlist = node.initialShortlist(*toFindID, node.k)
+	node.logger.Debugf("Found %d contacts", len(shortlist))
 
-	contactChan := make(chan []Contact)
-	valueChan := make(chan []byte)
+	// buffered so that RPCs still in flight after the value is found don't block
+	contactChan := make(chan []Contact, node.alpha)
+	valueChan := make(chan []byte, node.alpha)
+	rounds, stallCount := 0, 0
 	// while nearest contacts is not same, keep on iterating
 	for {
-		node.logger.Printf("Starting a new round of FindValues")
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		node.logger.Debugf("Starting a new round of FindValues")
 		found := 0
 		changed := false
-		toSend := make([]Contact, 0, alpha)
+		toSend := make([]Contact, 0, node.alpha)
 
 		// find alpha to contact
 		for i := 0; i < len(shortlist); i++ {
-			toPing := shortlist[i].Addr
-			_, exists := contacted[toPing.String()]
-
-			if exists {
+			if !contacted.Add(shortlist[i]) {
 				continue
 			}
 			toSend = append(toSend, shortlist[i])
 			found++
-			if found == alpha {
+			if found == node.alpha {
 				break
 			}
 		}
@@ -75,16 +156,22 @@ func (node *Node) doIterativeFindValue(key string) []byte {
 			//toPing := toSend[i].Addr
 			go func(toSendContact Contact) {
 				toPing := toSendContact.Addr
-				response := node.doFindValue(key, toPing)
+				response := node.doFindValue(ctx, key, toPing)
 				if response == nil {
-					// Error with performing doFindValue, ignoring for now
-					// TODO: Handle error (?)
-				} else if response.Val != nil {
+					// Error with performing doFindValue, nothing to add
+					contactChan <- nil
+					return
+				} else if response.Found {
 					// in this case, we found the value
-					node.logger.Printf("Got value from node %s at %s", toSendContact.Id.Text(keyBase), toSendContact.Addr.String())
+					node.logger.Debugf("Got value from node %s", toSendContact)
 					if (caching_on) {
-						go node.doCacheDirect(*cache_contact, key, response.Val)
-					}	
+						mu.Lock()
+						cacheOn := cache_contact
+						mu.Unlock()
+						if cacheOn != nil {
+							go node.doCacheDirect(*cacheOn, key, response.Val)
+						}
+					}
 					valueChan <- response.Val
 					return
 				}
@@ -93,45 +180,49 @@ func (node *Node) doIterativeFindValue(key string) []byte {
 				// also save it if we want to cache on it
 				// check if it's closer to the destination
 				mu.Lock()
-				contacted_distance := distanceBetween(toSendContact.Id, *toFindID)
-				if (contacted_distance.Cmp(cache_distance) == -1) {
+				contacted_distance := Distance(toSendContact.Id, *toFindID)
+				if cache_contact == nil || contacted_distance.Cmp(cache_distance) == -1 {
 					cache_contact = &toSendContact
 					cache_distance = contacted_distance
 				}
 				mu.Unlock()
 
 				responseShortlist := response.Contacts
-				contacted[toPing.String()] = true
 
 				// update the shortlist
 				sort.Slice(responseShortlist, func(i, j int) bool {
-					iDist := distanceBetween(*toFindID, responseShortlist[i].Id)
-					jDist := distanceBetween(*toFindID, responseShortlist[j].Id)
+					iDist := Distance(*toFindID, responseShortlist[i].Id)
+					jDist := Distance(*toFindID, responseShortlist[j].Id)
 					return (iDist.Cmp(jDist) == -1)
 				})
-				sliceIndex := k
-				if len(responseShortlist) < k {
+				sliceIndex := node.k
+				if len(responseShortlist) < node.k {
 					sliceIndex = len(responseShortlist)
 				}
 				contactChan <- responseShortlist[:sliceIndex]
 			}(toSend[i])
 		}
 
-		updatedShortlist := make([]Contact, len(shortlist), k)
+		updatedShortlist := make([]Contact, len(shortlist), node.k)
 		copy(updatedShortlist, shortlist)
-		node.logger.Printf("Shortlist length %d", len(updatedShortlist))
+		node.logger.Debugf("Shortlist length %d", len(updatedShortlist))
 		closer := 0
-		node.logger.Printf("Going to read from channel")
+		node.logger.Debugf("Going to read from channel")
 		for i := 0; i < len(toSend); i++ {
 			var s []Contact
 			select {
 			case val := <-valueChan:
-				return val
+				return val, true, nil
 			case s = <-contactChan:
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
 			}
-			newClosestDist := distanceBetween(*toFindID, s[0].Id)
+			if len(s) == 0 {
+				continue
+			}
+			newClosestDist := Distance(*toFindID, s[0].Id)
 			if len(updatedShortlist) > 0 {
-				currClosestDist := distanceBetween(*toFindID, updatedShortlist[0].Id)
+				currClosestDist := Distance(*toFindID, updatedShortlist[0].Id)
 				// if newClosestDist < currClosestDist
 				if newClosestDist.Cmp(currClosestDist) == -1 {
 					closer++
@@ -140,59 +231,60 @@ func (node *Node) doIterativeFindValue(key string) []byte {
 
 			updatedShortlist = append(updatedShortlist, s...)
 			updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
-			node.logger.Printf("Update: list length: %d\n", len(updatedShortlist))
+			node.logger.Debugf("Update: list length: %d", len(updatedShortlist))
 			// update the shortlist
 			sort.Slice(updatedShortlist, func(i, j int) bool {
-				iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-				jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+				iDist := Distance(*toFindID, updatedShortlist[i].Id)
+				jDist := Distance(*toFindID, updatedShortlist[j].Id)
 				return (iDist.Cmp(jDist) == -1)
 			})
-			sliceIndex := k
-			if len(updatedShortlist) < k {
+			sliceIndex := node.k
+			if len(updatedShortlist) < node.k {
 				sliceIndex = len(updatedShortlist)
 			}
 			updatedShortlist = updatedShortlist[:sliceIndex]
 		}
 
-		node.logger.Printf("Finished reading from channel")
+		node.logger.Debugf("Finished reading from channel")
 
 		// if we didn't find anything closer in last round, ping the rest of the
-		// shortlist that are unseen
+		// shortlist that are unseen, including the ones learned this round
 		if closer == 0 {
-			sendingTo := make([]Contact, 0, k)
-			for i := 0; i < len(shortlist); i++ {
-				toPing := shortlist[i].Addr
-				_, exists := contacted[toPing.String()]
-
-				if !exists {
-					sendingTo = append(sendingTo, shortlist[i])
+			sendingTo := make([]Contact, 0, node.k)
+			for i := 0; i < len(updatedShortlist); i++ {
+				if contacted.Add(updatedShortlist[i]) {
+					sendingTo = append(sendingTo, updatedShortlist[i])
 				}
 			}
-			value, responseShortlist := node.findValueToK(toFindID, sendingTo, cache_contact, cache_distance)
-			if value != nil {
-				return value
+			value, found, responseShortlist, err := node.findValueToK(ctx, toFindID, sendingTo, cache_contact, cache_distance)
+			if err != nil {
+				return nil, false, err
+			}
+			if found {
+				return value, true, nil
 			}
 			updatedShortlist = append(updatedShortlist, responseShortlist...)
 			updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
 			// update the shortlist
 			sort.Slice(updatedShortlist, func(i, j int) bool {
-				iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-				jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+				iDist := Distance(*toFindID, updatedShortlist[i].Id)
+				jDist := Distance(*toFindID, updatedShortlist[j].Id)
 				return (iDist.Cmp(jDist) == -1)
 			})
-			sliceIndex := k
-			if len(updatedShortlist) < k {
+			sliceIndex := node.k
+			if len(updatedShortlist) < node.k {
 				sliceIndex = len(updatedShortlist)
 			}
 			updatedShortlist = updatedShortlist[:sliceIndex]
 		}
 
-		node.logger.Printf("Checking if shortlist has changed")
+		node.logger.Debugf("Checking if shortlist has changed")
 		// check if the shortlist has changed at all
 		// if not, we should terminate
 		// comparing shortlist and updatedShortlist
-		node.logger.Printf("New shortlist has length %d", len(updatedShortlist))
-		changed = false
+		node.logger.Debugf("New shortlist has length %d", len(updatedShortlist))
+		// a shortlist that grew has changed even if its old entries haven't
+		changed = len(updatedShortlist) != len(shortlist)
 		loopIndex := len(updatedShortlist)
 		if len(shortlist) < loopIndex {
 			loopIndex = len(shortlist)
@@ -202,9 +294,17 @@ func (node *Node) doIterativeFindValue(key string) []byte {
 				changed = true
 			}
 		}
-		node.logger.Println("Shortlist changed this round", changed)
-		if !changed {
-			return nil
+		node.logger.Debugf("Shortlist changed this round: %t", changed)
+		rounds++
+		if stalled(shortlist, updatedShortlist) {
+			stallCount++
+		} else {
+			stallCount = 0
+		}
+		if !changed || node.lookup.finished(rounds, stallCount) {
+			node.logger.Debugf("Lookup finished after %d rounds, %d without getting closer", rounds, stallCount)
+			node.rememberShortlist(*toFindID, updatedShortlist)
+			return nil, false, nil
 		}
 
 		shortlist = updatedShortlist
@@ -212,39 +312,46 @@ func (node *Node) doIterativeFindValue(key string) []byte {
 }
 
 // Iteratively send a FINDNODE RPC
-// Returns a shortlist of k closest nodes
-func (node *Node) doIterativeFindNode(key string) []Contact {
+// Returns a shortlist of k closest nodes, or ctx's error if ctx is done first
+func (node *Node) doIterativeFindNode(ctx context.Context, key string) ([]Contact, error) {
+	return node.doIterativeFindN(ctx, key, node.k)
+}
+
+// doIterativeFindN is doIterativeFindNode for the n closest nodes instead of
+// the k closest
+func (node *Node) doIterativeFindN(ctx context.Context, key string, n int) ([]Contact, error) {
 	//Iterations continue until no contacts returned that are closer or if all contacts in shortlist are active (k contacts have been queried)
 	toFindID := new(big.Int)
 	toFindID.SetString(key, keyBase)
-	contacted := make(map[string]bool)
-	shortlist := make([]Contact, 0, k)
+	contacted := NewContactSet()
+	shortlist := make([]Contact, 0, n)
 
 	// add yourself to contacted
-	contacted[node.addr.String()] = true
+	contacted.Add(*NewContactWithID(node.id, node.addr))
 
-	shortlist = node.rt.findKNearestContacts(*toFindID)
-	node.logger.Printf("Found %d contacts", len(shortlist))
+	shortlist = node.initialShortlist(*toFindID, n)
+	node.logger.Debugf("Found %d contacts", len(shortlist))
 
-	contactChan := make(chan []Contact)
+	contactChan := make(chan []Contact, node.alpha)
+	rounds, stallCount := 0, 0
 	// while nearest contacts is not same, keep on iterating
 	for {
-		node.logger.Printf("Starting a new round of FindNodes")
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		node.logger.Debugf("Starting a new round of FindNodes")
 		found := 0
 		changed := false
-		toSend := make([]Contact, 0, alpha)
+		toSend := make([]Contact, 0, node.alpha)
 
 		// find alpha to contact
 		for i := 0; i < len(shortlist); i++ {
-			toPing := shortlist[i].Addr
-			_, exists := contacted[toPing.String()]
-
-			if exists {
+			if !contacted.Add(shortlist[i]) {
 				continue
 			}
 			toSend = append(toSend, shortlist[i])
 			found++
-			if found == alpha {
+			if found == node.alpha {
 				break
 			}
 		}
@@ -253,33 +360,41 @@ func (node *Node) doIterativeFindNode(key string) []Contact {
 		for i := 0; i < len(toSend); i++ {
 			toPing := toSend[i].Addr
 			go func() {
-				responseShortlist := node.doFindNode(key, toPing)
-				contacted[toPing.String()] = true
+				responseShortlist := node.doFindNode(ctx, key, toPing)
 
 				// update the shortlist
 				sort.Slice(responseShortlist, func(i, j int) bool {
-					iDist := distanceBetween(*toFindID, responseShortlist[i].Id)
-					jDist := distanceBetween(*toFindID, responseShortlist[j].Id)
+					iDist := Distance(*toFindID, responseShortlist[i].Id)
+					jDist := Distance(*toFindID, responseShortlist[j].Id)
 					return (iDist.Cmp(jDist) == -1)
 				})
-				sliceIndex := k
-				if len(responseShortlist) < k {
+				sliceIndex := n
+				if len(responseShortlist) < n {
 					sliceIndex = len(responseShortlist)
 				}
 				contactChan <- responseShortlist[:sliceIndex]
 			}()
 		}
 
-		updatedShortlist := make([]Contact, len(shortlist), k)
+		updatedShortlist := make([]Contact, len(shortlist), n)
 		copy(updatedShortlist, shortlist)
-		node.logger.Printf("Shortlist length %d", len(updatedShortlist))
+		node.logger.Debugf("Shortlist length %d", len(updatedShortlist))
 		closer := 0
-		node.logger.Printf("Going to read from channel")
+		node.logger.Debugf("Going to read from channel")
 		for i := 0; i < len(toSend); i++ {
-			s := <-contactChan
-			newClosestDist := distanceBetween(*toFindID, s[0].Id)
+			var s []Contact
+			select {
+			case s = <-contactChan:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			// failed RPCs and nodes with empty tables have nothing to add
+			if len(s) == 0 {
+				continue
+			}
+			newClosestDist := Distance(*toFindID, s[0].Id)
 			if len(updatedShortlist) > 0 {
-				currClosestDist := distanceBetween(*toFindID, updatedShortlist[0].Id)
+				currClosestDist := Distance(*toFindID, updatedShortlist[0].Id)
 				// if newClosestDist < currClosestDist
 				if newClosestDist.Cmp(currClosestDist) == -1 {
 					closer++
@@ -290,55 +405,56 @@ func (node *Node) doIterativeFindNode(key string) []Contact {
 			updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
 			// update the shortlist
 			sort.Slice(updatedShortlist, func(i, j int) bool {
-				iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-				jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+				iDist := Distance(*toFindID, updatedShortlist[i].Id)
+				jDist := Distance(*toFindID, updatedShortlist[j].Id)
 				return (iDist.Cmp(jDist) == -1)
 			})
 
-			sliceIndex := k
-			if len(updatedShortlist) < k {
+			sliceIndex := n
+			if len(updatedShortlist) < n {
 				sliceIndex = len(updatedShortlist)
 			}
 			updatedShortlist = updatedShortlist[:sliceIndex]
 
 		}
 
-		node.logger.Printf("Finished reading from channel")
+		node.logger.Debugf("Finished reading from channel")
 
 		// if we didn't find anything closer in last round, ping the rest of the
-		// shortlist that are unseen
+		// shortlist that are unseen, including the ones learned this round
 		if closer == 0 {
-			sendingTo := make([]Contact, 0, k)
-			for i := 0; i < len(shortlist); i++ {
-				toPing := shortlist[i].Addr
-				_, exists := contacted[toPing.String()]
-
-				if !exists {
-					sendingTo = append(sendingTo, shortlist[i])
+			sendingTo := make([]Contact, 0, n)
+			for i := 0; i < len(updatedShortlist); i++ {
+				if contacted.Add(updatedShortlist[i]) {
+					sendingTo = append(sendingTo, updatedShortlist[i])
 				}
 			}
-			responseShortlist := node.findNodeToK(toFindID, sendingTo)
+			responseShortlist, err := node.findNodeToN(ctx, toFindID, sendingTo, n)
+			if err != nil {
+				return nil, err
+			}
 			updatedShortlist = append(updatedShortlist, responseShortlist...)
 			updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
 			// update the shortlist
 			sort.Slice(updatedShortlist, func(i, j int) bool {
-				iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-				jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+				iDist := Distance(*toFindID, updatedShortlist[i].Id)
+				jDist := Distance(*toFindID, updatedShortlist[j].Id)
 				return (iDist.Cmp(jDist) == -1)
 			})
-			sliceIndex := k
-			if len(updatedShortlist) < k {
+			sliceIndex := n
+			if len(updatedShortlist) < n {
 				sliceIndex = len(updatedShortlist)
 			}
 			updatedShortlist = updatedShortlist[:sliceIndex]
 		}
 
-		node.logger.Printf("Checking if shortlist has changed")
+		node.logger.Debugf("Checking if shortlist has changed")
 		// check if the shortlist has changed at all
 		// if not, we should terminate
 		// comparing shortlist and updatedShortlist
-		node.logger.Printf("New shortlist has length %d", len(updatedShortlist))
-		changed = false
+		node.logger.Debugf("New shortlist has length %d", len(updatedShortlist))
+		// a shortlist that grew has changed even if its old entries haven't
+		changed = len(updatedShortlist) != len(shortlist)
 		loopIndex := len(updatedShortlist)
 		if len(shortlist) < loopIndex {
 			loopIndex = len(shortlist)
@@ -348,9 +464,17 @@ func (node *Node) doIterativeFindNode(key string) []Contact {
 				changed = true
 			}
 		}
-		node.logger.Println("Shortlist changed this round", changed)
-		if !changed {
-			return updatedShortlist
+		node.logger.Debugf("Shortlist changed this round: %t", changed)
+		rounds++
+		if stalled(shortlist, updatedShortlist) {
+			stallCount++
+		} else {
+			stallCount = 0
+		}
+		if !changed || node.lookup.finished(rounds, stallCount) {
+			node.logger.Debugf("Lookup finished after %d rounds, %d without getting closer", rounds, stallCount)
+			node.rememberShortlist(*toFindID, updatedShortlist)
+			return updatedShortlist, nil
 		}
 
 		shortlist = updatedShortlist
@@ -360,13 +484,18 @@ func (node *Node) doIterativeFindNode(key string) []Contact {
 	//return shortlist
 }
 
-func (node *Node) findNodeToK(toFindID *big.Int, toSend []Contact) []Contact {
-	contactChan := make(chan []Contact)
+// findNodeToN sends a FINDNODE RPC to every contact in toSend, with at most
+// alpha in flight at once, and returns the n closest contacts they know of
+func (node *Node) findNodeToN(ctx context.Context, toFindID *big.Int, toSend []Contact, n int) ([]Contact, error) {
+	contactChan := make(chan []Contact, len(toSend))
+	inFlight := make(chan struct{}, node.alpha)
 
 	for i := 0; i < len(toSend); i++ {
 		toPing := toSend[i].Addr
 		go func() {
-			responseShortlist := node.doFindNode(toFindID.Text(keyBase), toPing)
+			inFlight <- struct{}{}
+			responseShortlist := node.doFindNode(ctx, toFindID.Text(keyBase), toPing)
+			<-inFlight
 
 			contactChan <- responseShortlist
 		}()
@@ -375,49 +504,66 @@ func (node *Node) findNodeToK(toFindID *big.Int, toSend []Contact) []Contact {
 	// Wait for all rpcs to return
 	updatedShortlist := make([]Contact, 0)
 	for i := 0; i < len(toSend); i++ {
-		s := <-contactChan
+		var s []Contact
+		select {
+		case s = <-contactChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 		updatedShortlist = append(updatedShortlist, s...)
 		updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
 		// update the shortlist
 		sort.Slice(updatedShortlist, func(i, j int) bool {
-			iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-			jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+			iDist := Distance(*toFindID, updatedShortlist[i].Id)
+			jDist := Distance(*toFindID, updatedShortlist[j].Id)
 			return (iDist.Cmp(jDist) == -1)
 		})
-		sliceIndex := k
-		if len(updatedShortlist) < k {
+		sliceIndex := n
+		if len(updatedShortlist) < n {
 			sliceIndex = len(updatedShortlist)
 		}
 		updatedShortlist = updatedShortlist[:sliceIndex]
 	}
 
-	return updatedShortlist
+	return updatedShortlist, nil
 }
 
-func (node *Node) findValueToK(toFindID *big.Int, toSend []Contact, cache_contact *Contact, cache_distance *big.Int) ([]byte, []Contact) {
+// findValueToK sends a FINDVALUE RPC to every contact in toSend, with at most
+// alpha in flight at once. It returns the value as soon as one of them has it,
+// otherwise the k closest contacts they know of
+func (node *Node) findValueToK(ctx context.Context, toFindID *big.Int, toSend []Contact, cache_contact *Contact, cache_distance *big.Int) ([]byte, bool, []Contact, error) {
 	mu := &sync.Mutex{}
-	contactChan := make(chan []Contact)
-	valueChan := make(chan []byte)
+	contactChan := make(chan []Contact, len(toSend))
+	valueChan := make(chan []byte, len(toSend))
+	inFlight := make(chan struct{}, node.alpha)
 
 	for i := 0; i < len(toSend); i++ {
 		//toPing := toSend[i].Addr
 		go func(toSendContact Contact) {
 			toPing := toSendContact.Addr
-			response := node.doFindValue(toFindID.Text(keyBase), toPing)
+			inFlight <- struct{}{}
+			response := node.doFindValue(ctx, toFindID.Text(keyBase), toPing)
+			<-inFlight
 			if response == nil {
-				// Error with performing doFindValue, ignoring for now
-				// TODO: Handle error (?)
-			} else if response.Val != nil {
-				node.logger.Printf("Got value from node %s at %s", toSendContact.Id.Text(keyBase), toSendContact.Addr.String())
+				// Error with performing doFindValue, nothing to add
+				contactChan <- nil
+				return
+			} else if response.Found {
+				node.logger.Debugf("Got value from node %s", toSendContact)
 				if (caching_on) {
-					go node.doCacheDirect(*cache_contact, toFindID.Text(keyBase), response.Val)
+					mu.Lock()
+					cacheOn := cache_contact
+					mu.Unlock()
+					if cacheOn != nil {
+						go node.doCacheDirect(*cacheOn, toFindID.Text(keyBase), response.Val)
+					}
 				}
 				valueChan <- response.Val
 				return
 			}
 			mu.Lock()
-			contacted_distance := distanceBetween(toSendContact.Id, *toFindID)
-			if (contacted_distance.Cmp(cache_distance) == -1) {
+			contacted_distance := Distance(toSendContact.Id, *toFindID)
+			if cache_contact == nil || contacted_distance.Cmp(cache_distance) == -1 {
 				cache_contact = &toSendContact
 				cache_distance = contacted_distance
 			}
@@ -434,32 +580,39 @@ func (node *Node) findValueToK(toFindID *big.Int, toSend []Contact, cache_contac
 		var s []Contact
 		select {
 		case val := <-valueChan:
-			return val, nil
+			return val, true, nil, nil
 		case s = <-contactChan:
+		case <-ctx.Done():
+			return nil, false, nil, ctx.Err()
 		}
 		updatedShortlist = append(updatedShortlist, s...)
 		updatedShortlist = RemoveDupesFromShortlist(updatedShortlist)
 		// update the shortlist
 		sort.Slice(updatedShortlist, func(i, j int) bool {
-			iDist := distanceBetween(*toFindID, updatedShortlist[i].Id)
-			jDist := distanceBetween(*toFindID, updatedShortlist[j].Id)
+			iDist := Distance(*toFindID, updatedShortlist[i].Id)
+			jDist := Distance(*toFindID, updatedShortlist[j].Id)
 			return (iDist.Cmp(jDist) == -1)
 		})
-		sliceIndex := k
-		if len(updatedShortlist) < k {
+		sliceIndex := node.k
+		if len(updatedShortlist) < node.k {
 			sliceIndex = len(updatedShortlist)
 		}
 		updatedShortlist = updatedShortlist[:sliceIndex]
 	}
 
-	return nil, updatedShortlist
+	return nil, false, updatedShortlist, nil
 }
 
+// doCacheDirect stores a value found by a lookup on contact, the closest node
+// that was asked for it and didn't have it. The copy is only kept for tCache
+// and isn't republished
+// It runs in the background after a lookup has returned, so it isn't bound by
+// the lookup's context
 func (node *Node) doCacheDirect(contact Contact, key string, value []byte) {
-	node.logger.Printf("Caching on node %s", contact.Addr.String())
-	args := StoreArgs{node.addr, key, value}
+	node.logger.Debugf("Caching on node %s", contact)
+	count(&node.stats.StoresSent)
+	args := StoreArgs{Source: node.addr, Key: key, Val: value, TTL: tCache}
+	args.Auth = node.sign("Store", args)
 	var reply StoreReply
-	if !node.doRPC("Store", contact.Addr, args, &reply) {
-		return
-	}
+	node.doRPC(context.Background(), "Store", contact.Addr, args, &reply)
 }
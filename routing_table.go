@@ -1,36 +1,101 @@
 package kademlia
 
 import (
+	"container/heap"
+	"context"
 	"container/list"
-	"crypto/sha1"
-	//"fmt"
+	"fmt"
 	"math/big"
 	"net"
 	"sort"
 	"sync"
+	"time"
 )
 
 // Contact is an entry in the k-bucket
 type Contact struct {
 	Id   big.Int
 	Addr net.TCPAddr
+	// lastSeen is when we last received a message from the contact. It is
+	// zero for contacts we only heard about from other nodes. It isn't sent
+	// over the wire and isn't compared by AreEqualContacts
+	lastSeen time.Time
+	// rtt is the round-trip time of our last PING to the contact, or zero if
+	// we haven't pinged it. Like lastSeen it stays local
+	rtt time.Duration
+	// version is the protocol version the contact advertised in its last
+	// PING or PING reply, or zero if we haven't exchanged one
+	version int
 }
 
-// NewContact creates a new Contact struct based on addr by taking the hash
+// NewContact creates a new Contact struct based on addr by taking its SHA-1 hash
+// This is the ID a node gives addr unless it was created WithHash or
+// WithSigningKey
 func NewContact(addr net.TCPAddr) *Contact {
-	hash := sha1.Sum([]byte(addr.String()))
+	return NewContactWithID(hashAddr(addr, SHA1), addr)
+}
 
-	id := *big.NewInt(0)
-	id.SetBytes(hash[:])
+// NewContactChecked is NewContact for addresses that may be misconfigured. It
+// returns an error instead of a contact with a meaningless ID if addr has no
+// usable IP or its port isn't between 1 and 65535
+func NewContactChecked(addr net.TCPAddr) (*Contact, error) {
+	if len(addr.IP) != net.IPv4len && len(addr.IP) != net.IPv6len {
+		return nil, fmt.Errorf("Contact address %s has no valid IP", addr.String())
+	}
+	if addr.IP.IsUnspecified() {
+		return nil, fmt.Errorf("Contact address %s has an unspecified IP", addr.String())
+	}
+	if addr.Port < 1 || addr.Port > 65535 {
+		return nil, fmt.Errorf("Contact address %s has invalid port %d", addr.String(), addr.Port)
+	}
+	return NewContact(addr), nil
+}
 
-	nodeEntry := Contact{id, addr}
+// NewContactWithID creates a new Contact struct for addr that uses id instead of
+// the hash of addr
+func NewContactWithID(id big.Int, addr net.TCPAddr) *Contact {
+	nodeEntry := Contact{Id: id, Addr: addr}
 	return &nodeEntry
 }
 
+// String returns the first few hex digits of the contact's ID and its
+// address, which is enough to tell contacts apart in logs
+func (contact Contact) String() string {
+	id := IDToHex(contact.Id)
+	if len(id) > contactIDPrefix {
+		id = id[:contactIDPrefix]
+	}
+	return fmt.Sprintf("%s@%s", id, contact.Addr.String())
+}
+
 // AreEqualContacts returns true if contact Id and Addr are equivalent
 // structs can be compared, but structs containing big.Int cannot
 func AreEqualContacts(a *Contact, b *Contact) bool {
-	return (a.Id.Cmp(&b.Id) == 0)
+	return (a.Id.Cmp(&b.Id) == 0) && AreEqualAddrs(a.Addr, b.Addr)
+}
+
+// Distance returns the XOR distance between two IDs
+func Distance(a big.Int, b big.Int) *big.Int {
+	return big.NewInt(0).Xor(&a, &b)
+}
+
+// CommonPrefixLen returns the number of leading bits that a and b share, from 0
+// for IDs that differ in the top bit up to 160 for equal IDs. It assumes the
+// default 160-bit ID space; Node.CommonPrefixLen works in the node's
+func CommonPrefixLen(a big.Int, b big.Int) int {
+	return commonPrefixLen(a, b, idBits)
+}
+
+// CommonPrefixLen is like the package's CommonPrefixLen, but in the node's ID
+// space, so it goes up to 256 for a node created WithIDBits(256)
+func (node *Node) CommonPrefixLen(a big.Int, b big.Int) int {
+	return commonPrefixLen(a, b, node.idBits)
+}
+
+// commonPrefixLen returns the number of leading bits that a and b share as
+// IDs of bits bits
+func commonPrefixLen(a big.Int, b big.Int, bits int) int {
+	return bits - Distance(a, b).BitLen()
 }
 
 // extra struct because we will want to implement split bucket
@@ -38,203 +103,1014 @@ type RoutingTable struct {
 	owner        *Node
 	kBuckets     []*KBucket
 	numNeighbors int
+	// lowest is the index of the bucket whose range includes our own ID. It
+	// holds every contact whose distance index is <= lowest, and all the
+	// buckets below it stay unallocated until it is split
+	lowest int
+	// failures counts the RPCs in a row that each contact in the table has
+	// failed, keyed by ID
+	failures map[string]int
+	// conflicts holds the IDs, claimed from a second address, whose current
+	// contact is being pinged by resolveConflict
+	conflicts map[string]bool
+	// mu guards kBuckets, numNeighbors, lowest, failures and conflicts. It
+	// must not be held while waiting on the network
+	mu *sync.Mutex
+	// listener is told about structural changes, or is nil. events holds the
+	// changes not yet delivered to it, guarded by eventsMu
+	listener TableListener
+	events   []TableEvent
+	eventsMu *sync.Mutex
 }
 
+// NewRoutingTable returns an empty table for owner with one bucket per bit of
+// the owner's ID space
 func NewRoutingTable(owner *Node) *RoutingTable {
-	kBuckets := make([]*KBucket, 160)
+	kBuckets := make([]*KBucket, owner.idBits)
 	numNeighbors := 0
-	rt := RoutingTable{owner, kBuckets, numNeighbors}
+	mu := &sync.Mutex{}
+	failures := make(map[string]int)
+	rt := RoutingTable{owner, kBuckets, numNeighbors, len(kBuckets) - 1, failures, make(map[string]bool), mu, owner.tableListener, nil, &sync.Mutex{}}
 	return &rt
 }
 
+// indexFromID returns the index of the bucket that currently holds id. Ids
+// that would fall below the lowest bucket are held by the lowest bucket
+// Bucket i holds contacts at distance [2^i, 2^(i+1)), so every bucket is
+// usable. Our own ID (index -1) folds into the lowest bucket, but add never
+// stores it
+// The caller must hold the table's lock
+func (self *RoutingTable) indexFromID(id *big.Int) int {
+	index := self.owner.GetKBucketFromID(id)
+	if index < self.lowest {
+		index = self.lowest
+	}
+	return index
+}
+
+// newBucket returns an empty bucket at index configured from the owner
+func (self *RoutingTable) newBucket(index int) *KBucket {
+	bucket := NewKBucket(self.owner.k, self.owner.clock)
+	bucket.policy = self.owner.eviction
+	bucket.bucketPolicy = self.owner.bucketPolicy
+	bucket.ownerID = self.owner.id
+	bucket.logger = self.owner.logger
+	if self.listener != nil {
+		bucket.notify = func(kind TableEventKind, contact Contact) {
+			self.emit(TableEvent{kind, index, contact})
+		}
+	}
+	return bucket
+}
+
 // section 2.4 Kademlia protocol splits bucket when full and range includes own ID
-// TODO
-func (self *RoutingTable) splitBucket() {
+// Only the lowest bucket includes our own ID. Splitting it leaves the contacts
+// whose distance index equals index in place and moves the closer ones into a
+// new lowest bucket. Returns false if the bucket can't be split
+// The caller must hold the table's lock
+func (self *RoutingTable) splitBucket(index int) bool {
+	if index != self.lowest || index == 0 {
+		return false
+	}
+
+	old := self.kBuckets[index]
+	child := self.newBucket(index - 1)
+	self.owner.logger.Infof("Splitting bucket %d", index)
+	count(&self.owner.stats.BucketSplits)
+	self.emit(TableEvent{Kind: BucketSplit, Bucket: index})
 
+	old.mu.Lock()
+	self.moveBelow(old, old.contacts, child.contacts, index)
+	// cached contacts follow, or removeContact would later promote them into
+	// a bucket they don't belong in
+	self.moveBelow(old, old.lruCache, child.lruCache, index)
+	old.mu.Unlock()
+
+	self.lowest = index - 1
+	self.kBuckets[self.lowest] = child
+	return true
+}
+
+// moveBelow moves the contacts in from, one of bucket's lists, that belong in
+// a bucket below index to the back of to, keeping their order. The caller
+// must hold bucket's lock
+func (self *RoutingTable) moveBelow(bucket *KBucket, from *list.List, to *list.List, index int) {
+	for e := from.Front(); e != nil; {
+		next := e.Next()
+		if curr, ok := bucket.contactAt(e); ok && self.owner.GetKBucketFromID(&curr.Id) < index {
+			to.PushBack(from.Remove(e))
+		}
+		e = next
+	}
 }
 
+// findKNearestContacts returns the k contacts closest to id, or every contact
+// if the table holds fewer than k
 func (self *RoutingTable) findKNearestContacts(id big.Int) []Contact {
-	// If the entire RT has less than k contacts, then just return all the contacts
+	return self.findNClosest(id, self.owner.k)
+}
+
+// findNClosest returns the n contacts closest to id in order of distance, or
+// every contact if the table holds fewer than n
+func (self *RoutingTable) findNClosest(id big.Int, n int) []Contact {
+	return self.findNClosestExcluding(id, n, nil)
+}
 
-	kNearest := make([]Contact, 0, k)
-	// To find the k closest contacts, we start looking from the bucket that the contact would be in
-	index := self.owner.GetKBucketFromID(&id)
-	if index < 0 {
-		index = 0
+// findKNearestExcluding returns the k contacts closest to target that aren't
+// in exclude, such as nodes a lookup has already queried or found to be down
+func (self *RoutingTable) findKNearestExcluding(target big.Int, exclude ContactSet) []Contact {
+	return self.findNClosestExcluding(target, self.owner.k, exclude)
+}
+
+// findNClosestExcluding returns the n contacts closest to id that aren't in
+// exclude, in order of distance. exclude may be nil
+func (self *RoutingTable) findNClosestExcluding(id big.Int, n int, exclude ContactSet) []Contact {
+	if n <= 0 {
+		return []Contact{}
 	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// If the entire RT has less than n contacts, then just return all the contacts
+
+	nearest := make([]Contact, 0, n)
+	// To find the n closest contacts, we start looking from the bucket that the contact would be in
+	index := self.indexFromID(&id)
 
 	// for all of these, need to check that the kbucket exists
 	if self.kBuckets[index] != nil {
-		kNearest = append(kNearest, self.kBuckets[index].getAllContacts()...)
+		self.kBuckets[index].touch()
+		nearest = appendUnexcluded(nearest, self.kBuckets[index].getAllContacts(), exclude)
 	}
 
-	// If less than k contacts are in the bucket, then take the closest from the left
-	if len(kNearest) < k {
-		// 0th bucket never populated <--- this is wrong, 1 is between 2^0 and 2^1
+	// If less than n contacts are in the bucket, then take the closest from the left
+	if len(nearest) < n {
+		// bucket 0 holds the contact at distance 1, so it is scanned too
 		for curr := index - 1; curr >= 0; curr-- {
 			currBucket := self.kBuckets[curr]
 			if currBucket != nil {
-				kNearest = append(kNearest, currBucket.getAllContacts()...)
+				nearest = appendUnexcluded(nearest, currBucket.getAllContacts(), exclude)
 			}
-			if len(kNearest) >= k {
+			if len(nearest) >= n {
 				break
 			}
 		}
 	}
 
 	// Then go to the right
-	if len(kNearest) < k {
-		for curr := index + 1; curr < 160; curr++ {
+	if len(nearest) < n {
+		for curr := index + 1; curr < len(self.kBuckets); curr++ {
 			currBucket := self.kBuckets[curr]
 			if currBucket != nil {
-				kNearest = append(kNearest, currBucket.getAllContacts()...)
+				nearest = appendUnexcluded(nearest, currBucket.getAllContacts(), exclude)
 			}
-			if len(kNearest) >= k {
+			if len(nearest) >= n {
 				break
 			}
 		}
 	}
 
+	// a contact should only ever be in one bucket, but make sure it isn't
+	// returned twice if it ends up in two
+	nearest = removeDupesByID(nearest)
+
 	// Return in order of distance to contact
-	sort.Slice(kNearest, func(i, j int) bool {
-		aDist := distanceBetween(id, kNearest[i].Id)
-		bDist := distanceBetween(id, kNearest[j].Id)
+	sort.Slice(nearest, func(i, j int) bool {
+		aDist := Distance(id, nearest[i].Id)
+		bDist := Distance(id, nearest[j].Id)
 		return (aDist.Cmp(bDist) == -1)
 	})
 
-	slice_index := k
-	if len(kNearest) < k {
-		slice_index = len(kNearest)
+	slice_index := n
+	if len(nearest) < n {
+		slice_index = len(nearest)
+	}
+	nearest = nearest[:slice_index]
+
+	self.owner.logger.Debugf("Found %d neighbors", len(nearest))
+	return nearest
+}
+
+// appendUnexcluded appends the contacts that aren't in exclude to nearest
+func appendUnexcluded(nearest []Contact, contacts []Contact, exclude ContactSet) []Contact {
+	for _, contact := range contacts {
+		if !exclude.Contains(contact) {
+			nearest = append(nearest, contact)
+		}
+	}
+	return nearest
+}
+
+// IterateClosest returns an iterator over every contact in the table in order
+// of increasing distance from target. Each call returns the next contact, or
+// false once there are none left. The iterator works on a snapshot of the
+// table taken when IterateClosest is called, and contacts are only ordered as
+// they are asked for
+func (self *RoutingTable) IterateClosest(target big.Int) func() (*Contact, bool) {
+	contacts := self.allContacts()
+	h := make(distanceHeap, 0, len(contacts))
+	for _, contact := range contacts {
+		h = append(h, distanceEntry{contact, Distance(target, contact.Id)})
+	}
+	heap.Init(&h)
+
+	return func() (*Contact, bool) {
+		if h.Len() == 0 {
+			return nil, false
+		}
+		entry := heap.Pop(&h).(distanceEntry)
+		return &entry.contact, true
+	}
+}
+
+// SnapshotClosest returns a channel of the n contacts closest to target, in
+// order of increasing distance, which is closed after the last one. They are
+// found under a single hold of the table's lock, and the channel is buffered
+// to hold all of them, so a slow consumer never holds up the table and one
+// that stops reading early leaks nothing
+func (self *RoutingTable) SnapshotClosest(target big.Int, n int) <-chan Contact {
+	closest := self.findNClosest(target, n)
+	contacts := make(chan Contact, len(closest))
+	for _, contact := range closest {
+		contacts <- contact
+	}
+	close(contacts)
+	return contacts
+}
+
+// distanceEntry is a contact and its distance to the target of a
+// distanceHeap
+type distanceEntry struct {
+	contact  Contact
+	distance *big.Int
+}
+
+// distanceHeap is a min-heap of contacts ordered by their distance to a target
+type distanceHeap []distanceEntry
+
+func (h distanceHeap) Len() int {
+	return len(h)
+}
+
+func (h distanceHeap) Less(i, j int) bool {
+	return h[i].distance.Cmp(h[j].distance) == -1
+}
+
+func (h distanceHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *distanceHeap) Push(x interface{}) {
+	*h = append(*h, x.(distanceEntry))
+}
+
+func (h *distanceHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// add stores contact in the bucket it belongs to, splitting or evicting as
+// needed, and reports whether it was added, replaced another contact, was
+// updated, cached or dropped
+func (self *RoutingTable) add(contact Contact) addResult {
+	defer self.deliverEvents()
+	// Don't add yourself to the routing table under any circumstances. Only
+	// the ID is compared, since peers may echo us back under another address
+	self.owner.logger.Debugf("My node ID: %s, other ID: %s", IDToHex(self.owner.id), IDToHex(contact.Id))
+	if contact.Id.Cmp(&self.owner.id) == 0 {
+		return contactDropped
+	}
+	if self.owner.banned.contains(contact.Id) {
+		self.owner.logger.Debugf("Not adding blacklisted %s", contact)
+		return contactDropped
+	}
+	if existing := self.ContactFromID(contact.Id); existing != nil && !AreEqualAddrs(existing.Addr, contact.Addr) {
+		self.resolveConflict(*existing, contact)
+		return contactDropped
+	}
+
+	// a contact we only heard about from another node has no lastSeen time
+	// With pingOnInsert it must answer a PING before it is stored, so that
+	// spoofed FINDNODE replies can't fill the table
+	if self.owner.pingOnInsert && contact.lastSeen.IsZero() && self.ContactFromID(contact.Id) == nil {
+		if !self.ping(contact) {
+			self.owner.logger.Debugf("Not adding %s, it didn't answer a PING", contact)
+			return contactDropped
+		}
+		contact.lastSeen = self.owner.clock.Now()
+	}
+
+	self.mu.Lock()
+	result, index := self.insert(contact)
+	if result != contactDropped {
+		self.mu.Unlock()
+		return result
 	}
-	kNearest = kNearest[:slice_index]
 
-	self.owner.logger.Printf("Found %d neighbors", len(kNearest))
-	return kNearest
+	// the bucket can't split, so try to evict an unresponsive contact. The
+	// table is unlocked while the PING is in flight
+	bucket := self.kBuckets[index]
+	self.mu.Unlock()
+	result = bucket.addContact(contact, self.ping)
+	switch result {
+	case contactReplaced:
+		count(&self.owner.stats.Evictions)
+	case contactAdded:
+		self.mu.Lock()
+		self.numNeighbors++
+		self.evictOverCap(contact)
+		self.mu.Unlock()
+	}
+	return result
 }
 
-func (self *RoutingTable) add(contact Contact) {
-	// Don't add yourself to the routing table under any circumstances
-	self_contact := Contact{self.owner.id, self.owner.addr}
-	self.owner.logger.Printf("My node ID: %s, other ID: %s", self.owner.id.Text(keyBase), contact.Id.Text(keyBase))
-	if AreEqualContacts(&self_contact, &contact) {
+// resolveConflict decides in the background between existing and contact,
+// which claim the same ID from different addresses, e.g. two peers behind
+// one NAT or a spoofed ID. contact has been dropped in the meantime. The one
+// that answers a PING wins, and existing wins if both do, so a live contact
+// can't be overwritten. If existing doesn't answer, it is replaced by
+// contact. Only one conflict per ID is checked at a time, so a reply full of
+// conflicting contacts costs at most one PING for each
+func (self *RoutingTable) resolveConflict(existing Contact, contact Contact) {
+	count(&self.owner.stats.IDConflicts)
+	key := existing.Id.Text(keyBase)
+	self.mu.Lock()
+	if self.conflicts[key] {
+		self.mu.Unlock()
 		return
 	}
+	self.conflicts[key] = true
+	self.mu.Unlock()
+
+	go func() {
+		defer func() {
+			self.mu.Lock()
+			delete(self.conflicts, key)
+			self.mu.Unlock()
+		}()
+		if self.ping(existing) {
+			self.owner.logger.Warnf("Keeping %s over %s, which claims the same ID", existing, contact)
+			return
+		}
+		if contact.lastSeen.IsZero() {
+			if !self.ping(contact) {
+				self.owner.logger.Debugf("Not adding %s, its ID conflicts with %s and it didn't answer a PING", contact, existing)
+				return
+			}
+			contact.lastSeen = self.owner.clock.Now()
+		}
+		self.owner.logger.Warnf("Replacing %s with %s, which claims the same ID", existing, contact)
+		self.remove(existing)
+		self.add(contact)
+	}()
+}
 
-	index := self.owner.GetKBucketFromAddr(contact.Addr)
+// ping reports whether contact answers a PING, for the checks the table makes
+// on its own rather than for a caller's request
+func (self *RoutingTable) ping(contact Contact) bool {
+	return self.owner.pingContact(context.Background(), contact)
+}
+
+// touch records that we just received an RPC from contact. It is added if it
+// is new, and otherwise becomes the most recently seen contact in its bucket
+// and its failure count is reset
+func (self *RoutingTable) touch(contact Contact) addResult {
+	contact.lastSeen = self.owner.clock.Now()
+	self.markAlive(contact)
+	return self.add(contact)
+}
+
+// insert stores contact in its bucket without pinging anyone, allocating and
+// splitting buckets as needed. It returns what happened and the index of the
+// bucket the contact belongs in, which is full and can't split if the
+// contact was dropped
+// The caller must hold the table's lock
+func (self *RoutingTable) insert(contact Contact) (addResult, int) {
+	index := self.indexFromID(&contact.Id)
 	if self.kBuckets[index] == nil {
-		self.owner.logger.Printf("Creating bucket %d", index)
-		self.kBuckets[index] = NewKBucket(k)
+		self.owner.logger.Debugf("Creating bucket %d", index)
+		self.kBuckets[index] = self.newBucket(index)
+		self.emit(TableEvent{Kind: BucketCreated, Bucket: index})
 	}
-	self.owner.logger.Printf("Trying to put node %s in bucket %d", contact.Addr.String(), index)
+	self.owner.logger.Debugf("Trying to put node %s in bucket %d", contact, index)
+
+	// keep splitting while the contact lands in a full bucket covering our ID
+	result := self.kBuckets[index].addContact(contact, nil)
+	for result == contactDropped && self.splitBucket(index) {
+		index = self.indexFromID(&contact.Id)
+		result = self.kBuckets[index].addContact(contact, nil)
+	}
+	if result == contactAdded {
+		self.numNeighbors++
+		self.evictOverCap(contact)
+	}
+	return result, index
+}
+
+// ImportContacts adds contacts to the table in a single pass under the
+// table's lock, for seeding it from a saved or cached peer list. Nobody is
+// pinged: contacts that land in a full bucket that can't split are dropped.
+// A contact claiming the ID of one we know at another address is dropped
+// too, and the conflict is resolved in the background as in add
+// Returns how many contacts were added
+func (self *RoutingTable) ImportContacts(contacts []Contact) int {
+	defer self.deliverEvents()
+	self.mu.Lock()
+	added := 0
+	conflicts := make([][2]Contact, 0)
+	for _, contact := range contacts {
+		if contact.Id.Cmp(&self.owner.id) == 0 || self.owner.banned.contains(contact.Id) {
+			continue
+		}
+		if existing := self.contactWithID(contact.Id); existing != nil && !AreEqualAddrs(existing.Addr, contact.Addr) {
+			conflicts = append(conflicts, [2]Contact{*existing, contact})
+			continue
+		}
+		if result, _ := self.insert(contact); result == contactAdded {
+			added++
+		}
+	}
+	self.mu.Unlock()
+
+	// resolveConflict takes the table's lock itself
+	for _, conflict := range conflicts {
+		self.resolveConflict(conflict[0], conflict[1])
+	}
+	self.owner.logger.Infof("Imported %d of %d contacts", added, len(contacts))
+	return added
+}
 
-	self.kBuckets[index].addContact(contact)
-	//TODO: handle failure to add
+// contactWithID returns the contact in the table with id, or nil if there
+// isn't one. The caller must hold the table's lock
+func (self *RoutingTable) contactWithID(id big.Int) *Contact {
+	bucket := self.kBuckets[self.indexFromID(&id)]
+	if bucket == nil {
+		return nil
+	}
+	if element := bucket.getFromListByID(id); element != nil {
+		if contact, ok := bucket.contactAt(element); ok {
+			return &contact
+		}
+	}
+	return nil
 }
 
+// remove takes contact out of the table. It does nothing if the contact's
+// bucket was never allocated
 func (self *RoutingTable) remove(contact Contact) {
-	index := self.owner.GetKBucketFromAddr(contact.Addr)
-	self.kBuckets[index].removeContact(contact)
+	defer self.deliverEvents()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	index := self.indexFromID(&contact.Id)
+	if self.kBuckets[index] == nil {
+		return
+	}
+	if removed, refilled := self.kBuckets[index].removeContact(contact); removed && !refilled {
+		self.numNeighbors--
+	}
+}
+
+// removeByID removes the contact with id from the table, or does nothing if
+// there isn't one
+func (self *RoutingTable) removeByID(id big.Int) {
+	contact := self.ContactFromID(id)
+	if contact == nil {
+		return
+	}
+	self.remove(*contact)
+}
+
+// markFailed records that an RPC to contact failed. A contact that fails
+// maxFailures RPCs in a row is removed from the table
+func (self *RoutingTable) markFailed(contact Contact) {
+	defer self.deliverEvents()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	bucket := self.kBuckets[self.indexFromID(&contact.Id)]
+	if bucket == nil || bucket.getFromList(contact) == nil {
+		return
+	}
+
+	key := contact.Id.Text(keyBase)
+	self.failures[key]++
+	if self.failures[key] < maxFailures {
+		return
+	}
+	self.owner.logger.Infof("Removing %s after %d failed RPCs", contact, self.failures[key])
+	delete(self.failures, key)
+	if removed, refilled := bucket.removeContact(contact); removed && !refilled {
+		self.numNeighbors--
+	}
+}
+
+// markAlive records that contact answered an RPC, which resets its failure
+// count
+func (self *RoutingTable) markAlive(contact Contact) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.failures, contact.Id.Text(keyBase))
+}
+
+// allContacts returns a copy of every contact in the table, bucket by bucket
+// from the lowest index up, and most recently seen first within a bucket
+func (self *RoutingTable) allContacts() []Contact {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	contacts := make([]Contact, 0)
+	for _, bucket := range self.kBuckets {
+		if bucket != nil {
+			contacts = append(contacts, bucket.getAllContacts()...)
+		}
+	}
+	return contacts
+}
+
+// Size returns the number of contacts in the table
+func (self *RoutingTable) Size() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.numNeighbors
+}
+
+// Capacity returns the number of contacts the table can hold without splitting
+// a bucket, which is k for every allocated bucket
+func (self *RoutingTable) Capacity() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	capacity := 0
+	for _, bucket := range self.kBuckets {
+		if bucket != nil {
+			capacity += bucket.k
+		}
+	}
+	return capacity
+}
+
+// BucketStat describes one allocated bucket of a routing table
+type BucketStat struct {
+	Index        int
+	Contacts     int
+	Capacity     int
+	LastAccessed time.Time
+}
+
+// BucketStats returns a snapshot of every allocated bucket, in order of index
+func (self *RoutingTable) BucketStats() []BucketStat {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	stats := make([]BucketStat, 0)
+	for index, bucket := range self.kBuckets {
+		if bucket == nil {
+			continue
+		}
+		bucket.mu.Lock()
+		stats = append(stats, BucketStat{index, bucket.contacts.Len(), bucket.k, bucket.lastAccessed})
+		bucket.mu.Unlock()
+	}
+	return stats
+}
+
+// staleBuckets returns the indices of allocated buckets that haven't been
+// accessed for at least age
+func (self *RoutingTable) staleBuckets(age time.Duration) []int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	stale := make([]int, 0)
+	for index, bucket := range self.kBuckets {
+		if bucket != nil && bucket.sinceAccessed() >= age {
+			stale = append(stale, index)
+		}
+	}
+	return stale
+}
+
+// staleContacts returns the contacts we haven't heard from within age,
+// including the ones we have only heard about from other nodes
+func (self *RoutingTable) staleContacts(age time.Duration) []Contact {
+	now := self.owner.clock.Now()
+	stale := make([]Contact, 0)
+	for _, contact := range self.allContacts() {
+		if contact.lastSeen.IsZero() || now.Sub(contact.lastSeen) >= age {
+			stale = append(stale, contact)
+		}
+	}
+	return stale
+}
+
+// pendingSplits returns the indices of buckets that are full and cover our
+// own ID, so splitBucket should already have split them. add splits such a
+// bucket as soon as it fills, so anything returned points at a bug in the
+// splitting logic
+func (self *RoutingTable) pendingSplits() []int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pending := make([]int, 0)
+	for index, bucket := range self.kBuckets {
+		if bucket == nil || index != self.lowest || index == 0 {
+			continue
+		}
+		bucket.mu.Lock()
+		full := bucket.contacts.Len() >= bucket.k
+		bucket.mu.Unlock()
+		if full {
+			pending = append(pending, index)
+		}
+	}
+	return pending
 }
 
 // Not even sure if we will use this
 func (self *RoutingTable) clear() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 	// Note that this sets slice capacity to 0
 	self.kBuckets = nil
+	self.numNeighbors = 0
 }
 
 type KBucket struct {
+	// contacts is ordered by when we last heard from each contact, most
+	// recent at the front and least recent at the back. Contacts we only
+	// heard about from other nodes have no lastSeen and come last
 	contacts *list.List
 	k        int        // max number of contacts
-	lruCache *list.List // not implemented yet but explained in section 4.1
-	mu       *sync.Mutex
+	lruCache *list.List // replacement cache explained in section 4.1
+	// mu guards contacts, lruCache and lastAccessed, so a bucket is safe to
+	// use on its own without the table's lock. Code that holds both takes
+	// the table's lock first. Like the table's, it must not be held while
+	// waiting on the network
+	mu *sync.Mutex
+	// lastAccessed is when a contact was last added to or looked up in the
+	// bucket. Buckets that go unaccessed for tRefresh are refreshed
+	lastAccessed time.Time
+	clock        Clock
+	// policy decides whether a full bucket swaps a live contact for a new one
+	policy EvictionPolicy
+	// bucketPolicy decides whether a full bucket pings and caches at all
+	bucketPolicy BucketPolicy
+	// ownerID is the ID of the node whose table the bucket is in, which
+	// PreferCloser measures distances from
+	ownerID big.Int
+	// notify reports contacts added to and taken out of the bucket to the
+	// table's listener, or is nil if there isn't one
+	notify func(TableEventKind, Contact)
+	// logger is the owner's logger, or a NopLogger for a bucket made on its
+	// own with NewKBucket
+	logger Logger
 }
 
-func NewKBucket(k int) *KBucket {
+func NewKBucket(k int, clock Clock) *KBucket {
 	contacts := list.New()
 	lruCache := list.New()
 	mu := &sync.Mutex{}
-	kBucket := KBucket{contacts, k, lruCache, mu}
+	kBucket := KBucket{contacts, k, lruCache, mu, clock.Now(), clock, EvictLeastRecent, ReplacementCache, big.Int{}, nil, NopLogger()}
 	return &kBucket
 }
 
+// report passes a change to contact to notify, if it is set. The caller must
+// hold the bucket's lock
+func (self *KBucket) report(kind TableEventKind, contact Contact) {
+	if self.notify != nil {
+		self.notify(kind, contact)
+	}
+}
+
+// touch marks the bucket as accessed now
+func (self *KBucket) touch() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.lastAccessed = self.clock.Now()
+}
+
+// sinceAccessed returns how long ago the bucket was last accessed
+func (self *KBucket) sinceAccessed() time.Duration {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.clock.Now().Sub(self.lastAccessed)
+}
+
 // If bucket contains contact, returns ptr to element in list. Else, returns nil
 func (self *KBucket) getFromList(contact Contact) *list.Element {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.findInList(self.contacts, contact)
+}
+
+// getFromListByID returns the element in the bucket whose contact has id, or
+// nil if there isn't one
+func (self *KBucket) getFromListByID(id big.Int) *list.Element {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 	for e := self.contacts.Front(); e != nil; e = e.Next() {
-		curr, _ := e.Value.(Contact)
-		// TODO: handle error when element can't be cast to Contact
-		if AreEqualContacts(&curr, &contact) {
+		if curr, ok := self.contactAt(e); ok && curr.Id.Cmp(&id) == 0 {
 			return e
 		}
 	}
 	return nil
 }
 
-// Not nice, but need this functionality because contacts are a list
+// findInList returns the element of l holding contact or nil. The caller must
+// hold the bucket's lock
+func (self *KBucket) findInList(l *list.List, contact Contact) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if curr, ok := self.contactAt(e); ok && AreEqualContacts(&curr, &contact) {
+			return e
+		}
+	}
+	return nil
+}
+
+// contactAt returns the contact held by e. Buckets should only ever hold
+// Contacts, so anything else is logged to the bucket's logger and reported as
+// not ok
+func (self *KBucket) contactAt(e *list.Element) (Contact, bool) {
+	contact, ok := e.Value.(Contact)
+	if !ok {
+		self.logger.Errorf("Bucket element holds a %T instead of a Contact", e.Value)
+	}
+	return contact, ok
+}
+
+// oldestContact returns the element of the contact we heard from longest ago,
+// or nil if the bucket holds no contacts
+// Contacts with equal lastSeen times are ordered by their place in the list,
+// so the one nearest the back is picked
+// The caller must hold the bucket's lock
+func (self *KBucket) oldestContact() *list.Element {
+	var oldest *list.Element
+	var oldestContact Contact
+	for e := self.contacts.Back(); e != nil; e = e.Prev() {
+		curr, ok := self.contactAt(e)
+		if !ok {
+			continue
+		}
+		if oldest == nil || curr.lastSeen.Before(oldestContact.lastSeen) {
+			oldest = e
+			oldestContact = curr
+		}
+	}
+	return oldest
+}
+
+// insertByLastSeen puts contact into the bucket ahead of every contact we
+// last heard from at the same time or earlier, which keeps the list ordered
+// by lastSeen. Contacts we never heard from have no lastSeen, so they go
+// behind all the others, newest first
+// A contact in the bucket doesn't need a place in the replacement cache, so
+// it is taken out of the cache if it is there
+// The caller must hold the bucket's lock
+func (self *KBucket) insertByLastSeen(contact Contact) {
+	if element := self.findInList(self.lruCache, contact); element != nil {
+		self.lruCache.Remove(element)
+	}
+	for e := self.contacts.Front(); e != nil; e = e.Next() {
+		if curr, ok := self.contactAt(e); ok && !curr.lastSeen.After(contact.lastSeen) {
+			self.contacts.InsertBefore(contact, e)
+			return
+		}
+	}
+	self.contacts.PushBack(contact)
+}
+
+// cacheContact keeps contact in the replacement cache so it can take the place
+// of a contact that is removed later. The most recently seen contact is at the
+// front and the cache never holds more than k entries: when it is full, the
+// oldest entry is evicted to make room. Buckets whose policy doesn't keep a
+// cache drop contact instead. The caller must hold the bucket's lock
+func (self *KBucket) cacheContact(contact Contact) {
+	if self.bucketPolicy != ReplacementCache {
+		return
+	}
+	if element := self.findInList(self.lruCache, contact); element != nil {
+		self.lruCache.MoveToFront(element)
+		return
+	}
+	if self.lruCache.Len() >= self.k {
+		self.lruCache.Remove(self.lruCache.Back())
+	}
+	self.lruCache.PushFront(contact)
+}
+
+// getAllContacts returns a copy of the bucket's contacts in the same order
+// the bucket keeps them: most recently seen first, least recently seen last
 func (self *KBucket) getAllContacts() []Contact {
 	self.mu.Lock()
 	defer self.mu.Unlock()
-	contacts := make([]Contact, 0, 20)
+	contacts := make([]Contact, 0, self.contacts.Len())
 	for e := self.contacts.Front(); e != nil; e = e.Next() {
-		curr, _ := e.Value.(Contact)
-		contacts = append(contacts, curr)
+		if curr, ok := self.contactAt(e); ok {
+			contacts = append(contacts, curr)
+		}
 	}
 	return contacts
 }
 
-// Returns true if contact is added into bucket, false otherwise
-func (self *KBucket) addContact(contact Contact) bool {
-	// If contact exists, move to tail
-	element := self.getFromList(contact)
+// addResult reports what happened to a contact passed to RoutingTable.add
+type addResult int
+
+const (
+	// contactAdded means the contact is new to its bucket, which now holds
+	// one more contact
+	contactAdded addResult = iota
+	// contactReplaced means the bucket was full and the contact took the
+	// place of one that was evicted
+	contactReplaced
+	// contactUpdated means the contact was already known and is now the most
+	// recently seen
+	contactUpdated
+	// contactCached means the bucket was full and the contact went into the
+	// replacement cache
+	contactCached
+	// contactDropped means the contact wasn't stored at all
+	contactDropped
+)
+
+// BucketPolicy decides what a full bucket that can't split does when a new
+// contact arrives
+type BucketPolicy int
+
+const (
+	// ReplacementCache pings the least-recently seen contact and replaces it
+	// if it doesn't answer. Otherwise the new contact is kept in the
+	// replacement cache to fill the next free slot, as in the Kademlia
+	// paper. It is the default
+	ReplacementCache BucketPolicy = iota
+	// PingEvict pings the least-recently seen contact and replaces it if it
+	// doesn't answer, but drops the new contact if it does. There is no
+	// replacement cache
+	PingEvict
+	// StrictReject drops the new contact without pinging anyone, so a full
+	// bucket only changes when a contact is removed
+	StrictReject
+)
+
+// EvictionPolicy decides what a full bucket does when a new contact arrives
+// and its least-recently seen contact still answers a PING. Only
+// ReplacementCache buckets have somewhere to put the contact that loses, so
+// the other bucket policies can only be used with EvictLeastRecent
+type EvictionPolicy int
+
+const (
+	// EvictLeastRecent keeps the live contact and caches the new one, as in
+	// the Kademlia paper. It is the default
+	EvictLeastRecent EvictionPolicy = iota
+	// PreferLowRTT keeps whichever of the two has the lower PING round-trip
+	// time, when both have been pinged, and caches the other
+	PreferLowRTT
+	// PreferCloser replaces the contact farthest from our own ID with the new
+	// one if the new one is closer, and caches the farther one. It only ever
+	// applies to buckets that can't split: a full bucket covering our ID is
+	// split rather than evicted from
+	PreferCloser
+)
+
+// addContact stores contact in the bucket and reports what it did with it
+// If the bucket is full, ping is not nil and the bucket's policy isn't
+// StrictReject, the least-recently seen contact is pinged and replaced by
+// contact if it doesn't respond
+func (self *KBucket) addContact(contact Contact, ping func(Contact) bool) addResult {
+	self.mu.Lock()
+	self.lastAccessed = self.clock.Now()
+	// If contact exists, keep the latest lastSeen and move it to match
+	if element := self.findInList(self.contacts, contact); element != nil {
+		curr, _ := self.contactAt(element)
+		if curr.lastSeen.After(contact.lastSeen) {
+			contact.lastSeen = curr.lastSeen
+		}
+		if contact.rtt == 0 {
+			contact.rtt = curr.rtt
+		}
+		if contact.version == 0 {
+			contact.version = curr.version
+		}
+		self.contacts.Remove(element)
+		self.insertByLastSeen(contact)
+		self.mu.Unlock()
+		return contactUpdated
+	}
+
+	// If bucket isn't full, add it
+	// list.Len() = O(1)
+	if self.contacts.Len() < self.k {
+		self.insertByLastSeen(contact)
+		self.report(ContactAdded, contact)
+		self.mu.Unlock()
+		return contactAdded
+	}
+
+	if ping == nil || self.bucketPolicy == StrictReject {
+		self.mu.Unlock()
+		return contactDropped
+	}
+
+	// Otherwise, ping least-recently seen node. The lock isn't held while
+	// waiting on the network
+	lruNode := self.oldestContact()
+	if lruNode == nil {
+		self.mu.Unlock()
+		return contactDropped
+	}
+	lru, _ := self.contactAt(lruNode)
+	self.mu.Unlock()
+	if ping(lru) {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		if self.policy == PreferLowRTT && self.swapForLowerRTT(lru, contact) {
+			return contactReplaced
+		}
+		if self.policy == PreferCloser && self.swapForCloser(contact) {
+			return contactReplaced
+		}
+		if self.bucketPolicy != ReplacementCache {
+			return contactDropped
+		}
+		self.cacheContact(contact)
+		return contactCached
+	}
+
+	// If no response, node is evicted and new sender is inserted
+	// The bucket may have changed while it was unlocked, so look both
+	// contacts up again
 	self.mu.Lock()
 	defer self.mu.Unlock()
-	if element != nil {
-		self.contacts.MoveToFront(element)
-		return true
-	} else {
-		// If bucket isn't full, add to tail
-		// list.Len() = O(1)
-		if self.contacts.Len() < self.k {
-			self.contacts.PushFront(contact)
-			return true
-		}
-		/* TODO: Deal when with buckets are full
-		// Otherwise, ping least-recently seen node
-		lruNode := self.contacts.Front()
-		// ping node... sigh this is gnna be ugly.
-		if true {
-			// If no response, node is evicted and new sender is inserted at tail
-			self.contacts.Remove(lruNode)
-			self.contacts.PushBack(contact)
-			return true
-		}
-		// implement replacement cache
+	if element := self.findInList(self.contacts, contact); element != nil {
+		return contactUpdated
+	}
+	if element := self.findInList(self.contacts, lru); element != nil {
+		self.contacts.Remove(element)
+		self.insertByLastSeen(contact)
+		self.report(ContactEvicted, lru)
+		self.report(ContactAdded, contact)
+		return contactReplaced
+	}
+	if self.contacts.Len() < self.k {
+		self.insertByLastSeen(contact)
+		self.report(ContactAdded, contact)
+		return contactAdded
+	}
+	return contactDropped
+}
+
+// swapForLowerRTT replaces lru with contact, and moves lru to the replacement
+// cache, if both have been pinged and contact's round-trip time is lower.
+// Returns whether it did. The caller must hold the bucket's lock
+func (self *KBucket) swapForLowerRTT(lru Contact, contact Contact) bool {
+	element := self.findInList(self.contacts, lru)
+	if element == nil {
+		return false
+	}
+	// read lru again since the PING that was just sent updated its rtt
+	current, _ := self.contactAt(element)
+	if contact.rtt == 0 || current.rtt == 0 || contact.rtt >= current.rtt {
 		return false
-		*/
+	}
+	self.contacts.Remove(element)
+	self.cacheContact(current)
+	self.insertByLastSeen(contact)
+	self.report(ContactEvicted, current)
+	self.report(ContactAdded, contact)
+	return true
+}
+
+// swapForCloser replaces the contact farthest from the owner's ID with contact,
+// and moves it to the replacement cache, if contact is closer. Returns whether
+// it did. The caller must hold the bucket's lock
+func (self *KBucket) swapForCloser(contact Contact) bool {
+	farthest, farthestDist := self.farthestExcept(contact)
+	if farthest == nil || Distance(self.ownerID, contact.Id).Cmp(farthestDist) >= 0 {
 		return false
 	}
+	evicted, _ := self.contactAt(farthest)
+	self.contacts.Remove(farthest)
+	self.cacheContact(evicted)
+	self.insertByLastSeen(contact)
+	self.report(ContactEvicted, evicted)
+	self.report(ContactAdded, contact)
+	return true
 }
 
 // ContactFromID returns the contact that belongs to id if it exists and nil if
 // it doesn't
 func (table *RoutingTable) ContactFromID(id big.Int) *Contact {
-	contact := Contact{id, net.TCPAddr{}}
-
+	table.mu.Lock()
+	defer table.mu.Unlock()
 	// find the bucket it should be in
 	// if the bucket has been allocated (isn't nil), see if it's
 	// in the list
 
-	index := table.owner.GetKBucketFromID(&id)
-	table.owner.logger.Printf("Index is %d", index)
+	index := table.indexFromID(&id)
+	table.owner.logger.Debugf("Index is %d", index)
 	kbucket := table.kBuckets[index]
 
 	if kbucket != nil {
-		table.owner.logger.Printf("Found a kbucket")
-		result := kbucket.getFromList(contact)
+		table.owner.logger.Debugf("Found a kbucket")
+		result := kbucket.getFromListByID(id)
 		if result != nil {
-			toReturn := result.Value.(Contact)
-			return &toReturn
+			if toReturn, ok := kbucket.contactAt(result); ok {
+				return &toReturn
+			}
 		}
 	} else {
 		return nil
@@ -242,15 +1118,58 @@ func (table *RoutingTable) ContactFromID(id big.Int) *Contact {
 	return nil
 }
 
-// Returns true if contact exists, false otherwise
-func (self *KBucket) removeContact(contact Contact) bool {
+// ContactFromAddr returns the contact at addr if the table has one and nil if
+// it doesn't. Unlike ContactFromID it has to check every bucket
+func (table *RoutingTable) ContactFromAddr(addr net.TCPAddr) *Contact {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	for _, bucket := range table.kBuckets {
+		if bucket == nil {
+			continue
+		}
+		if contact, ok := bucket.getByAddr(addr); ok {
+			return &contact
+		}
+	}
+	return nil
+}
+
+// getByAddr returns the contact in the bucket at addr, if there is one
+func (self *KBucket) getByAddr(addr net.TCPAddr) (Contact, bool) {
 	self.mu.Lock()
 	defer self.mu.Unlock()
-	element := self.getFromList(contact)
+	for e := self.contacts.Front(); e != nil; e = e.Next() {
+		if curr, ok := self.contactAt(e); ok && AreEqualAddrs(curr.Addr, addr) {
+			return curr, true
+		}
+	}
+	return Contact{}, false
+}
+
+// removed is true if the bucket held contact, false otherwise
+// The freed slot is filled with the most recently seen contact from the
+// replacement cache, if there is one, and refilled reports whether it was
+func (self *KBucket) removeContact(contact Contact) (removed bool, refilled bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if element := self.findInList(self.lruCache, contact); element != nil {
+		self.lruCache.Remove(element)
+	}
+	element := self.findInList(self.contacts, contact)
 	if element != nil {
+		removed, _ := self.contactAt(element)
 		self.contacts.Remove(element)
-		return true
+		self.report(ContactRemoved, removed)
+		if cached := self.lruCache.Front(); cached != nil {
+			if refill, ok := self.contactAt(cached); ok {
+				self.lruCache.Remove(cached)
+				self.insertByLastSeen(refill)
+				self.report(ContactAdded, refill)
+				return true, true
+			}
+		}
+		return true, false
 	} else {
-		return false
+		return false, false
 	}
 }
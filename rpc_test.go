@@ -0,0 +1,77 @@
+package kademlia
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// gobRoundTrip encodes msg with gob, as net/rpc does, and decodes it into a
+// new value of the same type
+func gobRoundTrip(t *testing.T, msg interface{}) (interface{}, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		t.Fatalf("encoding %T: %s", msg, err)
+	}
+	encoded := append([]byte(nil), buf.Bytes()...)
+	decoded := reflect.New(reflect.TypeOf(msg).Elem())
+	if err := gob.NewDecoder(&buf).DecodeValue(decoded); err != nil {
+		t.Fatalf("decoding %T: %s", msg, err)
+	}
+	return decoded.Interface(), encoded
+}
+
+// Every RPC message survives gob, the encoding net/rpc sends them in. IDs keep
+// their full 160 bits, whether the top bit is set or they start with zeros
+func TestRPCMessagesRoundTrip(t *testing.T) {
+	source := net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000}
+	high := new(big.Int).Lsh(big.NewInt(1), idBits-1)
+	high.Add(high, big.NewInt(5))
+	low := big.NewInt(3)
+	contacts := []Contact{
+		*NewContactWithID(*high, source),
+		*NewContactWithID(*low, net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1, Zone: "eth0"}),
+	}
+	auth := Signature{[]byte("key"), []byte("sig")}
+
+	messages := []interface{}{
+		&PingArgs{source, protocolVersion, auth},
+		&PingReply{source, protocolVersion, auth},
+		&StoreArgs{source, high.Text(keyBase), []byte("value"), time.Minute, auth},
+		&BatchStoreArgs{source, []KeyValue{{"a", []byte("1")}, {"b", []byte("2")}}, auth},
+		&FindValueArgs{source, high.Text(keyBase), auth},
+		&FindValueReply{[]byte("value"), true, nil},
+		&FindValueReply{nil, false, contacts},
+		&FindNodeArgs{source, low.Text(keyBase), high, auth},
+		&FindNodeReply{contacts},
+	}
+	for _, msg := range messages {
+		decoded, encoded := gobRoundTrip(t, msg)
+		_, again := gobRoundTrip(t, decoded)
+		if !bytes.Equal(encoded, again) {
+			t.Errorf("%T changed in a round trip: %+v became %+v", msg, msg, decoded)
+		}
+
+		var got []Contact
+		switch decoded := decoded.(type) {
+		case *FindValueReply:
+			got = decoded.Contacts
+		case *FindNodeReply:
+			got = decoded.Contacts
+		case *FindNodeArgs:
+			if decoded.MaxDistance == nil || decoded.MaxDistance.Cmp(high) != 0 {
+				t.Errorf("MaxDistance %s decoded as %v", high, decoded.MaxDistance)
+			}
+		}
+		for i := range got {
+			if got[i].Id.Cmp(&contacts[i].Id) != 0 || !AreEqualAddrs(got[i].Addr, contacts[i].Addr) {
+				t.Errorf("%T: %s decoded as %s", msg, contacts[i], got[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package kademlia
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"time"
+)
+
+// serveRPC accepts an RPC connection like rpc.Server's own ServeHTTP, but
+// serves it with a serverCodec so that a peer sending garbage or stalling
+// halfway through a message only loses its own connection
+func (node *Node) serveRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, buffered, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		node.logger.Warnf("Couldn't take over RPC connection from %s: %s", r.RemoteAddr, err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	// anything the peer sent right after the CONNECT may already be buffered
+	node.server.ServeCodec(newServerCodec(conn, buffered.Reader, node.logger, node.allowPeer))
+}
+
+// serverCodec is the gob codec net/rpc uses by default, plus read deadlines,
+// rate limiting and logging. A connection is closed if no request header
+// arrives on it for tRPCIdle, or if a request's body doesn't follow its
+// header within tRPCRead
+type serverCodec struct {
+	conn   net.Conn
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	logger Logger
+	// allow returns an error if a request from the peer at host should be
+	// dropped before its body is decoded
+	allow  func(host string) error
+	closed bool
+}
+
+// newServerCodec returns a codec that reads requests from r, which must read
+// from conn, and writes responses to conn
+func newServerCodec(conn net.Conn, r io.Reader, logger Logger, allow func(host string) error) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{conn, gob.NewDecoder(r), gob.NewEncoder(buf), buf, logger, allow, false}
+}
+
+func (codec *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	// idle connections from the client's pool wait here between RPCs
+	codec.conn.SetReadDeadline(time.Now().Add(tRPCIdle))
+	err := codec.dec.Decode(r)
+	codec.logReadError(err)
+	return err
+}
+
+// ReadRequestBody decodes the body of a request, unless its peer is over the
+// rate limit. Then the body is discarded without being decoded or verified,
+// and net/rpc answers with the error
+func (codec *serverCodec) ReadRequestBody(body interface{}) error {
+	codec.conn.SetReadDeadline(time.Now().Add(tRPCRead))
+	if body != nil {
+		if err := codec.allow(codec.peerHost()); err != nil {
+			if discardErr := codec.dec.DecodeValue(reflect.Value{}); discardErr != nil {
+				codec.logReadError(discardErr)
+				return discardErr
+			}
+			return err
+		}
+	}
+	err := codec.dec.Decode(body)
+	codec.logReadError(err)
+	return err
+}
+
+// peerHost returns the IP of the connection's peer
+func (codec *serverCodec) peerHost() string {
+	addr := codec.conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// logReadError logs why a request couldn't be read. Peers closing the
+// connection and idle timeouts are routine, the rest means a bad peer
+func (codec *serverCodec) logReadError(err error) {
+	if err == nil || err == io.EOF {
+		return
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		codec.logger.Debugf("Closing RPC connection from %s: %s", codec.conn.RemoteAddr(), err)
+		return
+	}
+	codec.logger.Warnf("Closing RPC connection from %s, couldn't decode request: %s", codec.conn.RemoteAddr(), err)
+}
+
+func (codec *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if err := codec.enc.Encode(r); err != nil {
+		if codec.encBuf.Flush() == nil {
+			codec.logger.Errorf("Couldn't encode RPC response header: %s", err)
+			codec.Close()
+		}
+		return err
+	}
+	if err := codec.enc.Encode(body); err != nil {
+		if codec.encBuf.Flush() == nil {
+			codec.logger.Errorf("Couldn't encode RPC response body: %s", err)
+			codec.Close()
+		}
+		return err
+	}
+	return codec.encBuf.Flush()
+}
+
+func (codec *serverCodec) Close() error {
+	if codec.closed {
+		return nil
+	}
+	codec.closed = true
+	return codec.conn.Close()
+}
@@ -0,0 +1,108 @@
+package kademlia
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// shortlistCache keeps the final shortlists of recent lookups so that a lookup
+// for a nearby target can start from contacts that are already close to it,
+// instead of only from the routing table. Shortlists are keyed by the top
+// shortlistPrefixBits bits of their target
+// Cached contacts are only used to seed a lookup and are queried like any
+// other, so a stale entry costs an RPC but can't change the result
+type shortlistCache struct {
+	entries map[string]shortlistEntry
+	ttl     time.Duration // how long a shortlist is reused for
+	idBits  int           // number of bits in a target
+	clock   Clock
+	mu      *sync.Mutex
+}
+
+type shortlistEntry struct {
+	contacts []Contact
+	stored   time.Time
+}
+
+func newShortlistCache(ttl time.Duration, idBits int, clock Clock) *shortlistCache {
+	cache := new(shortlistCache)
+	cache.entries = make(map[string]shortlistEntry)
+	cache.ttl = ttl
+	cache.idBits = idBits
+	cache.clock = clock
+	cache.mu = &sync.Mutex{}
+	return cache
+}
+
+// prefix returns the cache key for target
+func (cache *shortlistCache) prefix(target big.Int) string {
+	shift := cache.idBits - shortlistPrefixBits
+	if shift < 0 {
+		shift = 0
+	}
+	return new(big.Int).Rsh(&target, uint(shift)).Text(keyBase)
+}
+
+// get returns the cached contacts for targets near target, or nil
+func (cache *shortlistCache) get(target big.Int) []Contact {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[cache.prefix(target)]
+	if !ok || cache.clock.Now().Sub(entry.stored) >= cache.ttl {
+		return nil
+	}
+	contacts := make([]Contact, len(entry.contacts))
+	copy(contacts, entry.contacts)
+	return contacts
+}
+
+// put stores the shortlist a lookup for target converged on. Expired entries
+// are dropped at the same time
+func (cache *shortlistCache) put(target big.Int, contacts []Contact) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := cache.clock.Now()
+	for prefix, entry := range cache.entries {
+		if now.Sub(entry.stored) >= cache.ttl {
+			delete(cache.entries, prefix)
+		}
+	}
+	stored := make([]Contact, len(contacts))
+	copy(stored, contacts)
+	cache.entries[cache.prefix(target)] = shortlistEntry{stored, now}
+}
+
+// initialShortlist returns the n contacts a lookup for target starts from. If
+// the shortlist cache is enabled, the cached contacts for nearby targets are
+// considered alongside the routing table's
+func (node *Node) initialShortlist(target big.Int, n int) []Contact {
+	shortlist := node.rt.findNClosest(target, n)
+	if node.shortlists == nil {
+		return shortlist
+	}
+	cached := node.shortlists.get(target)
+	if len(cached) == 0 {
+		return shortlist
+	}
+
+	shortlist = RemoveDupesFromShortlist(append(shortlist, cached...))
+	sort.Slice(shortlist, func(i, j int) bool {
+		iDist := Distance(target, shortlist[i].Id)
+		jDist := Distance(target, shortlist[j].Id)
+		return (iDist.Cmp(jDist) == -1)
+	})
+	if len(shortlist) > n {
+		shortlist = shortlist[:n]
+	}
+	return shortlist
+}
+
+// rememberShortlist stores the shortlist a lookup for target converged on, if
+// the shortlist cache is enabled
+func (node *Node) rememberShortlist(target big.Int, shortlist []Contact) {
+	if node.shortlists != nil && len(shortlist) > 0 {
+		node.shortlists.put(target, shortlist)
+	}
+}
@@ -0,0 +1,76 @@
+package kademlia
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// shortlistNetwork returns a searcher joined to a network of n nodes, which
+// only knows the seed and caches shortlists if cache is set
+func shortlistNetwork(t testing.TB, n int, cache bool) *Node {
+	t.Helper()
+	network := NewMemoryNetwork()
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, network, 10000+i, WithK(4))
+		if i > 0 {
+			nodes[i].Bootstrap(context.Background(), *NewContactWithID(nodes[0].id, nodes[0].addr))
+		}
+	}
+	opts := []Option{WithK(4)}
+	if cache {
+		opts = append(opts, WithShortlistCache(time.Minute))
+	}
+	searcher := newTestNode(t, network, 9999, opts...)
+	searcher.rt.ImportContacts([]Contact{*NewContactWithID(nodes[0].id, nodes[0].addr)})
+	return searcher
+}
+
+// adjacentKeys returns two targets far from the searcher that share their
+// top bits, so they use the same cached shortlist
+func adjacentKeys(searcher *Node) (string, string) {
+	first := new(big.Int).Xor(&searcher.id, new(big.Int).Lsh(big.NewInt(1), idBits-1))
+	second := new(big.Int).Xor(first, big.NewInt(1))
+	return first.Text(keyBase), second.Text(keyBase)
+}
+
+// A second lookup for a key next to one just looked up sends fewer FINDNODEs
+// when it can start from the first lookup's shortlist
+func TestShortlistCacheSavesRPCs(t *testing.T) {
+	sent := make(map[bool]uint64)
+	for _, cache := range []bool{false, true} {
+		searcher := shortlistNetwork(t, 40, cache)
+		first, second := adjacentKeys(searcher)
+		if _, err := searcher.doIterativeFindNode(context.Background(), first); err != nil {
+			t.Fatal(err)
+		}
+		before := searcher.Stats().FindNodesSent
+		if _, err := searcher.doIterativeFindNode(context.Background(), second); err != nil {
+			t.Fatal(err)
+		}
+		sent[cache] = searcher.Stats().FindNodesSent - before
+	}
+	if sent[true] >= sent[false] {
+		t.Errorf("second lookup sent %d FINDNODEs with the cache and %d without", sent[true], sent[false])
+	}
+}
+
+func BenchmarkAdjacentLookups(b *testing.B) {
+	for _, cache := range []bool{false, true} {
+		name := "uncached"
+		if cache {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			searcher := shortlistNetwork(b, 40, cache)
+			first, second := adjacentKeys(searcher)
+			searcher.doIterativeFindNode(context.Background(), first)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				searcher.doIterativeFindNode(context.Background(), second)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package kademlia
+
+import (
+	"context"
+	"math/big"
+	"time"
+)
+
+// SiblingSet returns up to 2k of the contacts closest to our own ID, closest
+// first. These are the nodes that share responsibility for the keys near us,
+// so keeping twice as many as a lookup needs means a few of them can fail
+// without a value near us losing all of its copies
+func (node *Node) SiblingSet() []Contact {
+	return node.rt.findNClosest(node.id, 2*node.k)
+}
+
+// siblingsFor returns the siblings that are closer to key than the farthest
+// contact in shortlist, and so should hold the key too, but aren't in it
+func (node *Node) siblingsFor(key big.Int, shortlist []Contact) []Contact {
+	if len(shortlist) == 0 {
+		return nil
+	}
+	farthest := Distance(key, shortlist[0].Id)
+	for _, contact := range shortlist[1:] {
+		if dist := Distance(key, contact.Id); dist.Cmp(farthest) == 1 {
+			farthest = dist
+		}
+	}
+
+	extra := make([]Contact, 0)
+	for _, sibling := range node.SiblingSet() {
+		if Distance(key, sibling.Id).Cmp(farthest) == -1 {
+			extra = append(extra, sibling)
+		}
+	}
+	return excludeAll(extra, shortlist)
+}
+
+// startSiblingLoop looks up our own ID every interval in the background so
+// that the sibling set follows nodes joining and leaving near us. interval
+// is measured on the node's clock. The loop stops when the node is closed
+func (node *Node) startSiblingLoop(interval time.Duration) {
+	done := node.done
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-node.clock.After(interval):
+				if _, err := node.doIterativeFindNode(context.Background(), node.id.Text(keyBase)); err != nil {
+					node.logger.Warnf("Refreshing siblings failed: %s", err)
+				}
+			}
+		}
+	}()
+}
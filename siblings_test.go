@@ -0,0 +1,78 @@
+package kademlia
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSiblingLoopLooksUpOwnID(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	interval := 5 * time.Minute
+	node := newTestNode(t, network, 10000, WithClock(clock), WithSelfLookupInterval(interval))
+	peer := newTestNode(t, network, 10001)
+	defer node.Close()
+	if !node.doPing(context.Background(), peer.addr) {
+		t.Fatal("Peer didn't answer a PING")
+	}
+	lookups := func() uint64 { return atomic.LoadUint64(&peer.stats.FindNodesReceived) }
+
+	node.startSiblingLoop(node.selfLookupInterval)
+	waitFor(t, "the sibling loop to wait on the clock", func() bool { return clock.waiting() == 1 })
+	clock.Advance(interval - time.Second)
+	if got := lookups(); got != 0 {
+		t.Fatalf("%d lookups sent before the interval passed", got)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, "the self-lookup", func() bool { return lookups() > 0 })
+}
+
+// As nodes near us leave and join, the sibling set stays full, and the new
+// nodes we learn of that are among the closest to us join it
+func TestSiblingSetUnderChurn(t *testing.T) {
+	network, nodes := newTestNetwork(t, 24, WithK(4))
+	node := nodes[0]
+	want := 2 * node.k
+	check := func(step string) []Contact {
+		t.Helper()
+		if _, err := node.doIterativeFindNode(context.Background(), node.id.Text(keyBase)); err != nil {
+			t.Fatal(err)
+		}
+		siblings := node.SiblingSet()
+		if len(siblings) != want {
+			t.Fatalf("sibling set has %d contacts after %s, want %d", len(siblings), step, want)
+		}
+		return siblings
+	}
+	check("joining")
+
+	seed := *NewContactWithID(node.id, node.addr)
+	for round := 0; round < 3; round++ {
+		for _, sibling := range node.SiblingSet()[:2] {
+			network.Remove(sibling.Addr)
+		}
+		check("siblings left")
+
+		joiners := make([]*Node, 2)
+		for i := range joiners {
+			joiners[i] = newTestNode(t, network, 11000+2*round+i, WithK(4))
+			if err := joiners[i].Bootstrap(context.Background(), seed); err != nil {
+				t.Fatal(err)
+			}
+		}
+		siblings := check("nodes joined")
+		farthest := Distance(node.id, siblings[len(siblings)-1].Id)
+		set := NewContactSet()
+		for _, sibling := range siblings {
+			set.Add(sibling)
+		}
+		for _, joiner := range joiners {
+			known := node.rt.ContactFromID(joiner.id) != nil
+			if known && Distance(node.id, joiner.id).Cmp(farthest) < 0 && !set.Contains(*NewContactWithID(joiner.id, joiner.addr)) {
+				t.Errorf("%s is known and closer than the farthest sibling but isn't one", joiner.addr.String())
+			}
+		}
+	}
+}
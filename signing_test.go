@@ -0,0 +1,61 @@
+package kademlia
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+func newSignedTestNode(t *testing.T, network *MemoryNetwork, port int) *Node {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestNode(t, network, port, WithSigningKey(key))
+}
+
+func TestSignedPing(t *testing.T) {
+	network := NewMemoryNetwork()
+	a := newSignedTestNode(t, network, 10000)
+	b := newSignedTestNode(t, network, 10001)
+
+	replied := a.ping(context.Background(), b.addr)
+	if replied == nil {
+		t.Fatal("signed PING wasn't answered")
+	}
+	if replied.Id.Cmp(&b.id) != 0 {
+		t.Errorf("PING reply gave ID %s, want the hash of b's key %s", IDToHex(replied.Id), IDToHex(b.id))
+	}
+	if contact := b.rt.ContactFromID(a.id); contact == nil || !AreEqualAddrs(contact.Addr, a.addr) {
+		t.Errorf("b didn't add a under the hash of its key, got %v", contact)
+	}
+}
+
+// A message whose signature doesn't match its contents, or that isn't
+// signed at all, is rejected and its sender isn't added
+func TestBadSignatureRejected(t *testing.T) {
+	network := NewMemoryNetwork()
+	a := newSignedTestNode(t, network, 10000)
+	b := newSignedTestNode(t, network, 10001)
+
+	forged := PingArgs{Source: a.addr, Version: protocolVersion}
+	forged.Auth = a.sign("Ping", forged)
+	forged.Source = net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 4000}
+	unsigned := PingArgs{Source: a.addr, Version: protocolVersion}
+	replayed := PingArgs{Source: a.addr, Version: protocolVersion}
+	replayed.Auth = a.sign("FindNode", replayed)
+
+	for name, args := range map[string]PingArgs{"tampered": forged, "unsigned": unsigned, "other method": replayed} {
+		var reply PingReply
+		err := network.Call(context.Background(), b.addr, "Ping", args, &reply)
+		if _, ok := err.(rpc.ServerError); !ok {
+			t.Errorf("%s PING returned %v, want a server error", name, err)
+		}
+	}
+	if b.rt.Size() != 0 {
+		t.Errorf("b added %d contacts from rejected PINGs", b.rt.Size())
+	}
+}
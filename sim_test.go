@@ -0,0 +1,146 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// simulation runs a network of in-memory nodes that join and leave while
+// values are stored and looked up
+type simulation struct {
+	t        *testing.T
+	network  *MemoryNetwork
+	live     []*Node
+	rng      *rand.Rand
+	nextHost int
+	graceful bool
+}
+
+// join starts a new node on the next free address and bootstraps it off a
+// random live node. The first node has nobody to bootstrap off
+func (sim *simulation) join() error {
+	sim.nextHost++
+	addr := net.TCPAddr{IP: net.IPv4(10, byte(sim.nextHost>>16), byte(sim.nextHost>>8), byte(sim.nextHost)), Port: 4000}
+	node, err := NewNode(addr,
+		WithTransport(sim.network),
+		WithLogger(NopLogger()),
+		WithRandSource(rand.NewSource(sim.rng.Int63())))
+	if err != nil {
+		sim.t.Fatal(err)
+	}
+	sim.network.Add(node)
+
+	if len(sim.live) > 0 {
+		seed := sim.live[sim.rng.Intn(len(sim.live))]
+		if err := node.Bootstrap(context.Background(), *NewContact(seed.addr)); err != nil {
+			sim.network.Remove(addr)
+			return err
+		}
+	}
+	sim.live = append(sim.live, node)
+	return nil
+}
+
+// leave takes a random live node off the network. A graceful node hands its
+// values off first, otherwise it just disappears
+func (sim *simulation) leave() {
+	i := sim.rng.Intn(len(sim.live))
+	leaving := sim.live[i]
+	sim.live = append(sim.live[:i], sim.live[i+1:]...)
+	if sim.graceful {
+		leaving.Shutdown(context.Background())
+	}
+	sim.network.Remove(leaving.addr)
+	leaving.Close()
+}
+
+func (sim *simulation) randomNode() *Node {
+	return sim.live[sim.rng.Intn(len(sim.live))]
+}
+
+// runChurn builds a network of size nodes, then issues ops PUT/GET pairs
+// while a churn fraction of the nodes leave, spread evenly over the run, and
+// are each replaced by a new node. Returns the fraction of GETs that found
+// their value
+func runChurn(t *testing.T, size int, churn float64, ops int, graceful bool, seed int64) float64 {
+	t.Helper()
+	sim := &simulation{
+		t:        t,
+		network:  NewMemoryNetwork(),
+		rng:      rand.New(rand.NewSource(seed)),
+		graceful: graceful,
+	}
+	for i := 0; i < size; i++ {
+		if err := sim.join(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	departures := int(float64(size) * churn)
+	churnEvery := ops + 1
+	if departures > 0 {
+		churnEvery = ops / departures
+		if churnEvery < 1 {
+			churnEvery = 1
+		}
+	}
+
+	ctx := context.Background()
+	stored := make([]string, 0, ops)
+	putsFailed, gets, found, left := 0, 0, 0, 0
+	for op := 0; op < ops; op++ {
+		if left < departures && op%churnEvery == 0 {
+			sim.leave()
+			left++
+			if err := sim.join(); err != nil {
+				t.Logf("Join failed: %s", err)
+			}
+		}
+
+		key := fmt.Sprintf("key-%d", op)
+		if err := sim.randomNode().Put(ctx, []byte(key), []byte(key)); err != nil {
+			putsFailed++
+		} else {
+			stored = append(stored, key)
+		}
+
+		if len(stored) == 0 {
+			continue
+		}
+		key = stored[sim.rng.Intn(len(stored))]
+		gets++
+		if val, ok, err := sim.randomNode().Get(ctx, []byte(key)); err == nil && ok && string(val) == key {
+			found++
+		}
+	}
+
+	success := 1.0
+	if gets > 0 {
+		success = float64(found) / float64(gets)
+	}
+	t.Logf("%d nodes, %d left and were replaced", size, left)
+	t.Logf("PUT: %d of %d succeeded", ops-putsFailed, ops)
+	t.Logf("GET: %d of %d succeeded (%.1f%%)", found, gets, success*100)
+	return success
+}
+
+func TestChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulates 100 nodes")
+	}
+	if success := runChurn(t, 100, 0.1, 200, false, 1); success < 0.9 {
+		t.Errorf("%.1f%% of GETs succeeded with 10%% churn, want at least 90%%", success*100)
+	}
+}
+
+func TestChurnGraceful(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulates 100 nodes")
+	}
+	if success := runChurn(t, 100, 0.1, 200, true, 1); success < 0.9 {
+		t.Errorf("%.1f%% of GETs succeeded with 10%% graceful churn, want at least 90%%", success*100)
+	}
+}
@@ -0,0 +1,53 @@
+package kademlia
+
+import (
+	"sync/atomic"
+)
+
+// Stats counts the RPCs and routing table operations a node has performed
+// since it was created
+type Stats struct {
+	PingsSent          uint64
+	PingsReceived      uint64
+	StoresSent         uint64
+	StoresReceived     uint64
+	FindNodesSent      uint64
+	FindNodesReceived  uint64
+	FindValuesSent     uint64
+	FindValuesReceived uint64
+	BucketSplits       uint64
+	Evictions          uint64
+	FailedDials        uint64
+	RateLimited        uint64
+	// IDConflicts counts contacts that claimed the ID of a contact we know
+	// at another address
+	IDConflicts uint64
+	// StoreQueueDepth is how many key/value pairs are waiting in the store
+	// queue to be republished. Unlike the other fields it goes down as well
+	StoreQueueDepth uint64
+}
+
+// Stats returns a snapshot of the node's counters
+func (node *Node) Stats() Stats {
+	return Stats{
+		PingsSent:          atomic.LoadUint64(&node.stats.PingsSent),
+		PingsReceived:      atomic.LoadUint64(&node.stats.PingsReceived),
+		StoresSent:         atomic.LoadUint64(&node.stats.StoresSent),
+		StoresReceived:     atomic.LoadUint64(&node.stats.StoresReceived),
+		FindNodesSent:      atomic.LoadUint64(&node.stats.FindNodesSent),
+		FindNodesReceived:  atomic.LoadUint64(&node.stats.FindNodesReceived),
+		FindValuesSent:     atomic.LoadUint64(&node.stats.FindValuesSent),
+		FindValuesReceived: atomic.LoadUint64(&node.stats.FindValuesReceived),
+		BucketSplits:       atomic.LoadUint64(&node.stats.BucketSplits),
+		Evictions:          atomic.LoadUint64(&node.stats.Evictions),
+		FailedDials:        atomic.LoadUint64(&node.stats.FailedDials),
+		RateLimited:        atomic.LoadUint64(&node.stats.RateLimited),
+		IDConflicts:        atomic.LoadUint64(&node.stats.IDConflicts),
+		StoreQueueDepth:    atomic.LoadUint64(&node.stats.StoreQueueDepth),
+	}
+}
+
+// count atomically increments one of the node's counters
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
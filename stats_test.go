@@ -0,0 +1,39 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestStatsCountRPCs(t *testing.T) {
+	network := NewMemoryNetwork()
+	a := newTestNode(t, network, 10000)
+	b := newTestNode(t, network, 10001)
+	ctx := context.Background()
+
+	a.doPing(ctx, b.addr)
+	a.doPing(ctx, b.addr)
+	a.doStore(ctx, "abc", []byte("value"), b.addr)
+	a.doFindNode(ctx, "abc", b.addr)
+	a.doFindValue(ctx, "abc", b.addr)
+	a.doFindValue(ctx, "def", b.addr)
+	a.doPing(ctx, net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9})
+
+	sent, received := a.Stats(), b.Stats()
+	if sent.PingsSent != 3 || received.PingsReceived != 2 {
+		t.Errorf("PINGs sent %d, received %d, want 3 and 2", sent.PingsSent, received.PingsReceived)
+	}
+	if sent.StoresSent != 1 || received.StoresReceived != 1 {
+		t.Errorf("STOREs sent %d, received %d, want 1 each", sent.StoresSent, received.StoresReceived)
+	}
+	if sent.FindNodesSent != 1 || received.FindNodesReceived != 1 {
+		t.Errorf("FINDNODEs sent %d, received %d, want 1 each", sent.FindNodesSent, received.FindNodesReceived)
+	}
+	if sent.FindValuesSent != 2 || received.FindValuesReceived != 2 {
+		t.Errorf("FINDVALUEs sent %d, received %d, want 2 each", sent.FindValuesSent, received.FindValuesReceived)
+	}
+	if sent.FailedDials != 1 || received.FailedDials != 0 {
+		t.Errorf("failed dials are %d and %d, want 1 and 0", sent.FailedDials, received.FailedDials)
+	}
+}
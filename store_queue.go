@@ -0,0 +1,90 @@
+package kademlia
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// storeJob is a batch of key/value pairs waiting to be republished to contact
+type storeJob struct {
+	contact Contact
+	pairs   []KeyValue
+}
+
+// storeQueue holds the BATCHSTOREs of a republish so they can be sent at a
+// steady rate instead of all at once. It is bounded: a republish that finds
+// it full leaves the rest of its keys for the next one
+type storeQueue struct {
+	jobs chan storeJob
+	rate float64 // pairs sent per second
+}
+
+func newStoreQueue(size int, rate float64) *storeQueue {
+	queue := new(storeQueue)
+	queue.jobs = make(chan storeJob, size)
+	queue.rate = rate
+	return queue
+}
+
+// push adds job to the queue and reports whether there was room for it
+func (queue *storeQueue) push(job storeJob) bool {
+	select {
+	case queue.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueStore adds a BATCHSTORE of pairs to contact to the store queue,
+// split into batches of at most republishBatchSize pairs. Returns the pairs
+// that didn't fit
+func (node *Node) queueStore(contact Contact, pairs []KeyValue) []KeyValue {
+	for len(pairs) > 0 {
+		size := len(pairs)
+		if size > republishBatchSize {
+			size = republishBatchSize
+		}
+		if !node.stores.push(storeJob{contact, pairs[:size]}) {
+			return pairs
+		}
+		atomic.AddUint64(&node.stats.StoreQueueDepth, uint64(size))
+		pairs = pairs[size:]
+	}
+	return nil
+}
+
+// drainStoreQueue sends the queued BATCHSTOREs until the node is closed. Each
+// batch is sent once the ones before it have had len(pairs)/rate seconds
+// each, so the pairs go out at the queue's rate however they are batched.
+// The wait is on the node's clock, the same one next is read from
+func (node *Node) drainStoreQueue() {
+	next := node.clock.Now()
+	for {
+		var job storeJob
+		select {
+		case <-node.done:
+			return
+		case job = <-node.stores.jobs:
+		}
+
+		if wait := next.Sub(node.clock.Now()); wait > 0 {
+			select {
+			case <-node.done:
+				return
+			case <-node.clock.After(wait):
+			}
+		}
+		if err := node.batchStore(context.Background(), job.contact, job.pairs); err != nil {
+			node.logger.Warnf("%s", err)
+		}
+		atomic.AddUint64(&node.stats.StoreQueueDepth, ^uint64(len(job.pairs)-1))
+
+		// time spent idle doesn't earn a burst later
+		if now := node.clock.Now(); next.Before(now) {
+			next = now
+		}
+		next = next.Add(time.Duration(float64(len(job.pairs)) / node.stores.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,38 @@
+package kademlia
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The store queue sends at the republish rate as measured by the node's
+// clock, so moving a fake clock is what lets each batch go
+func TestStoreQueueWaitsOnNodeClock(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := newFakeClock()
+	sender := newTestNode(t, network, 10000, WithClock(clock), WithRepublishRate(1))
+	receiver := newTestNode(t, network, 10001)
+	defer sender.Close()
+
+	to := *NewContactWithID(receiver.id, receiver.addr)
+	for i := 0; i < 3; i++ {
+		pair := KeyValue{Key: IDToHex(*big.NewInt(int64(i))), Val: []byte("value")}
+		if left := sender.queueStore(to, []KeyValue{pair}); len(left) != 0 {
+			t.Fatalf("queueStore left %d pairs unqueued", len(left))
+		}
+	}
+	received := func() uint64 { return atomic.LoadUint64(&receiver.stats.StoresReceived) }
+	go sender.drainStoreQueue()
+
+	waitFor(t, "the first batch", func() bool { return received() == 1 })
+	for want := uint64(2); want <= 3; want++ {
+		waitFor(t, "the queue to wait on the clock", func() bool { return clock.waiting() == 1 })
+		if got := received(); got != want-1 {
+			t.Fatalf("%d batches sent before the clock moved, want %d", got, want-1)
+		}
+		clock.Advance(time.Second)
+		waitFor(t, "the next batch", func() bool { return received() == want })
+	}
+}
@@ -0,0 +1,90 @@
+package kademlia
+
+import (
+	"container/list"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// evictOverCap evicts contacts while the table holds more than the node's
+// maxContacts, each time the contact farthest from us in the least recently
+// accessed bucket. added, which was just stored, is never the one evicted.
+// Evicted contacts aren't cached and the freed slot isn't refilled from the
+// replacement cache, since that would undo the eviction
+// The caller must hold the table's lock
+func (self *RoutingTable) evictOverCap(added Contact) {
+	limit := self.owner.maxContacts
+	for limit > 0 && self.numNeighbors > limit {
+		evicted := false
+		for _, bucket := range self.bucketsByAccess() {
+			if bucket.evictFarthest(added) {
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			return
+		}
+		self.numNeighbors--
+		count(&self.owner.stats.Evictions)
+	}
+}
+
+// bucketsByAccess returns the allocated buckets, least recently accessed
+// first. Buckets accessed at the same time, such as the ones made by a
+// split, are farthest first, so that ties don't cost us our closest contacts
+// The caller must hold the table's lock
+func (self *RoutingTable) bucketsByAccess() []*KBucket {
+	buckets := make([]*KBucket, 0)
+	accessed := make(map[*KBucket]time.Time)
+	for index := len(self.kBuckets) - 1; index >= 0; index-- {
+		bucket := self.kBuckets[index]
+		if bucket == nil {
+			continue
+		}
+		bucket.mu.Lock()
+		accessed[bucket] = bucket.lastAccessed
+		bucket.mu.Unlock()
+		buckets = append(buckets, bucket)
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return accessed[buckets[i]].Before(accessed[buckets[j]])
+	})
+	return buckets
+}
+
+// evictFarthest removes the contact farthest from the table's owner other
+// than keep, and reports whether there was one
+func (self *KBucket) evictFarthest(keep Contact) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	farthest, _ := self.farthestExcept(keep)
+	if farthest == nil {
+		return false
+	}
+	evicted, _ := self.contactAt(farthest)
+	self.contacts.Remove(farthest)
+	self.report(ContactEvicted, evicted)
+	return true
+}
+
+// farthestExcept returns the element of the contact farthest from the table's
+// owner other than keep, and its distance, or nil if there isn't one
+// The caller must hold the bucket's lock
+func (self *KBucket) farthestExcept(keep Contact) (*list.Element, *big.Int) {
+	var farthest *list.Element
+	var farthestDist *big.Int
+	for e := self.contacts.Front(); e != nil; e = e.Next() {
+		curr, ok := self.contactAt(e)
+		if !ok || AreEqualContacts(&curr, &keep) {
+			continue
+		}
+		dist := Distance(self.ownerID, curr.Id)
+		if farthest == nil || dist.Cmp(farthestDist) > 0 {
+			farthest = e
+			farthestDist = dist
+		}
+	}
+	return farthest, farthestDist
+}
@@ -0,0 +1,72 @@
+package kademlia
+
+import (
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// contactAtDistance returns a contact whose ID differs from id in bit and in
+// the bits of low
+func contactAtDistance(id big.Int, bit uint, low int64, port int) Contact {
+	distance := new(big.Int).Lsh(big.NewInt(1), bit)
+	distance.Or(distance, big.NewInt(low))
+	contactID := new(big.Int).Xor(&id, distance)
+	return *NewContactWithID(*contactID, net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: port})
+}
+
+func TestMaxContactsEvictsFarthestInLeastRecentBucket(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2), WithClock(clock), WithMaxContacts(4))
+	far1 := contactAtDistance(node.id, 100, 0, 1)
+	far2 := contactAtDistance(node.id, 100, 1, 2)
+	mid1 := contactAtDistance(node.id, 50, 0, 3)
+	mid2 := contactAtDistance(node.id, 50, 1, 4)
+	near := contactAtDistance(node.id, 10, 0, 5)
+
+	node.rt.ImportContacts([]Contact{far1, far2})
+	clock.Advance(time.Minute)
+	node.rt.ImportContacts([]Contact{mid1, mid2})
+	clock.Advance(time.Minute)
+	// touching far1 makes bucket 100 newer than bucket 50, but adding near
+	// passes through bucket 50 on its way down, leaving bucket 100 the least
+	// recently accessed
+	node.rt.ImportContacts([]Contact{far1})
+	clock.Advance(time.Minute)
+	node.rt.ImportContacts([]Contact{near})
+
+	if size := node.rt.Size(); size != 4 {
+		t.Fatalf("table holds %d contacts, want 4", size)
+	}
+	if node.rt.ContactFromID(far2.Id) != nil {
+		t.Error("far2, the farthest contact in the least recently accessed bucket, wasn't evicted")
+	}
+	for _, contact := range []Contact{far1, mid1, mid2, near} {
+		if node.rt.ContactFromID(contact.Id) == nil {
+			t.Errorf("%s was evicted", contact)
+		}
+	}
+}
+
+func TestMaxContactsBoundsSize(t *testing.T) {
+	clock := newFakeClock()
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2), WithClock(clock), WithMaxContacts(4))
+	for i := 0; i < 40; i++ {
+		clock.Advance(time.Second)
+		added := contactAtDistance(node.id, uint(20+i*3), 0, 100+i)
+		node.rt.ImportContacts([]Contact{added})
+		if size, held := node.rt.Size(), len(node.rt.allContacts()); size > 4 || held != size {
+			t.Fatalf("after %d inserts the table counts %d contacts and holds %d, want at most 4", i+1, size, held)
+		}
+		if node.rt.ContactFromID(added.Id) == nil {
+			t.Fatalf("the contact just added was evicted")
+		}
+	}
+}
+
+func TestMaxContactsRejectsNegative(t *testing.T) {
+	if _, err := NewNode(net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10000}, WithMaxContacts(-1)); err == nil {
+		t.Error("NewNode accepted a negative contact cap")
+	}
+}
@@ -0,0 +1,62 @@
+package kademlia
+
+// TableEventKind is the kind of change a TableEvent reports
+type TableEventKind int
+
+const (
+	// BucketCreated means the bucket was allocated for its first contact
+	BucketCreated TableEventKind = iota
+	// BucketSplit means the lowest bucket was split. Bucket is the index
+	// that was split, and the contacts closer to us moved to Bucket-1
+	BucketSplit
+	// ContactAdded means Contact was stored in the bucket, including when
+	// it took the place of a removed contact from the replacement cache
+	ContactAdded
+	// ContactRemoved means Contact was taken out of the bucket, because it
+	// was removed or failed too many RPCs
+	ContactRemoved
+	// ContactEvicted means Contact was pushed out of the full bucket to make
+	// room for another
+	ContactEvicted
+)
+
+// TableEvent describes a change to the structure of a routing table
+type TableEvent struct {
+	Kind TableEventKind
+	// Bucket is the index of the bucket that changed
+	Bucket int
+	// Contact is the contact that was added, removed or evicted. It is
+	// zero for bucket events
+	Contact Contact
+}
+
+// TableListener is called with every change to a routing table. It is only
+// called once the table's locks are released, so it may use the table, but
+// it may be called from several goroutines at once
+type TableListener func(TableEvent)
+
+// emit records event to be delivered to the table's listener, if it has one
+// It may be called with the table's or a bucket's lock held
+func (self *RoutingTable) emit(event TableEvent) {
+	if self.listener == nil {
+		return
+	}
+	self.eventsMu.Lock()
+	defer self.eventsMu.Unlock()
+	self.events = append(self.events, event)
+}
+
+// deliverEvents hands the recorded events to the listener. Every method that
+// changes the table calls it once it has released its locks
+func (self *RoutingTable) deliverEvents() {
+	if self.listener == nil {
+		return
+	}
+	self.eventsMu.Lock()
+	events := self.events
+	self.events = nil
+	self.eventsMu.Unlock()
+	for _, event := range events {
+		self.listener(event)
+	}
+}
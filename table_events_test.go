@@ -0,0 +1,41 @@
+package kademlia
+
+import (
+	"sync"
+	"testing"
+)
+
+// Filling the bucket that covers our ID tells the listener about the new
+// bucket, the contacts added and then the split
+func TestTableListenerSeesSplit(t *testing.T) {
+	var mu sync.Mutex
+	events := make([]TableEvent, 0)
+	listener := func(event TableEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	node := newTestNode(t, NewMemoryNetwork(), 10000, WithK(2), WithTableListener(listener))
+	first := contactAtDistance(node.id, 159, 0, 1)
+	second := contactAtDistance(node.id, 159, 1, 2)
+	near := contactAtDistance(node.id, 100, 0, 3)
+	node.rt.ImportContacts([]Contact{first, second, near})
+
+	want := []TableEvent{
+		{Kind: BucketCreated, Bucket: 159},
+		{Kind: ContactAdded, Bucket: 159, Contact: first},
+		{Kind: ContactAdded, Bucket: 159, Contact: second},
+		{Kind: BucketSplit, Bucket: 159},
+		{Kind: ContactAdded, Bucket: 158, Contact: near},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != len(want) {
+		t.Fatalf("listener got %v, want %v", events, want)
+	}
+	for i := range want {
+		if events[i].Kind != want[i].Kind || events[i].Bucket != want[i].Bucket || events[i].Contact.Id.Cmp(&want[i].Contact.Id) != 0 {
+			t.Errorf("event %d is %v, want %v", i, events[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package kademlia
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a node at 127.0.0.1:port that is reachable on network
+// Logging is off and k is large enough that a test's buckets don't fill up,
+// unless opts say otherwise
+func newTestNode(t testing.TB, network *MemoryNetwork, port int, opts ...Option) *Node {
+	t.Helper()
+	addr := net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	defaults := []Option{WithTransport(network), WithLogger(NopLogger()), WithK(20)}
+	node, err := NewNode(addr, append(defaults, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Add(node)
+	return node
+}
+
+// newTestNetwork returns n nodes on a new MemoryNetwork. Every node after the
+// first bootstraps from the first
+func newTestNetwork(t *testing.T, n int, opts ...Option) (*MemoryNetwork, []*Node) {
+	t.Helper()
+	network := NewMemoryNetwork()
+	nodes := make([]*Node, n)
+	for i := range nodes {
+		nodes[i] = newTestNode(t, network, 10000+i, opts...)
+	}
+	seed := *NewContactWithID(nodes[0].id, nodes[0].addr)
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap(context.Background(), seed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return network, nodes
+}
+
+// freeAddr returns a loopback address with a port nothing is listening on
+func freeAddr(t *testing.T) net.TCPAddr {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return *l.Addr().(*net.TCPAddr)
+}
+
+// waitFor fails the test if cond doesn't become true within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeClock is a Clock that only moves when the test advances it
+type fakeClock struct {
+	now     time.Time
+	waiters []fakeTimer
+	mu      *sync.Mutex
+}
+
+// fakeTimer is a channel returned by fakeClock.After, waiting for its deadline
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time.Unix(1000000, 0), nil, &sync.Mutex{}}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- clock.now
+		return c
+	}
+	clock.waiters = append(clock.waiters, fakeTimer{clock.now.Add(d), c})
+	return c
+}
+
+// waiting returns how many channels returned by After haven't fired yet
+func (clock *fakeClock) waiting() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.waiters)
+}
+
+// Advance moves the clock forward by d, firing the channels of every After
+// whose deadline that reaches
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	waiting := clock.waiters[:0]
+	for _, timer := range clock.waiters {
+		if timer.deadline.After(clock.now) {
+			waiting = append(waiting, timer)
+		} else {
+			timer.c <- clock.now
+		}
+	}
+	clock.waiters = waiting
+}
@@ -0,0 +1,27 @@
+package kademlia
+
+import (
+	"net"
+	"time"
+)
+
+// LookupEvent describes one RPC an iterative lookup sent
+type LookupEvent struct {
+	// Target is the key or node ID being looked up
+	Target string
+	// Method is "FindNode" or "FindValue"
+	Method string
+	// Addr is the node that was asked
+	Addr    net.TCPAddr
+	Latency time.Duration
+	// OK is false if the RPC failed, in which case nothing else is set
+	OK bool
+	// Contacts is how many contacts the node replied with
+	Contacts int
+	// Found is set if the node had the value of a FindValue
+	Found bool
+}
+
+// LookupTrace is called after every RPC a lookup sends. Lookups send their
+// RPCs concurrently, so it must be safe to call from several goroutines
+type LookupTrace func(LookupEvent)
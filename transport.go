@@ -0,0 +1,141 @@
+package kademlia
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Transport carries outgoing RPCs to other nodes
+type Transport interface {
+	// Call invokes the named RPC on the node at to and decodes its reply
+	// into reply
+	Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error
+	// Close releases any connections the transport is holding open
+	Close() error
+}
+
+// dialError is returned by a Transport when it couldn't reach the remote node
+// at all, as opposed to the RPC itself failing
+type dialError struct {
+	err error
+}
+
+func (e *dialError) Error() string {
+	return fmt.Sprintf("Dial failed: %s", e.err)
+}
+
+func (e *dialError) Unwrap() error {
+	return e.err
+}
+
+// callRPC sends method on client and waits for the reply or for ctx to be done
+func callRPC(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(fmt.Sprintf("NodeRPC.%s", method), args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// tcpTransport is the default Transport. It sends net/rpc calls over HTTP and
+// keeps connections open in a connPool for reuse
+type tcpTransport struct {
+	pool *connPool
+	// readTimeout is how long a reply may take to arrive once the RPC is
+	// sent, or zero for no limit
+	readTimeout time.Duration
+}
+
+func newTCPTransport(maxIdle int, timeout time.Duration, dialTimeout time.Duration, readTimeout time.Duration, clock Clock) *tcpTransport {
+	return &tcpTransport{newConnPool(maxIdle, timeout, dialTimeout, clock), readTimeout}
+}
+
+// Call implements Transport. The connection is closed rather than reused if
+// the RPC fails, times out or is abandoned
+func (transport *tcpTransport) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	client, err := transport.pool.get(ctx, to.String())
+	if err != nil {
+		return &dialError{err}
+	}
+
+	// a peer that stops answering fails the read, which fails the call
+	if transport.readTimeout > 0 {
+		client.conn.SetReadDeadline(time.Now().Add(transport.readTimeout))
+	}
+	if err := callRPC(ctx, client.Client, method, args, reply); err != nil {
+		client.Close()
+		return err
+	}
+	client.conn.SetReadDeadline(time.Time{})
+
+	transport.pool.put(to.String(), client)
+	return nil
+}
+
+// Close implements Transport
+func (transport *tcpTransport) Close() error {
+	transport.pool.closeAll()
+	return nil
+}
+
+// MemoryNetwork is a Transport that delivers RPCs to nodes in the same process
+// without opening any sockets. Nodes are reached by the address they were
+// added with, so a whole network can be simulated deterministically
+type MemoryNetwork struct {
+	servers map[string]*rpc.Server
+	mu      *sync.Mutex
+}
+
+// NewMemoryNetwork returns an empty MemoryNetwork
+func NewMemoryNetwork() *MemoryNetwork {
+	network := new(MemoryNetwork)
+	network.servers = make(map[string]*rpc.Server)
+	network.mu = &sync.Mutex{}
+	return network
+}
+
+// Add makes node reachable on the network at its address. The node should
+// have been created with WithTransport(network) so its own RPCs go over the
+// network too
+func (network *MemoryNetwork) Add(node *Node) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	network.servers[node.addr.String()] = node.server
+}
+
+// Remove makes the node at addr unreachable, as if it had gone offline
+func (network *MemoryNetwork) Remove(addr net.TCPAddr) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	delete(network.servers, addr.String())
+}
+
+// Call implements Transport. Each call gets its own in-memory pipe to the
+// remote node's RPC server
+func (network *MemoryNetwork) Call(ctx context.Context, to net.TCPAddr, method string, args interface{}, reply interface{}) error {
+	network.mu.Lock()
+	server, ok := network.servers[to.String()]
+	network.mu.Unlock()
+	if !ok {
+		return &dialError{fmt.Errorf("No node at %s", to.String())}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	return callRPC(ctx, client, method, args, reply)
+}
+
+// Close implements Transport. The network is shared between nodes, so closing
+// one node's transport leaves it intact
+func (network *MemoryNetwork) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package kademlia
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Over the in-memory transport, 50 nodes with small buckets find each other:
+// a lookup for a node's ID returns that node first
+func TestMemoryNetworkLookupsConverge(t *testing.T) {
+	_, nodes := newTestNetwork(t, 50, WithK(4))
+	for i := 0; i < len(nodes); i += 5 {
+		searcher, target := nodes[i], nodes[(i*7+3)%len(nodes)]
+		if searcher == target {
+			continue
+		}
+		found, err := searcher.doIterativeFindNode(context.Background(), target.id.Text(keyBase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) == 0 || found[0].Id.Cmp(&target.id) != 0 {
+			t.Errorf("%s looking up %s found %v", searcher.addr.String(), IDToHex(target.id), found)
+		}
+	}
+}
+
+// silentPeer accepts connections and answers the RPC handshake, then never
+// replies to anything
+func silentPeer(t *testing.T) net.TCPAddr {
+	t.Helper()
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				r := bufio.NewReader(conn)
+				// skip the CONNECT request up to its blank line
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == "\n" {
+						break
+					}
+				}
+				io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+				io.Copy(io.Discard, r)
+			}()
+		}
+	}()
+	return *l.Addr().(*net.TCPAddr)
+}
+
+// An RPC to a peer that accepts it but never replies fails with a timeout
+// once the read timeout has passed
+func TestReadTimeout(t *testing.T) {
+	addr := silentPeer(t)
+	node, err := NewNode(freeAddr(t), WithLogger(NopLogger()), WithReadTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	start := time.Now()
+	var reply PingReply
+	err = node.transport.Call(context.Background(), addr, "Ping", PingArgs{Source: node.addr}, &reply)
+	elapsed := time.Since(start)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Call returned %v, want a timeout", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Call took %s, want about the 200ms read timeout", elapsed)
+	}
+}
@@ -1,10 +1,11 @@
 package kademlia
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"math/big"
+	"math/rand"
 	"net"
+	"strconv"
 )
 
 func RemoveDupesFromShortlist(contacts []Contact) []Contact {
@@ -23,25 +24,127 @@ func RemoveDupesFromShortlist(contacts []Contact) []Contact {
 	return unduped_slice
 }
 
-// GetKBucketFromAddr returns the KBucket that would contain destAddr
-func (node *Node) GetKBucketFromAddr(destAddr net.TCPAddr) int {
-	hash := sha1.Sum([]byte(destAddr.String()))
+// removeDupesByID returns contacts with only the first entry for each ID
+func removeDupesByID(contacts []Contact) []Contact {
+	seen := make(map[string]bool)
+	unduped := make([]Contact, 0, len(contacts))
+	for _, curr := range contacts {
+		key := curr.Id.Text(keyBase)
+		if !seen[key] {
+			unduped = append(unduped, curr)
+			seen[key] = true
+		}
+	}
+	return unduped
+}
 
-	id := *big.NewInt(0)
-	id.SetBytes(hash[:])
+// excludeContact returns contacts without any entry equal to contact
+func excludeContact(contacts []Contact, contact Contact) []Contact {
+	result := make([]Contact, 0, len(contacts))
+	for i := 0; i < len(contacts); i++ {
+		if !AreEqualContacts(&contacts[i], &contact) {
+			result = append(result, contacts[i])
+		}
+	}
+	return result
+}
+
+// withinDistance returns the contacts whose XOR distance from target is at
+// most maxDistance
+func withinDistance(contacts []Contact, target big.Int, maxDistance *big.Int) []Contact {
+	result := make([]Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if Distance(target, contact.Id).Cmp(maxDistance) <= 0 {
+			result = append(result, contact)
+		}
+	}
+	return result
+}
+
+// excludeAll returns contacts without any entry whose ID is in others
+func excludeAll(contacts []Contact, others []Contact) []Contact {
+	skip := make(map[string]bool)
+	for _, other := range others {
+		skip[other.Id.Text(keyBase)] = true
+	}
+	result := make([]Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if !skip[contact.Id.Text(keyBase)] {
+			result = append(result, contact)
+		}
+	}
+	return result
+}
+
+// IDToHex formats id in hex, padded with leading zeros to the width of the
+// default ID space so that IDs line up and their prefixes compare. Keys are
+// still stored unpadded, as id.Text(keyBase)
+func IDToHex(id big.Int) string {
+	return fmt.Sprintf("%0*x", idBits/4, &id)
+}
+
+// HexToID parses an ID written in hex, with or without leading zeros
+func HexToID(s string) (big.Int, error) {
+	id := new(big.Int)
+	if _, ok := id.SetString(s, keyBase); !ok || id.Sign() < 0 {
+		return big.Int{}, fmt.Errorf("Invalid hex ID %q", s)
+	}
+	return *id, nil
+}
+
+// canonicalAddr returns the form of addr that node IDs are hashed from. The
+// zone is left out because it names an interface on whichever host resolved
+// the address, so two nodes would otherwise hash the same link-local peer to
+// different IDs. IPv4-mapped IPv6 addresses hash the same as plain IPv4 ones
+func canonicalAddr(addr net.TCPAddr) string {
+	ip := ""
+	if len(addr.IP) != 0 {
+		ip = addr.IP.String()
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(addr.Port))
+}
 
-	return node.GetKBucketFromID(&id)
+// AreEqualAddrs returns true if a and b have the same IP, port and zone
+func AreEqualAddrs(a net.TCPAddr, b net.TCPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+// GetKBucketFromAddr returns the KBucket that would contain destAddr. It
+// agrees with GetKBucketFromID for the contact at destAddr because it finds
+// the contact's ID the same way the rest of the node does. With signing, an
+// address only has an ID once its contact is in the table, so -1 is returned
+// for any other address
+func (node *Node) GetKBucketFromAddr(destAddr net.TCPAddr) int {
+	contact := node.contactByAddr(destAddr)
+	if contact == nil {
+		return -1
+	}
+	return node.GetKBucketFromID(&contact.Id)
 }
 
 // GetKBucketFromID returns the KBucket that would contain destID
 func (node *Node) GetKBucketFromID(destID *big.Int) int {
-	destContact := Contact{*destID, net.TCPAddr{}}
-	dist := node.distanceTo(&destContact)
-	node.logger.Printf("Distance is %s", dist)
+	return bucketIndex(node.id, *destID)
+}
+
+// bucketIndex returns the index of the bucket that targetID belongs in for the
+// node with ownerID. That is the floor of log_2 of their distance, which is
+// the ID size minus their common prefix length minus 1. ownerID itself has no
+// bucket, so it gets -1
+func bucketIndex(ownerID big.Int, targetID big.Int) int {
+	return Distance(ownerID, targetID).BitLen() - 1
+}
 
-	// a kludgy hack to the get the floor of log_2 of the distance
-	bitstring := fmt.Sprintf("%b", dist)
-	log2Floor := len(bitstring) - 1
+// randomIDInBucket returns a random ID that falls in bucket bucketIndex of the
+// node with ownerID, so its distance from ownerID is in
+// [2^bucketIndex, 2^(bucketIndex+1))
+func randomIDInBucket(ownerID big.Int, bucketIndex int, rng *rand.Rand) big.Int {
+	// the top bit of the distance is fixed and the bits below it are random
+	span := new(big.Int).Lsh(big.NewInt(1), uint(bucketIndex))
+	dist := new(big.Int).Rand(rng, span)
+	dist.Add(dist, span)
 
-	return log2Floor
+	id := *big.NewInt(0)
+	id.Xor(&ownerID, dist)
+	return id
 }
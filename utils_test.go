@@ -0,0 +1,135 @@
+package kademlia
+
+import (
+	"math/big"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestBucketIndex(t *testing.T) {
+	owner := *new(big.Int).Lsh(big.NewInt(0xabc), 100)
+	if got := bucketIndex(owner, owner); got != -1 {
+		t.Errorf("bucketIndex of our own ID = %d, want -1", got)
+	}
+
+	// every bit flipped is as far as an ID can be
+	all := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), idBits), big.NewInt(1))
+	farthest := *new(big.Int).Xor(&owner, all)
+	if got := bucketIndex(owner, farthest); got != idBits-1 {
+		t.Errorf("bucketIndex of the farthest ID = %d, want %d", got, idBits-1)
+	}
+
+	for bit := 0; bit < idBits; bit++ {
+		target := *new(big.Int).Xor(&owner, new(big.Int).Lsh(big.NewInt(1), uint(bit)))
+		if got := bucketIndex(owner, target); got != bit {
+			t.Errorf("bucketIndex of an ID differing in bit %d = %d", bit, got)
+		}
+		if got := bucketIndex(target, owner); got != bit {
+			t.Errorf("bucketIndex isn't symmetric for bit %d", bit)
+		}
+	}
+}
+
+// IPv6 addresses hash to the same ID however they were written or resolved,
+// so their bucket doesn't move, while the zone still tells link-local peers
+// on different interfaces apart
+func TestIPv6Addrs(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	eth0 := net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 4000, Zone: "eth0"}
+	eth1 := net.TCPAddr{IP: net.ParseIP("fe80:0:0::0001"), Port: 4000, Zone: "eth1"}
+
+	if AreEqualAddrs(eth0, eth1) {
+		t.Error("link-local addresses with different zones are equal")
+	}
+	if !AreEqualAddrs(eth0, net.TCPAddr{IP: net.ParseIP("fe80::0:1"), Port: 4000, Zone: "eth0"}) {
+		t.Error("the same IPv6 address written two ways isn't equal")
+	}
+	a, b := NewContact(eth0), NewContact(eth1)
+	if a.Id.Cmp(&b.Id) != 0 {
+		t.Error("the zone changed the contact's ID")
+	}
+	if AreEqualContacts(a, b) {
+		t.Error("contacts on different zones are equal")
+	}
+	if node.GetKBucketFromID(&a.Id) != node.GetKBucketFromID(&b.Id) {
+		t.Error("the zone changed the contact's bucket")
+	}
+	bucket := NewKBucket(4, realClock{})
+	bucket.addContact(*a, nil)
+	if bucket.getFromList(*b) != nil {
+		t.Error("a bucket found a contact on another zone")
+	}
+
+	mapped := net.TCPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 4000}
+	plain := net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 4000}
+	if id := NewContact(mapped).Id; id.Cmp(&NewContact(plain).Id) != 0 {
+		t.Error("an IPv4-mapped address has a different ID from the IPv4 one")
+	}
+}
+
+// randomIDInBucket lands in the bucket it was asked for, every bucket of the
+// ID space, and a seeded source gives the same IDs every time
+func TestRandomIDInBucket(t *testing.T) {
+	owner := *new(big.Int).Lsh(big.NewInt(0xabc), 100)
+	rng, again := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for index := 0; index < idBits; index++ {
+		id := randomIDInBucket(owner, index, rng)
+		if got := bucketIndex(owner, id); got != index {
+			t.Errorf("random ID for bucket %d is in bucket %d", index, got)
+		}
+		if repeat := randomIDInBucket(owner, index, again); repeat.Cmp(&id) != 0 {
+			t.Errorf("the same seed gave different IDs for bucket %d", index)
+		}
+	}
+}
+
+// IDs round-trip through hex, keeping their leading zeros, and contacts print
+// with a short ID prefix
+func TestIDHex(t *testing.T) {
+	ids := []*big.Int{big.NewInt(0), big.NewInt(1), new(big.Int).Lsh(big.NewInt(0xabc), 100), new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), idBits), big.NewInt(1))}
+	for _, id := range ids {
+		hex := IDToHex(*id)
+		if len(hex) != idBits/4 {
+			t.Errorf("IDToHex(%s) = %q, want %d digits", id, hex, idBits/4)
+		}
+		got, err := HexToID(hex)
+		if err != nil || got.Cmp(id) != 0 {
+			t.Errorf("HexToID(%q) = %s, %v, want %s, nil", hex, &got, err, id)
+		}
+	}
+	if got := IDToHex(*big.NewInt(0xab)); got != "00000000000000000000000000000000000000ab" {
+		t.Errorf("IDToHex(0xab) = %q, want leading zeros", got)
+	}
+	for _, bad := range []string{"", "xyz", "-1"} {
+		if _, err := HexToID(bad); err == nil {
+			t.Errorf("HexToID(%q) returned no error", bad)
+		}
+	}
+
+	contact := NewContactWithID(*new(big.Int).Lsh(big.NewInt(0xabcdef12), 128), net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000})
+	if got := contact.String(); got != "abcdef12@10.0.0.1:4000" {
+		t.Errorf("Contact.String() = %q, want %q", got, "abcdef12@10.0.0.1:4000")
+	}
+}
+
+// The bucket found from an address is the bucket of the contact made from it,
+// for IPv4 and IPv6 addresses and ports at both ends of the range
+func TestBucketFromAddrMatchesID(t *testing.T) {
+	node := newTestNode(t, NewMemoryNetwork(), 10000)
+	addrs := []net.TCPAddr{
+		{IP: net.ParseIP("10.0.0.1"), Port: 1},
+		{IP: net.ParseIP("10.0.0.1"), Port: 65535},
+		{IP: net.IPv4(192, 168, 1, 20).To4(), Port: 4000},
+		{IP: net.ParseIP("::ffff:192.168.1.20"), Port: 4000},
+		{IP: net.ParseIP("2001:db8::1"), Port: 1},
+		{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+		{IP: net.ParseIP("fe80::1"), Port: 4000, Zone: "eth0"},
+	}
+	for _, addr := range addrs {
+		id := NewContact(addr).Id
+		if fromID, fromAddr := node.GetKBucketFromID(&id), node.GetKBucketFromAddr(addr); fromID != fromAddr {
+			t.Errorf("%s: GetKBucketFromID = %d, GetKBucketFromAddr = %d", addr.String(), fromID, fromAddr)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package kademlia
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// wireVersion returns the protocol version a peer advertised. Peers from
+// before versioning don't send one, so it decodes as zero
+func wireVersion(advertised int) int {
+	if advertised == 0 {
+		return 1
+	}
+	return advertised
+}
+
+// checkVersion returns an error if a peer advertising version is too old to
+// talk to at all
+func checkVersion(version int) error {
+	if version < minProtocolVersion {
+		return fmt.Errorf("Protocol version %d is older than the oldest supported, %d", version, minProtocolVersion)
+	}
+	return nil
+}
+
+// peerSupports reports whether the contact with id speaks at least version.
+// Contacts we haven't exchanged a PING with are assumed to be current
+func (node *Node) peerSupports(id big.Int, version int) bool {
+	contact := node.rt.ContactFromID(id)
+	if contact == nil || contact.version == 0 {
+		return true
+	}
+	return contact.version >= version
+}
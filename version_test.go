@@ -0,0 +1,75 @@
+package kademlia
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+// A peer from before BATCHSTORE still answers PINGs, takes Puts and gets
+// republished to, one STORE per pair
+func TestOlderPeerInteroperates(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	old := newTestNode(t, network, 10001)
+	// peers from before versioning don't advertise one
+	old.version = 0
+
+	for _, version := range []int{0, 1} {
+		args := PingArgs{Source: old.addr, Version: version}
+		var reply PingReply
+		if err := network.Call(context.Background(), node.addr, "Ping", args, &reply); err != nil {
+			t.Fatalf("PING advertising version %d failed: %s", version, err)
+		}
+	}
+	if !node.doPing(context.Background(), old.addr) {
+		t.Fatal("Old peer didn't answer a PING")
+	}
+	contact := node.rt.ContactFromID(old.id)
+	if contact == nil || contact.version != 1 {
+		t.Fatalf("Old peer should be in the table at version 1, got %v", contact)
+	}
+
+	if err := node.Put(context.Background(), []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("Put to an old peer failed: %s", err)
+	}
+	if len(old.ht.keys()) != 1 {
+		t.Errorf("Old peer holds %d keys after a Put, want 1", len(old.ht.keys()))
+	}
+
+	pairs := []KeyValue{{"a", []byte("1")}, {"b", []byte("2")}, {"c", []byte("3")}}
+	sent := atomic.LoadUint64(&node.stats.StoresSent)
+	if err := node.batchStore(context.Background(), *contact, pairs); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadUint64(&node.stats.StoresSent) - sent; got != uint64(len(pairs)) {
+		t.Errorf("Republish to an old peer sent %d RPCs, want one STORE per pair (%d)", got, len(pairs))
+	}
+	for _, pair := range pairs {
+		if _, ok := old.ht.get(pair.Key); !ok {
+			t.Errorf("Old peer is missing key %s", pair.Key)
+		}
+	}
+}
+
+// A current peer gets the whole republish in one BATCHSTORE
+func TestCurrentPeerGetsBatchStore(t *testing.T) {
+	network := NewMemoryNetwork()
+	node := newTestNode(t, network, 10000)
+	peer := newTestNode(t, network, 10001)
+	if !node.doPing(context.Background(), peer.addr) {
+		t.Fatal("Peer didn't answer a PING")
+	}
+	contact := node.rt.ContactFromID(peer.id)
+	if contact == nil || contact.version != protocolVersion {
+		t.Fatalf("Peer should be in the table at version %d, got %v", protocolVersion, contact)
+	}
+	pairs := []KeyValue{{"a", []byte("1")}, {"b", []byte("2")}}
+	sent := atomic.LoadUint64(&node.stats.StoresSent)
+	if err := node.batchStore(context.Background(), *contact, pairs); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadUint64(&node.stats.StoresSent) - sent; got != 1 {
+		t.Errorf("Republish sent %d RPCs, want a single BATCHSTORE", got)
+	}
+}